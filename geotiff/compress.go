@@ -0,0 +1,147 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package geotiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// inflate decompresses Deflate-compressed data expected to be n bytes long.
+func inflate(b []byte, n int) ([]byte, error) {
+	z, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	out := make([]byte, n)
+	if _, err := io.ReadFull(z, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// unpackBits decompresses PackBits-compressed data expected to be n bytes
+// long.
+func unpackBits(b []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(b) && len(out) < n; {
+		c := int(int8(b[i]))
+		i++
+		switch {
+		case c >= 0:
+			// Copy the next c+1 bytes literally.
+			if i+c+1 > len(b) {
+				return nil, FormatError("short PackBits literal")
+			}
+			out = append(out, b[i:i+c+1]...)
+			i += c + 1
+		case c != -128:
+			// Repeat the next byte 1-c times.
+			if i >= len(b) {
+				return nil, FormatError("short PackBits run")
+			}
+			for j := 0; j < 1-c; j++ {
+				out = append(out, b[i])
+			}
+			i++
+		}
+	}
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+// unLZW decompresses TIFF LZW-compressed data expected to be n bytes long.
+// TIFF LZW codes are packed most significant bit first, and the code width
+// grows one code earlier than in GIF and the compress/lzw package.
+func unLZW(b []byte, n int) ([]byte, error) {
+	const (
+		clear   = 256
+		eoi     = 257
+		maxCode = 4096
+	)
+	var (
+		prefix [maxCode]uint16
+		suffix [maxCode]byte
+		length [maxCode]int
+	)
+	for i := 0; i < 256; i++ {
+		suffix[i] = byte(i)
+		length[i] = 1
+	}
+	out := make([]byte, 0, n)
+
+	// emit appends the string for code to out.
+	emit := func(code int) {
+		start := len(out)
+		for i := 0; i < length[code]; i++ {
+			out = append(out, 0)
+		}
+		for i := len(out) - 1; i >= start; i-- {
+			out[i] = suffix[code]
+			code = int(prefix[code])
+		}
+	}
+
+	var (
+		bits  uint32
+		nbits uint
+		width uint = 9
+		next       = eoi + 1
+		prev       = -1
+	)
+	for i := 0; len(out) < n; {
+		for nbits < width {
+			if i >= len(b) {
+				return out, nil // tolerate a missing EOI code
+			}
+			bits = bits<<8 | uint32(b[i])
+			nbits += 8
+			i++
+		}
+		code := int(bits >> (nbits - width) & (1<<width - 1))
+		nbits -= width
+
+		switch {
+		case code == clear:
+			width, next, prev = 9, eoi+1, -1
+			continue
+		case code == eoi:
+			return out, nil
+		case prev == -1:
+			if code > 255 {
+				return nil, FormatError("invalid LZW code")
+			}
+			out = append(out, byte(code))
+			prev = code
+			continue
+		}
+
+		// Emit the string for code, and add the previous string followed by
+		// the first byte of this one to the table.
+		start := len(out)
+		switch {
+		case code < next:
+			emit(code)
+		case code == next:
+			emit(prev)
+			out = append(out, out[start])
+		default:
+			return nil, FormatError("invalid LZW code")
+		}
+		if next < maxCode {
+			prefix[next] = uint16(prev)
+			suffix[next] = out[start]
+			length[next] = length[prev] + 1
+			next++
+		}
+		if next+1 >= 1<<width && width < 12 {
+			width++
+		}
+		prev = code
+	}
+	return out, nil
+}
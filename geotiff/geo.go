@@ -0,0 +1,99 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package geotiff
+
+// GeoKeys.
+const (
+	gkModelType      = 1024
+	gkRasterType     = 1025
+	gkGeographicType = 2048
+	gkProjectedType  = 3072
+)
+
+// GTModelTypeGeoKey and GTRasterTypeGeoKey values.
+const (
+	modelProjected  = 1
+	modelGeographic = 2
+	rasterIsPoint   = 2
+)
+
+// A Georeference relates the pixels of an image to a model coordinate
+// reference system.
+type Georeference struct {
+	// Transform maps the raster space (i, j), in which (0, 0) is the top-left
+	// corner of the top-left pixel, to model coordinates:
+	//	x = Transform[0]*i + Transform[1]*j + Transform[2]
+	//	y = Transform[3]*i + Transform[4]*j + Transform[5]
+	Transform [6]float64
+
+	// EPSG is the EPSG code of the model coordinate reference system,
+	// or 0 if it is not known.
+	EPSG int
+
+	// Geographic reports whether the model coordinate reference system is
+	// geographic, with coordinates in degrees of longitude and latitude.
+	Geographic bool
+}
+
+// Apply returns the model coordinates of the raster point (i, j).
+func (g *Georeference) Apply(i, j float64) (x, y float64) {
+	t := &g.Transform
+	return t[0]*i + t[1]*j + t[2], t[3]*i + t[4]*j + t[5]
+}
+
+// georeference reads the GeoTIFF tags. It returns nil if the image has no
+// model transformation.
+func (d *Reader) georeference() (*Georeference, error) {
+	g := new(Georeference)
+	if m := d.floats(tModelTransformation); len(m) == 16 {
+		g.Transform = [6]float64{m[0], m[1], m[3], m[4], m[5], m[7]}
+	} else {
+		tp := d.floats(tModelTiepoint)
+		sc := d.floats(tModelPixelScale)
+		if len(tp) < 6 || len(sc) < 2 {
+			return nil, nil
+		}
+		// Only the first tiepoint is used; images georeferenced by a
+		// set of tiepoints without a pixel scale are not supported.
+		i, j, x, y := tp[0], tp[1], tp[3], tp[4]
+		g.Transform = [6]float64{sc[0], 0, x - i*sc[0], 0, -sc[1], y + j*sc[1]}
+	}
+
+	keys := d.geoKeys()
+	switch keys[gkModelType] {
+	case modelProjected:
+		g.EPSG = keys[gkProjectedType]
+	case modelGeographic:
+		g.EPSG = keys[gkGeographicType]
+		g.Geographic = true
+	}
+	if g.EPSG == 32767 { // user-defined
+		g.EPSG = 0
+	}
+
+	// Model coordinates of PixelIsPoint images refer to pixel centers.
+	if keys[gkRasterType] == rasterIsPoint {
+		t := &g.Transform
+		t[2] -= (t[0] + t[1]) / 2
+		t[5] -= (t[3] + t[4]) / 2
+	}
+	return g, nil
+}
+
+// geoKeys returns the short-valued keys of the GeoKeyDirectory.
+func (d *Reader) geoKeys() map[int]int {
+	keys := make(map[int]int)
+	dir := d.ints(tGeoKeyDirectory)
+	if len(dir) < 4 {
+		return keys
+	}
+	n := int(dir[3])
+	for i := 0; i < n && 4+4*i+3 < len(dir); i++ {
+		e := dir[4+4*i : 8+4*i]
+		// A location of 0 means the value is held in the entry itself.
+		if e[1] == 0 {
+			keys[int(e[0])] = int(e[3])
+		}
+	}
+	return keys
+}
@@ -0,0 +1,364 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package geotiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// writeTIFF lays out a little-endian TIFF holding the IFD entries ifd, to
+// which it adds the offsets and byte counts of the strips.
+func writeTIFF(ifd []*entry, strips [][]byte) []byte {
+	offsets := &entry{tag: tStripOffsets, typ: dtLong, ints: make([]uint32, len(strips))}
+	counts := &entry{tag: tStripByteCounts, typ: dtLong}
+	for _, s := range strips {
+		counts.ints = append(counts.ints, uint32(len(s)))
+	}
+	ifd = append(ifd, offsets, counts)
+	for i := 1; i < len(ifd); i++ {
+		for j := i; j > 0 && ifd[j].tag < ifd[j-1].tag; j-- {
+			ifd[j], ifd[j-1] = ifd[j-1], ifd[j]
+		}
+	}
+	off := 8 + 2 + 12*len(ifd) + 4
+	for _, e := range ifd {
+		if n := e.size(); n > 4 {
+			off += n
+		}
+	}
+	for i, s := range strips {
+		offsets.ints[i] = uint32(off)
+		off += len(s)
+	}
+
+	le := binary.LittleEndian
+	buf, extra := new(bytes.Buffer), new(bytes.Buffer)
+	buf.WriteString(leHeader)
+	binary.Write(buf, le, uint32(8))
+	binary.Write(buf, le, uint16(len(ifd)))
+	for _, e := range ifd {
+		v := new(bytes.Buffer)
+		for _, n := range e.ints {
+			if e.typ == dtShort {
+				binary.Write(v, le, uint16(n))
+			} else {
+				binary.Write(v, le, n)
+			}
+		}
+		binary.Write(buf, le, uint16(e.tag))
+		binary.Write(buf, le, uint16(e.typ))
+		binary.Write(buf, le, uint32(e.count()))
+		if v.Len() > 4 {
+			binary.Write(buf, le, uint32(8+2+12*len(ifd)+4+extra.Len()))
+			extra.Write(v.Bytes())
+			continue
+		}
+		for v.Len() < 4 {
+			v.WriteByte(0)
+		}
+		buf.Write(v.Bytes())
+	}
+	binary.Write(buf, le, uint32(0))
+	buf.Write(extra.Bytes())
+	for _, s := range strips {
+		buf.Write(s)
+	}
+	return buf.Bytes()
+}
+
+// compressLZW compresses b with TIFF LZW, whose code width grows one code
+// earlier than the decoder's table.
+func compressLZW(b []byte) []byte {
+	var (
+		out   []byte
+		bits  uint32
+		nbits uint
+		width uint = 9
+		next       = 258
+		table      = make(map[string]int)
+	)
+	put := func(code int) {
+		bits = bits<<width | uint32(code)
+		nbits += width
+		for nbits >= 8 {
+			out = append(out, byte(bits>>(nbits-8)))
+			nbits -= 8
+		}
+	}
+	put(256)
+	var s string
+	for i := range b {
+		c := string(b[i : i+1])
+		if _, ok := table[s+c]; ok || s == "" {
+			s += c
+			continue
+		}
+		put(lzwCode(table, s))
+		table[s+c] = next
+		if next++; next >= 1<<width {
+			width++
+		}
+		if next >= 4093 {
+			put(256)
+			table, width, next = make(map[string]int), 9, 258
+		}
+		s = c
+	}
+	if s != "" {
+		put(lzwCode(table, s))
+		if next++; next >= 1<<width {
+			width++
+		}
+	}
+	put(257)
+	if nbits > 0 {
+		out = append(out, byte(bits<<(8-nbits)))
+	}
+	return out
+}
+
+// lzwCode returns the code of the string s, which is a single byte or in
+// table.
+func lzwCode(table map[string]int, s string) int {
+	if len(s) == 1 {
+		return int(s[0])
+	}
+	return table[s]
+}
+
+// compressPackBits compresses b with PackBits, as runs where bytes repeat
+// and literals elsewhere.
+func compressPackBits(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		n := 1
+		for n < len(b) && n < 128 && b[n] == b[0] {
+			n++
+		}
+		if n > 1 {
+			out = append(out, byte(1-n), b[0])
+			b = b[n:]
+			continue
+		}
+		for n < len(b) && n < 128 && (n+1 == len(b) || b[n] != b[n+1]) {
+			n++
+		}
+		out = append(out, byte(n-1))
+		out = append(out, b[:n]...)
+		b = b[n:]
+	}
+	return out
+}
+
+// testImage returns an opaque RGB image with runs of equal pixels.
+func testImage(width, height int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	c := color.RGBA{A: 255}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if rnd.Intn(4) == 0 {
+				c = color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+// encodeRGB encodes the RGB samples of m as a TIFF with the specified
+// compression, predictor, sample layout and bits per sample, in strips of the
+// specified number of rows.
+func encodeRGB(m *image.RGBA, compression, predictor int, planar bool, bps, rows int) []byte {
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	planes, spp := 1, 3
+	if planar {
+		planes, spp = 3, 1
+	}
+	var strips [][]byte
+	for p := 0; p < planes; p++ {
+		for y := 0; y < h; y += rows {
+			var b []byte
+			for r := y; r < y+rows && r < h; r++ {
+				row := make([]byte, 0, w*spp*bps/8)
+				for x := 0; x < w; x++ {
+					for s := p; s < p+spp; s++ {
+						v := m.Pix[m.PixOffset(x, r)+s]
+						if bps == 16 {
+							row = append(row, v, v) // v*257, little-endian
+						} else {
+							row = append(row, v)
+						}
+					}
+				}
+				if predictor == 2 {
+					differentiate(row, spp, bps)
+				}
+				b = append(b, row...)
+			}
+			switch compression {
+			case cLZW:
+				b = compressLZW(b)
+			case cDeflate:
+				buf := new(bytes.Buffer)
+				z := zlib.NewWriter(buf)
+				z.Write(b)
+				z.Close()
+				b = buf.Bytes()
+			case cPackBits:
+				b = compressPackBits(b)
+			}
+			strips = append(strips, b)
+		}
+	}
+	planarConfig := uint32(1)
+	if planar {
+		planarConfig = 2
+	}
+	b := uint32(bps)
+	return writeTIFF([]*entry{
+		{tag: tImageWidth, typ: dtLong, ints: []uint32{uint32(w)}},
+		{tag: tImageLength, typ: dtLong, ints: []uint32{uint32(h)}},
+		{tag: tBitsPerSample, typ: dtShort, ints: []uint32{b, b, b}},
+		{tag: tCompression, typ: dtShort, ints: []uint32{uint32(compression)}},
+		{tag: tPhotometricInterpretation, typ: dtShort, ints: []uint32{pRGB}},
+		{tag: tSamplesPerPixel, typ: dtShort, ints: []uint32{3}},
+		{tag: tRowsPerStrip, typ: dtLong, ints: []uint32{uint32(rows)}},
+		{tag: tPlanarConfiguration, typ: dtShort, ints: []uint32{planarConfig}},
+		{tag: tPredictor, typ: dtShort, ints: []uint32{uint32(predictor)}},
+	}, strips)
+}
+
+// differentiate applies horizontal differencing to a row of little-endian
+// samples, spp to a pixel.
+func differentiate(row []byte, spp, bps int) {
+	if bps == 8 {
+		for i := len(row) - 1; i >= spp; i-- {
+			row[i] -= row[i-spp]
+		}
+		return
+	}
+	le := binary.LittleEndian
+	for i := len(row) - 2; i >= 2*spp; i -= 2 {
+		le.PutUint16(row[i:], le.Uint16(row[i:])-le.Uint16(row[i-2*spp:]))
+	}
+}
+
+// decode reads the whole of the TIFF image held in b.
+func decode(b []byte) (*image.RGBA, error) {
+	d, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	w, h := d.Size()
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	if err := d.Read(m, 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func TestDecodeRGB(t *testing.T) {
+	m := testImage(37, 23)
+	for _, compression := range []int{cNone, cLZW, cDeflate, cPackBits} {
+		for _, predictor := range []int{1, 2} {
+			for _, planar := range []bool{false, true} {
+				for _, bps := range []int{8, 16} {
+					desc := fmt.Sprintf("compression %d, predictor %d, planar %v, %d bits", compression, predictor, planar, bps)
+					got, err := decode(encodeRGB(m, compression, predictor, planar, bps, 5))
+					if err != nil {
+						t.Errorf("%s: %v", desc, err)
+						continue
+					}
+					if !bytes.Equal(got.Pix, m.Pix) {
+						t.Errorf("%s: pixels differ", desc)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 300, 211))
+	for y := 0; y < 211; y++ {
+		for x := 0; x < 300; x++ {
+			a := uint8(x * 7)
+			m.SetRGBA(x, y, color.RGBA{uint8(x) & a, uint8(y) & a, uint8(x*y) & a, a})
+		}
+	}
+	for _, g := range []*Georeference{
+		nil,
+		{Transform: [6]float64{2, 0, 100, 0, -3, 500}, EPSG: 3857},
+		{Transform: [6]float64{0.1, 0, -10, 0, -0.1, 50}, EPSG: 4326, Geographic: true},
+		{Transform: [6]float64{1, 0.5, 0, 0.25, -1, 9}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, m, g); err != nil {
+			t.Fatalf("%+v: %v", g, err)
+		}
+		d, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%+v: %v", g, err)
+		}
+		if got := d.Georeference(); (got == nil) != (g == nil) || got != nil && *got != *g {
+			t.Errorf("%+v: Georeference = %+v", g, got)
+		}
+		got, err := decode(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%+v: %v", g, err)
+		}
+		if !bytes.Equal(got.Pix, m.Pix) {
+			t.Errorf("%+v: pixels differ", g)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, testImage(100, 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	d, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strips := int(d.offsets[0])
+	for _, n := range []int{4, 20, strips - 1, strips, strips + 1, len(b) / 2, len(b) - 1} {
+		_, err := decode(b[:n])
+		switch {
+		case err == nil:
+			t.Errorf("file cut to %d bytes: no error", n)
+		case n >= strips && err != io.ErrUnexpectedEOF:
+			t.Errorf("file cut to %d bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestFieldTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, testImage(10, 10), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	le := binary.LittleEndian
+	n := int(le.Uint16(b[8:]))
+	for i := 0; i < n; i++ {
+		e := b[10+12*i:]
+		if le.Uint16(e) == tStripOffsets {
+			le.PutUint32(e[4:], maxFieldBytes/4+1)
+		}
+	}
+	if _, err := NewReader(bytes.NewReader(b)); err != FormatError("field too large") {
+		t.Errorf("NewReader: got %v, want %v", err, FormatError("field too large"))
+	}
+}
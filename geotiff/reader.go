@@ -0,0 +1,641 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+// Package geotiff reads and writes TIFF images, including the GeoTIFF tags
+// that georeference them.
+//
+// The reader handles striped and tiled layouts, chunky and planar sample
+// organization, uncompressed, LZW, Deflate and PackBits compression, bilevel,
+// grayscale, paletted and RGB images with 1 to 16 bits per sample, and any
+// number of extra bands. Images are decoded a band of rows at a time, so that
+// large images need not be held in memory.
+package geotiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// A FormatError reports that the input is not a valid TIFF image.
+type FormatError string
+
+func (e FormatError) Error() string { return "tiff: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented
+// TIFF feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "tiff: unsupported feature: " + string(e) }
+
+const (
+	leHeader = "II\x2A\x00" // little-endian byte order
+	beHeader = "MM\x00\x2A" // big-endian byte order
+)
+
+// TIFF tags.
+const (
+	tImageWidth                = 256
+	tImageLength               = 257
+	tBitsPerSample             = 258
+	tCompression               = 259
+	tPhotometricInterpretation = 262
+	tStripOffsets              = 273
+	tSamplesPerPixel           = 277
+	tRowsPerStrip              = 278
+	tStripByteCounts           = 279
+	tMinSampleValue            = 280
+	tMaxSampleValue            = 281
+	tPlanarConfiguration       = 284
+	tPredictor                 = 317
+	tColorMap                  = 320
+	tTileWidth                 = 322
+	tTileLength                = 323
+	tTileOffsets               = 324
+	tTileByteCounts            = 325
+	tExtraSamples              = 338
+	tSampleFormat              = 339
+
+	tModelPixelScale     = 33550
+	tModelTiepoint       = 33922
+	tModelTransformation = 34264
+	tGeoKeyDirectory     = 34735
+	tGeoDoubleParams     = 34736
+	tGeoASCIIParams      = 34737
+)
+
+// TIFF field types.
+const (
+	dtByte      = 1
+	dtASCII     = 2
+	dtShort     = 3
+	dtLong      = 4
+	dtRational  = 5
+	dtSByte     = 6
+	dtUndefined = 7
+	dtSShort    = 8
+	dtSLong     = 9
+	dtSRational = 10
+	dtFloat     = 11
+	dtDouble    = 12
+)
+
+var typeSize = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// Compression schemes.
+const (
+	cNone     = 1
+	cLZW      = 5
+	cDeflate  = 8
+	cPackBits = 32773
+	cDeflate2 = 32946 // obsolete Deflate code
+)
+
+// Photometric interpretations.
+const (
+	pWhiteIsZero = 0
+	pBlackIsZero = 1
+	pRGB         = 2
+	pPaletted    = 3
+)
+
+// maxBlockBytes limits the decoded size of a single strip or tile.
+const maxBlockBytes = 256 << 20
+
+// maxFieldBytes limits the size of the value of an IFD entry. The largest
+// are the offsets and byte counts of strips or tiles, which for the largest
+// images supported take a few hundred kilobytes.
+const maxFieldBytes = 4 << 20
+
+// A field is a decoded IFD entry.
+type field struct {
+	typ  int
+	ints []uint64
+	flts []float64
+	str  string
+}
+
+// A Reader decodes a TIFF image held in an io.ReaderAt.
+type Reader struct {
+	r      io.ReaderAt
+	order  binary.ByteOrder
+	fields map[int]*field
+
+	width, height int
+	bps           int // bits per sample
+	spp           int // samples per pixel
+	photometric   int
+	compression   int
+	predictor     int
+	planar        bool
+	alpha         int  // index of the alpha sample, or -1
+	premultiplied bool // whether color samples are premultiplied by alpha
+	minVal        uint64
+	maxVal        uint64
+	colorMap      []uint64
+
+	blockW, blockH int // strip or tile dimensions
+	tiled          bool
+	offsets        []uint64
+	counts         []uint64
+
+	geo *Georeference
+}
+
+// NewReader reads the header and first image file directory of the TIFF image
+// held in r. It returns image.ErrFormat if r does not hold a TIFF image.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	p := make([]byte, 8)
+	if _, err := r.ReadAt(p, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d := &Reader{r: r, fields: make(map[int]*field)}
+	switch string(p[:4]) {
+	case leHeader:
+		d.order = binary.LittleEndian
+	case beHeader:
+		d.order = binary.BigEndian
+	default:
+		return nil, image.ErrFormat
+	}
+	if err := d.readIFD(int64(d.order.Uint32(p[4:8]))); err != nil {
+		return nil, err
+	}
+	if err := d.parse(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readIFD reads the fields of the image file directory at the given offset.
+func (d *Reader) readIFD(off int64) error {
+	var b [2]byte
+	if _, err := d.r.ReadAt(b[:], off); err != nil {
+		return FormatError("bad IFD offset")
+	}
+	n := int(d.order.Uint16(b[:]))
+	entries := make([]byte, 12*n)
+	if _, err := d.r.ReadAt(entries, off+2); err != nil {
+		return FormatError("short IFD")
+	}
+	for i := 0; i < n; i++ {
+		e := entries[12*i : 12*(i+1)]
+		tag := int(d.order.Uint16(e[0:2]))
+		typ := int(d.order.Uint16(e[2:4]))
+		count := int64(d.order.Uint32(e[4:8]))
+		if typ <= 0 || typ >= len(typeSize) {
+			continue // unknown types are to be ignored
+		}
+		size := int64(typeSize[typ]) * count
+		if size < 0 || size > maxFieldBytes {
+			return FormatError("field too large")
+		}
+		raw := e[8:12]
+		if size > 4 {
+			raw = make([]byte, size)
+			if _, err := d.r.ReadAt(raw, int64(d.order.Uint32(e[8:12]))); err != nil {
+				return FormatError("bad field offset")
+			}
+		}
+		d.fields[tag] = d.decodeField(typ, int(count), raw)
+	}
+	return nil
+}
+
+func (d *Reader) decodeField(typ, count int, raw []byte) *field {
+	f := &field{typ: typ}
+	switch typ {
+	case dtASCII:
+		s := raw[:count]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		f.str = string(s)
+	case dtByte, dtUndefined, dtSByte:
+		for _, v := range raw[:count] {
+			f.ints = append(f.ints, uint64(v))
+		}
+	case dtShort, dtSShort:
+		for i := 0; i < count; i++ {
+			f.ints = append(f.ints, uint64(d.order.Uint16(raw[2*i:])))
+		}
+	case dtLong, dtSLong:
+		for i := 0; i < count; i++ {
+			f.ints = append(f.ints, uint64(d.order.Uint32(raw[4*i:])))
+		}
+	case dtRational, dtSRational:
+		for i := 0; i < count; i++ {
+			n, m := d.order.Uint32(raw[8*i:]), d.order.Uint32(raw[8*i+4:])
+			if typ == dtSRational {
+				f.flts = append(f.flts, float64(int32(n))/float64(int32(m)))
+			} else {
+				f.flts = append(f.flts, float64(n)/float64(m))
+			}
+		}
+	case dtFloat:
+		for i := 0; i < count; i++ {
+			f.flts = append(f.flts, float64(math.Float32frombits(d.order.Uint32(raw[4*i:]))))
+		}
+	case dtDouble:
+		for i := 0; i < count; i++ {
+			f.flts = append(f.flts, math.Float64frombits(d.order.Uint64(raw[8*i:])))
+		}
+	}
+	return f
+}
+
+// int returns the first value of an integer field, or def if it is absent.
+func (d *Reader) int(tag int, def int) int {
+	f := d.fields[tag]
+	if f == nil || len(f.ints) == 0 {
+		return def
+	}
+	return int(f.ints[0])
+}
+
+// floats returns the values of a numeric field as float64s.
+func (d *Reader) floats(tag int) []float64 {
+	f := d.fields[tag]
+	if f == nil {
+		return nil
+	}
+	if f.flts != nil {
+		return f.flts
+	}
+	v := make([]float64, len(f.ints))
+	for i, n := range f.ints {
+		v[i] = float64(n)
+	}
+	return v
+}
+
+// parse interprets the baseline fields and checks that the image is one we
+// can decode.
+func (d *Reader) parse() error {
+	d.width = d.int(tImageWidth, 0)
+	d.height = d.int(tImageLength, 0)
+	if d.width <= 0 || d.height <= 0 {
+		return FormatError("missing or invalid dimensions")
+	}
+	d.spp = d.int(tSamplesPerPixel, 1)
+	if d.spp < 1 {
+		return FormatError("invalid SamplesPerPixel")
+	}
+	d.bps = d.int(tBitsPerSample, 1)
+	if f := d.fields[tBitsPerSample]; f != nil {
+		for _, b := range f.ints {
+			if int(b) != d.bps {
+				return UnsupportedError("differing BitsPerSample")
+			}
+		}
+	}
+	switch d.bps {
+	case 1, 2, 4, 8, 16:
+	default:
+		return UnsupportedError(fmt.Sprintf("%d bits per sample", d.bps))
+	}
+	if f := d.fields[tSampleFormat]; f != nil {
+		for _, v := range f.ints {
+			if v != 1 {
+				return UnsupportedError("non-integer or signed samples")
+			}
+		}
+	}
+
+	d.compression = d.int(tCompression, cNone)
+	switch d.compression {
+	case cNone, cLZW, cDeflate, cDeflate2, cPackBits:
+	default:
+		return UnsupportedError(fmt.Sprintf("compression scheme %d", d.compression))
+	}
+	d.predictor = d.int(tPredictor, 1)
+	if d.predictor != 1 && (d.predictor != 2 || d.bps < 8) {
+		return UnsupportedError(fmt.Sprintf("predictor %d", d.predictor))
+	}
+	d.planar = d.int(tPlanarConfiguration, 1) == 2
+
+	d.photometric = d.int(tPhotometricInterpretation, pBlackIsZero)
+	switch d.photometric {
+	case pWhiteIsZero, pBlackIsZero:
+	case pRGB:
+		if d.spp < 3 {
+			return FormatError("RGB image with fewer than 3 samples")
+		}
+	case pPaletted:
+		d.colorMap = nil
+		if f := d.fields[tColorMap]; f != nil {
+			d.colorMap = f.ints
+		}
+		if len(d.colorMap) != 3<<uint(d.bps) || d.bps > 8 {
+			return FormatError("bad ColorMap")
+		}
+	default:
+		return UnsupportedError(fmt.Sprintf("photometric interpretation %d", d.photometric))
+	}
+
+	// The first extra sample, if it is alpha, follows the color samples.
+	d.alpha = -1
+	if f := d.fields[tExtraSamples]; f != nil && len(f.ints) > 0 {
+		color := d.spp - len(f.ints)
+		if f.ints[0] == 1 || f.ints[0] == 2 {
+			d.alpha = color
+			d.premultiplied = f.ints[0] == 1
+		}
+	}
+
+	d.maxVal = 1<<uint(d.bps) - 1
+	if v := d.int(tMaxSampleValue, 0); v > 0 && uint64(v) < d.maxVal {
+		d.maxVal = uint64(v)
+	}
+	if v := d.int(tMinSampleValue, 0); v > 0 && uint64(v) < d.maxVal {
+		d.minVal = uint64(v)
+	}
+
+	if d.fields[tTileWidth] != nil {
+		d.tiled = true
+		d.blockW = d.int(tTileWidth, 0)
+		d.blockH = d.int(tTileLength, 0)
+		d.offsets = d.ints(tTileOffsets)
+		d.counts = d.ints(tTileByteCounts)
+	} else {
+		d.blockW = d.width
+		d.blockH = d.int(tRowsPerStrip, d.height)
+		if d.blockH > d.height {
+			d.blockH = d.height
+		}
+		d.offsets = d.ints(tStripOffsets)
+		d.counts = d.ints(tStripByteCounts)
+	}
+	if d.blockW <= 0 || d.blockH <= 0 {
+		return FormatError("invalid strip or tile dimensions")
+	}
+	if int64(d.blockW)*int64(d.blockH)*int64(d.spp)*2 > maxBlockBytes {
+		return UnsupportedError("strip or tile too large")
+	}
+	n := d.blocksAcross() * d.blocksDown()
+	if d.planar {
+		n *= d.spp
+	}
+	if len(d.offsets) < n || len(d.counts) < n {
+		return FormatError("missing strip or tile offsets")
+	}
+
+	geo, err := d.georeference()
+	if err != nil {
+		return err
+	}
+	d.geo = geo
+	return nil
+}
+
+func (d *Reader) ints(tag int) []uint64 {
+	if f := d.fields[tag]; f != nil {
+		return f.ints
+	}
+	return nil
+}
+
+func (d *Reader) blocksAcross() int {
+	return (d.width + d.blockW - 1) / d.blockW
+}
+
+func (d *Reader) blocksDown() int {
+	return (d.height + d.blockH - 1) / d.blockH
+}
+
+// Size returns the dimensions of the image.
+func (d *Reader) Size() (width, height int) {
+	return d.width, d.height
+}
+
+// Georeference returns the image's georeferencing, or nil if it has none.
+func (d *Reader) Georeference() *Georeference {
+	return d.geo
+}
+
+// Read draws rows y to y+dst.Bounds().Dy() of the image into dst, whose width
+// must be that of the image, as alpha-premultiplied RGBA.
+func (d *Reader) Read(dst *image.RGBA, y int) error {
+	rows := dst.Rect.Dy()
+	if y < 0 || y+rows > d.height || dst.Rect.Dx() != d.width {
+		return errors.New("tiff: rows out of range")
+	}
+	for by := y / d.blockH; by*d.blockH < y+rows; by++ {
+		for bx := 0; bx < d.blocksAcross(); bx++ {
+			if err := d.readBlock(dst, y, bx, by); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readBlock decodes the strip or tile at (bx, by) and draws the part of it that
+// falls in rows y to y+dst.Bounds().Dy() into dst.
+func (d *Reader) readBlock(dst *image.RGBA, y, bx, by int) error {
+	// Strips at the bottom of the image may be short; tiles never are.
+	bh := d.blockH
+	if !d.tiled && (by+1)*bh > d.height {
+		bh = d.height - by*bh
+	}
+	planes, spp := 1, d.spp
+	if d.planar {
+		planes, spp = d.spp, 1
+	}
+	rowBytes := (d.blockW*spp*d.bps + 7) / 8
+
+	vals := make([]uint16, d.blockW*bh*d.spp)
+	for p := 0; p < planes; p++ {
+		i := by*d.blocksAcross() + bx + p*d.blocksAcross()*d.blocksDown()
+		b, err := d.decompress(d.offsets[i], d.counts[i], rowBytes*bh)
+		if err != nil {
+			return err
+		}
+		for row := 0; row < bh; row++ {
+			rb := b[row*rowBytes : (row+1)*rowBytes]
+			if d.predictor == 2 {
+				d.undoPredictor(rb, spp)
+			}
+			for x := 0; x < d.blockW; x++ {
+				for s := 0; s < spp; s++ {
+					vals[(row*d.blockW+x)*d.spp+p+s] = d.sample(rb, x*spp+s)
+				}
+			}
+		}
+	}
+
+	// Convert the part of the block that lies in the requested rows.
+	r := image.Rect(bx*d.blockW, by*d.blockH, bx*d.blockW+d.blockW, by*d.blockH+bh).
+		Intersect(image.Rect(0, y, d.width, y+dst.Rect.Dy()))
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		row := py - by*d.blockH
+		o := dst.PixOffset(dst.Rect.Min.X+r.Min.X, dst.Rect.Min.Y+py-y)
+		for px := r.Min.X; px < r.Max.X; px++ {
+			x := px - bx*d.blockW
+			v := vals[(row*d.blockW+x)*d.spp : (row*d.blockW+x+1)*d.spp]
+			d.pixel(dst.Pix[o:o+4], v)
+			o += 4
+		}
+	}
+	return nil
+}
+
+// decompress reads and decompresses a strip or tile, which should decode to n
+// bytes. It returns io.ErrUnexpectedEOF if the file ends within the strip or
+// tile, or if it decodes to fewer bytes.
+func (d *Reader) decompress(off, count uint64, n int) ([]byte, error) {
+	if count > maxBlockBytes {
+		return nil, UnsupportedError("strip or tile too large")
+	}
+	b := make([]byte, count)
+	if m, err := d.r.ReadAt(b, int64(off)); m < len(b) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var err error
+	switch d.compression {
+	case cLZW:
+		b, err = unLZW(b, n)
+	case cDeflate, cDeflate2:
+		b, err = inflate(b, n)
+	case cPackBits:
+		b, err = unpackBits(b, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// undoPredictor reverses horizontal differencing on a row of samples.
+func (d *Reader) undoPredictor(b []byte, spp int) {
+	switch d.bps {
+	case 8:
+		for i := spp; i < len(b); i++ {
+			b[i] += b[i-spp]
+		}
+	case 16:
+		for i := spp * 2; i+1 < len(b); i += 2 {
+			v := d.order.Uint16(b[i:]) + d.order.Uint16(b[i-spp*2:])
+			d.order.PutUint16(b[i:], v)
+		}
+	}
+}
+
+// sample returns the nth sample of a row.
+func (d *Reader) sample(b []byte, n int) uint16 {
+	switch d.bps {
+	case 16:
+		return d.order.Uint16(b[n*2:])
+	case 8:
+		return uint16(b[n])
+	}
+	bit := n * d.bps
+	shift := uint(8 - d.bps - bit%8)
+	return uint16(b[bit/8]>>shift) & (1<<uint(d.bps) - 1)
+}
+
+// scale maps a sample value from the range [minVal, maxVal] to 16 bits.
+func (d *Reader) scale(v uint16) uint32 {
+	if uint64(v) <= d.minVal {
+		return 0
+	}
+	if uint64(v) >= d.maxVal {
+		return 0xffff
+	}
+	return uint32((uint64(v) - d.minVal) * 0xffff / (d.maxVal - d.minVal))
+}
+
+// pixel writes the pixel with samples v to pix as alpha-premultiplied RGBA.
+// Images with more bands than their photometric interpretation requires are
+// shown using their first three bands as red, green and blue.
+func (d *Reader) pixel(pix []byte, v []uint16) {
+	var r, g, b uint32
+	a := uint32(0xffff)
+	switch {
+	case d.photometric == pPaletted:
+		n := 1 << uint(d.bps)
+		i := int(v[0])
+		r, g, b = uint32(d.colorMap[i]), uint32(d.colorMap[n+i]), uint32(d.colorMap[2*n+i])
+	case d.photometric == pRGB || (d.spp >= 3 && (d.alpha < 0 || d.alpha >= 3)):
+		r, g, b = d.scale(v[0]), d.scale(v[1]), d.scale(v[2])
+	default:
+		r = d.scale(v[0])
+		if d.photometric == pWhiteIsZero {
+			r = 0xffff - r
+		}
+		g, b = r, r
+	}
+	if d.alpha >= 0 {
+		a = d.scale(v[d.alpha])
+		if !d.premultiplied {
+			r, g, b = r*a/0xffff, g*a/0xffff, b*a/0xffff
+		}
+	}
+	pix[0] = uint8(r >> 8)
+	pix[1] = uint8(g >> 8)
+	pix[2] = uint8(b >> 8)
+	pix[3] = uint8(a >> 8)
+}
+
+func init() {
+	image.RegisterFormat("tiff", leHeader, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", beHeader, Decode, DecodeConfig)
+}
+
+// readerAt returns r as an io.ReaderAt, reading it into memory if it is not
+// one already.
+func readerAt(r io.Reader) (io.ReaderAt, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra, nil
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// Decode reads a TIFF image from r and returns it as an *image.RGBA.
+func Decode(r io.Reader) (image.Image, error) {
+	ra, err := readerAt(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewReader(ra)
+	if err != nil {
+		return nil, err
+	}
+	m := image.NewRGBA(image.Rect(0, 0, d.width, d.height))
+	if err := d.Read(m, 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DecodeConfig returns the color model and dimensions of a TIFF image without
+// decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	ra, err := readerAt(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	d, err := NewReader(ra)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: d.width, Height: d.height}, nil
+}
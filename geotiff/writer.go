@@ -0,0 +1,221 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package geotiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// stripBytes is the approximate uncompressed size of the strips written by
+// the encoder.
+const stripBytes = 256 << 10
+
+// An entry is an IFD entry to be written.
+type entry struct {
+	tag, typ int
+	ints     []uint32 // values of SHORT and LONG entries
+	flts     []float64
+}
+
+func (e *entry) count() int {
+	if e.typ == dtDouble {
+		return len(e.flts)
+	}
+	return len(e.ints)
+}
+
+func (e *entry) size() int {
+	return e.count() * typeSize[e.typ]
+}
+
+// Encode writes the image m to w in TIFF format, georeferenced by g if it is
+// not nil.
+func Encode(w io.Writer, m image.Image, g *Georeference) error {
+	b := m.Bounds()
+	return EncodeRows(w, b.Dx(), b.Dy(), g, func(dst *image.RGBA) error {
+		draw.Draw(dst, dst.Rect, m, b.Min.Add(dst.Rect.Min), draw.Src)
+		return nil
+	})
+}
+
+// EncodeRows writes an image of the specified size to w in TIFF format,
+// georeferenced by g if it is not nil. The image is produced a band of rows
+// at a time by calling read, from top to bottom, with a transparent dst whose
+// bounds are those of the band. Only the compressed image is held in memory.
+//
+// The image is written as 8-bit RGBA with associated alpha, in strips
+// compressed with Deflate and horizontal differencing.
+func EncodeRows(w io.Writer, width, height int, g *Georeference, read func(dst *image.RGBA) error) error {
+	if width <= 0 || height <= 0 {
+		return errors.New("tiff: empty image")
+	}
+	rows := stripBytes / (4 * width)
+	if rows < 1 {
+		rows = 1
+	}
+	if rows > height {
+		rows = height
+	}
+
+	// Compress the strips.
+	var strips [][]byte
+	band := image.NewRGBA(image.Rect(0, 0, width, rows))
+	for y := 0; y < height; y += rows {
+		n := rows
+		if height-y < n {
+			n = height - y
+		}
+		pix := band.Pix[:n*band.Stride]
+		for i := range pix {
+			pix[i] = 0
+		}
+		dst := &image.RGBA{Pix: pix, Stride: band.Stride, Rect: image.Rect(0, y, width, y+n)}
+		if err := read(dst); err != nil {
+			return err
+		}
+		for r := 0; r < n; r++ {
+			row := pix[r*band.Stride : r*band.Stride+4*width]
+			for i := len(row) - 1; i >= 4; i-- {
+				row[i] -= row[i-4]
+			}
+		}
+		buf := new(bytes.Buffer)
+		z := zlib.NewWriter(buf)
+		if _, err := z.Write(pix); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		strips = append(strips, buf.Bytes())
+	}
+
+	offsets := make([]uint32, len(strips))
+	counts := make([]uint32, len(strips))
+	for i, s := range strips {
+		counts[i] = uint32(len(s))
+	}
+	ifd := []*entry{
+		{tag: tImageWidth, typ: dtLong, ints: []uint32{uint32(width)}},
+		{tag: tImageLength, typ: dtLong, ints: []uint32{uint32(height)}},
+		{tag: tBitsPerSample, typ: dtShort, ints: []uint32{8, 8, 8, 8}},
+		{tag: tCompression, typ: dtShort, ints: []uint32{cDeflate}},
+		{tag: tPhotometricInterpretation, typ: dtShort, ints: []uint32{pRGB}},
+		{tag: tStripOffsets, typ: dtLong, ints: offsets},
+		{tag: tSamplesPerPixel, typ: dtShort, ints: []uint32{4}},
+		{tag: tRowsPerStrip, typ: dtLong, ints: []uint32{uint32(rows)}},
+		{tag: tStripByteCounts, typ: dtLong, ints: counts},
+		{tag: tPlanarConfiguration, typ: dtShort, ints: []uint32{1}},
+		{tag: tPredictor, typ: dtShort, ints: []uint32{2}},
+		{tag: tExtraSamples, typ: dtShort, ints: []uint32{1}}, // associated alpha
+	}
+	if g != nil {
+		ifd = append(ifd, g.entries()...)
+	}
+
+	// Lay out the file: the header, the IFD, the values that do not fit in
+	// their entries, and the strips.
+	off := 8 + 2 + 12*len(ifd) + 4
+	for _, e := range ifd {
+		if n := e.size(); n > 4 {
+			off += n + n&1
+		}
+	}
+	for i, s := range strips {
+		offsets[i] = uint32(off)
+		off += len(s)
+	}
+	if int64(off) > 1<<32-1 {
+		return errors.New("tiff: image too large")
+	}
+
+	buf := new(bytes.Buffer)
+	le := binary.LittleEndian
+	buf.WriteString(leHeader)
+	binary.Write(buf, le, uint32(8))
+	binary.Write(buf, le, uint16(len(ifd)))
+	extra := new(bytes.Buffer)
+	extraOff := 8 + 2 + 12*len(ifd) + 4
+	for _, e := range ifd {
+		v := new(bytes.Buffer)
+		for _, n := range e.ints {
+			if e.typ == dtShort {
+				binary.Write(v, le, uint16(n))
+			} else {
+				binary.Write(v, le, n)
+			}
+		}
+		binary.Write(v, le, e.flts)
+		binary.Write(buf, le, uint16(e.tag))
+		binary.Write(buf, le, uint16(e.typ))
+		binary.Write(buf, le, uint32(e.count()))
+		if v.Len() <= 4 {
+			for v.Len() < 4 {
+				v.WriteByte(0)
+			}
+			buf.Write(v.Bytes())
+			continue
+		}
+		binary.Write(buf, le, uint32(extraOff+extra.Len()))
+		if v.Len()&1 != 0 {
+			v.WriteByte(0)
+		}
+		extra.Write(v.Bytes())
+	}
+	binary.Write(buf, le, uint32(0)) // no next IFD
+	buf.Write(extra.Bytes())
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+	for _, s := range strips {
+		if _, err := w.Write(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries returns the GeoTIFF entries that record g.
+func (g *Georeference) entries() []*entry {
+	t := g.Transform
+	var es []*entry
+	if t[1] == 0 && t[3] == 0 {
+		es = []*entry{
+			{tag: tModelPixelScale, typ: dtDouble, flts: []float64{t[0], -t[4], 0}},
+			{tag: tModelTiepoint, typ: dtDouble, flts: []float64{0, 0, 0, t[2], t[5], 0}},
+		}
+	} else {
+		es = []*entry{{tag: tModelTransformation, typ: dtDouble, flts: []float64{
+			t[0], t[1], 0, t[2],
+			t[3], t[4], 0, t[5],
+			0, 0, 0, 0,
+			0, 0, 0, 1,
+		}}}
+	}
+
+	// The GeoKeyDirectory header is followed by entries of key, location,
+	// count and value, sorted by key.
+	keys := []uint32{1, 1, 0, 0}
+	add := func(key, value int) {
+		keys = append(keys, uint32(key), 0, 1, uint32(value))
+		keys[3]++
+	}
+	if g.EPSG == 0 {
+		add(gkRasterType, 1) // PixelIsArea
+	} else if g.Geographic {
+		add(gkModelType, modelGeographic)
+		add(gkRasterType, 1)
+		add(gkGeographicType, g.EPSG)
+	} else {
+		add(gkModelType, modelProjected)
+		add(gkRasterType, 1)
+		add(gkProjectedType, g.EPSG)
+	}
+	return append(es, &entry{tag: tGeoKeyDirectory, typ: dtShort, ints: keys})
+}
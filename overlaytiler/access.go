@@ -0,0 +1,103 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Every handler that acts on a single Overlay for a user gets it with
+// requestOverlay, or checks it with authorizeOverlay, stating the access it
+// needs. Users may do anything with the Overlays they own, and
+// administrators, when logged in, with any Overlay; others have the access
+// of the role the Overlay is shared with them in (see share.go). Overlays
+// that a user may not see are reported as not found, so that their keys
+// reveal nothing. Task handlers, which only administrators and the task
+// queues may call, use getOverlay instead.
+
+// An access is what a user may do with an Overlay.
+type access int
+
+const (
+	accessNone access = iota
+	accessView        // see an Overlay, its previews, tiles and downloads
+	accessEdit        // also place, process and export it
+	accessOwn         // also share it
+)
+
+// role returns the role, as reported to clients, of users with the access.
+func (a access) role() string {
+	switch a {
+	case accessOwn:
+		return roleOwner
+	case accessEdit:
+		return roleEditor
+	case accessView:
+		return roleViewer
+	}
+	return ""
+}
+
+// overlayAccess returns what the principal may do with the Overlay. The
+// principal's Groups must be loaded if the Overlay is shared with any.
+func overlayAccess(p *principal, o *Overlay) access {
+	switch {
+	case p == nil:
+		return accessNone
+	case o.Owner == p.UserID:
+		return accessOwn
+	case p.Admin && p.Token == nil:
+		return accessOwn
+	}
+	a := accessNone
+	for _, id := range p.identities() {
+		for _, s := range o.Editors {
+			if s == id {
+				return accessEdit
+			}
+		}
+		for _, s := range o.Viewers {
+			if s == id {
+				a = accessView
+			}
+		}
+	}
+	return a
+}
+
+// authorizeOverlay returns an appError if the principal is not allowed the
+// specified access to the Overlay.
+func authorizeOverlay(c appengine.Context, p *principal, o *Overlay, need access) *appError {
+	if p != nil && o.sharedWithGroups() {
+		if err := p.loadGroups(c); err != nil {
+			return appErrorf(err, "could not get groups")
+		}
+	}
+	switch a := overlayAccess(p, o); {
+	case a == accessNone:
+		return &appError{errNoOverlay, "overlay not found", http.StatusNotFound}
+	case a < need && need == accessOwn:
+		return &appError{nil, "only the owner may share this overlay", http.StatusForbidden}
+	case a < need:
+		return &appError{nil, "you may not change this overlay", http.StatusForbidden}
+	}
+	return nil
+}
+
+// requestOverlay fetches the Overlay identified by the "key" form value, as
+// getOverlay does, if the principal is allowed the specified access to it.
+func requestOverlay(c appengine.Context, p *principal, r *http.Request, need access) (*datastore.Key, *Overlay, *appError) {
+	k, o, err := loadOverlay(c, r.FormValue("key"))
+	if err == errNoOverlay {
+		return nil, nil, &appError{err, "overlay not found", http.StatusNotFound}
+	} else if err != nil {
+		return nil, nil, appErrorf(err, "could not get overlay")
+	}
+	if e := authorizeOverlay(c, p, o, need); e != nil {
+		return nil, nil, e
+	}
+	return k, o, nil
+}
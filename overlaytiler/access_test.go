@@ -0,0 +1,55 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"net/http"
+	"testing"
+
+	"appengine/datastore"
+)
+
+// accessTests are attempts by various users to use an Overlay owned by
+// "owner", shared with a viewer, an editor and a Group.
+var accessTests = []struct {
+	desc string
+	p    *principal
+	need access
+	want access
+	code int // of authorizeOverlay, or 0 if allowed
+}{
+	{"owner shares", &principal{UserID: "owner", Email: "owner@example.com", groupsLoaded: true}, accessOwn, accessOwn, 0},
+	{"nobody views", nil, accessView, accessNone, http.StatusNotFound},
+	{"other user views", &principal{UserID: "other", Email: "other@example.com", groupsLoaded: true}, accessView, accessNone, http.StatusNotFound},
+	{"other user edits", &principal{UserID: "other", Email: "other@example.com", groupsLoaded: true}, accessEdit, accessNone, http.StatusNotFound},
+	{"viewer views", &principal{UserID: "v", Email: "viewer@example.com", groupsLoaded: true}, accessView, accessView, 0},
+	{"viewer edits", &principal{UserID: "v", Email: "viewer@example.com", groupsLoaded: true}, accessEdit, accessView, http.StatusForbidden},
+	{"editor edits", &principal{UserID: "e", Email: "editor@example.com", groupsLoaded: true}, accessEdit, accessEdit, 0},
+	{"editor shares", &principal{UserID: "e", Email: "editor@example.com", groupsLoaded: true}, accessOwn, accessEdit, http.StatusForbidden},
+	{"admin shares", &principal{UserID: "admin", Email: "admin@example.com", Admin: true, groupsLoaded: true}, accessOwn, accessOwn, 0},
+	{"admin views with token", &principal{UserID: "admin", Email: "admin@example.com", Admin: true, Token: new(datastore.Key), groupsLoaded: true}, accessView, accessNone, http.StatusNotFound},
+	{"group member views", &principal{UserID: "m", Email: "member@example.com", Groups: []string{"42"}, groupsLoaded: true}, accessView, accessView, 0},
+	{"group member edits", &principal{UserID: "m", Email: "member@example.com", Groups: []string{"42"}, groupsLoaded: true}, accessEdit, accessView, http.StatusForbidden},
+	{"other group member views", &principal{UserID: "n", Email: "nonmember@example.com", Groups: []string{"43"}, groupsLoaded: true}, accessView, accessNone, http.StatusNotFound},
+}
+
+func TestOverlayAccess(t *testing.T) {
+	o := &Overlay{
+		Owner:   "owner",
+		Viewers: []string{"viewer@example.com", groupPrefix + "42"},
+		Editors: []string{"editor@example.com"},
+	}
+	for _, tt := range accessTests {
+		if got := overlayAccess(tt.p, o); got != tt.want {
+			t.Errorf("%s: overlayAccess = %v, want %v", tt.desc, got, tt.want)
+		}
+		// The principals' Groups are loaded, so no context is needed.
+		e := authorizeOverlay(nil, tt.p, o, tt.need)
+		switch {
+		case e == nil && tt.code != 0:
+			t.Errorf("%s: authorizeOverlay allowed access, want status %d", tt.desc, tt.code)
+		case e != nil && e.Code != tt.code:
+			t.Errorf("%s: authorizeOverlay gave status %d, want %d", tt.desc, e.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Faded or yellowed scans may be corrected by adjusting the colours of the
+// Overlay's image: its levels, gamma, brightness, contrast and saturation,
+// and a tint. The adjustments are applied, in that order, as the image is
+// read, so the source is adjusted once for all of the tiles, mosaics and
+// exports drawn from it. A preview of them is served by previewHandler.
+
+const (
+	minGamma = 0.1
+	maxGamma = 10.0
+)
+
+// adjusted reports whether the colours of the Overlay's image are adjusted.
+func (o *Overlay) adjusted() bool {
+	return o.Levels != nil || (o.Gamma != 0 && o.Gamma != 1) || o.Brightness != 0 ||
+		o.Contrast != 0 || o.Saturation != 0 || o.Grayscale || o.Tint != ""
+}
+
+// parseAdjustments sets the Overlay's adjustments from the parameters of a
+// request, which param returns by name:
+//
+//	levels      input black and white points, as "black,white" from 0 to 255
+//	gamma       from 0.1 to 10
+//	brightness  from -1 to 1
+//	contrast    from -1 to 1
+//	saturation  from -1 to 1
+//	grayscale   true or false
+//	tint        a colour, as "#rrggbb", by which the image is multiplied
+//
+// Parameters that are not given leave the image unchanged.
+func parseAdjustments(o *Overlay, param func(string) string) error {
+	o.Levels, o.Gamma, o.Brightness, o.Contrast = nil, 0, 0, 0
+	o.Saturation, o.Grayscale, o.Tint = 0, false, ""
+	if v := param("levels"); v != "" {
+		p, err := parsePair(v)
+		if err != nil {
+			return fmt.Errorf("invalid parameter levels: %v", err)
+		}
+		if !(p[0] >= 0 && p[0] < p[1] && p[1] <= 255) {
+			return fmt.Errorf("invalid parameter levels: must be black and white points from 0 to 255, black first")
+		}
+		o.Levels = p
+	}
+	if v := param("gamma"); v != "" {
+		g, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(g >= minGamma && g <= maxGamma) {
+			return fmt.Errorf("invalid parameter gamma: must be from %g to %g", minGamma, maxGamma)
+		}
+		o.Gamma = g
+	}
+	for _, f := range []struct {
+		name string
+		v    *float64
+	}{
+		{"brightness", &o.Brightness},
+		{"contrast", &o.Contrast},
+		{"saturation", &o.Saturation},
+	} {
+		v := param(f.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(x >= -1 && x <= 1) {
+			return fmt.Errorf("invalid parameter %s: must be from -1 to 1", f.name)
+		}
+		*f.v = x
+	}
+	if v := param("grayscale"); v != "" {
+		var err error
+		if o.Grayscale, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid parameter grayscale")
+		}
+	}
+	if v := param("tint"); v != "" {
+		if _, err := parseColor(v); err != nil {
+			return fmt.Errorf("invalid parameter tint: %v", err)
+		}
+		o.Tint = "#" + strings.ToLower(strings.TrimPrefix(v, "#"))
+	}
+	return nil
+}
+
+// adjustSource returns src with its colours adjusted as the Overlay
+// specifies.
+func adjustSource(o *Overlay, src imageSource) imageSource {
+	if !o.adjusted() {
+		return src
+	}
+	s := &adjustedSource{src: src, saturation: 1 + o.Saturation}
+	if o.Grayscale {
+		s.saturation = 0
+	}
+	s.tint = [3]float64{1, 1, 1}
+	if t, err := parseColor(o.Tint); err == nil {
+		for i := range t {
+			s.tint[i] = float64(t[i]) / 0xff
+		}
+	}
+	black, white := 0.0, 255.0
+	if o.Levels != nil {
+		black, white = o.Levels[0], o.Levels[1]
+	}
+	gamma := 1.0
+	if o.Gamma != 0 {
+		gamma = o.Gamma
+	}
+	// Levels, gamma, brightness and contrast apply to each component alike,
+	// so they are combined into one table.
+	for i := range s.table {
+		v := (float64(i) - black) / (white - black)
+		v = math.Pow(clamp(v), 1/gamma)
+		v += o.Brightness
+		v = (v-0.5)*(1+o.Contrast) + 0.5
+		s.table[i] = clamp(v)
+	}
+	return s
+}
+
+// clamp returns v limited to the range from 0 to 1.
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// An adjustedSource is an imageSource whose colours are adjusted as they are
+// read.
+type adjustedSource struct {
+	src        imageSource
+	table      [256]float64 // levels, gamma, brightness and contrast
+	saturation float64      // 0 is grey, 1 unchanged
+	tint       [3]float64
+}
+
+func (s *adjustedSource) levels() int {
+	return s.src.levels()
+}
+
+func (s *adjustedSource) level(n int) image.Image {
+	return &adjustedImage{s, s.src.level(n)}
+}
+
+func (s *adjustedSource) err() error {
+	return s.src.err()
+}
+
+// An adjustedImage is a level of detail of an adjustedSource.
+type adjustedImage struct {
+	s *adjustedSource
+	m image.Image
+}
+
+func (m *adjustedImage) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (m *adjustedImage) Bounds() image.Rectangle {
+	return m.m.Bounds()
+}
+
+func (m *adjustedImage) At(x, y int) color.Color {
+	c := color.NRGBAModel.Convert(m.m.At(x, y)).(color.NRGBA)
+	if c.A == 0 {
+		return c
+	}
+	v := [3]float64{m.s.table[c.R], m.s.table[c.G], m.s.table[c.B]}
+	luma := 0.299*v[0] + 0.587*v[1] + 0.114*v[2]
+	var out [3]uint8
+	for i := range v {
+		f := luma + (v[i]-luma)*m.s.saturation
+		out[i] = uint8(clamp(f*m.s.tint[i])*0xff + 0.5)
+	}
+	return color.NRGBA{out[0], out[1], out[2], c.A}
+}
@@ -0,0 +1,509 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+)
+
+// The JSON API exposes a user's Overlays as resources, identified by their
+// encoded datastore keys, under apiPrefix:
+//
+//	GET   overlays                            list the user's Overlays
+//	GET   search                              find the Overlays in an area
+//	POST  overlays                            get a URL to upload an image to
+//	POST  upload                              (the upload URL's target) create an Overlay
+//	GET   overlays/{id}                       get an Overlay
+//	PATCH overlays/{id}                       update an Overlay's metadata
+//	POST  overlays/{id}/process               start processing an Overlay
+//	GET   overlays/{id}/status                get the progress of processing
+//	GET   overlays/{id}/tiles                 describe an Overlay's tiles
+//	GET   overlays/{id}/tiles/{z}/{x}/{y}.png get a tile; "@2x.png" for high-DPI
+//	GET   overlays/{id}/download              get the zip file
+//
+// API tokens are managed under "tokens" (see token.go); requests made with a
+// token need the scope given for each resource in static/openapi.yaml.
+// Overlays are shared under overlays/{id}/sharing and overlays/{id}/links,
+// and groups of users to share them with are managed under "groups" (see
+// share.go and links.go).
+//
+// Responses are JSON, but for tiles and downloads, and errors are JSON
+// objects holding an apiError. The API is described for clients by
+// static/openapi.yaml.
+
+const apiPrefix = "/api/v1/"
+
+// apiHandler is like appHandler, but writes errors as JSON.
+type apiHandler func(appengine.Context, http.ResponseWriter, *http.Request) *appError
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if e := fn(c, w, r); e != nil {
+		ae := apiError{Code: e.Code, Message: e.Message}
+		if ue, ok := e.Error.(*uploadError); ok {
+			ae.Reason, ae.Limit, ae.Value = ue.Reason, ue.Limit, ue.Value
+		}
+		writeJSON(w, e.Code, struct {
+			Error apiError `json:"error"`
+		}{ae})
+		c.Errorf("%s (%v)", e.Message, e.Error)
+	}
+}
+
+// An apiError is the body of an API error response, derived from an
+// appError. Rejected uploads also give the fields of their uploadError.
+type apiError struct {
+	Code    int    `json:"code"` // the HTTP status code
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
+	Value   int64  `json:"value,omitempty"`
+}
+
+// writeJSON writes v to the response as JSON with the specified status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// methodNotAllowed returns the appError for a request whose method is not one
+// of those allowed.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) *appError {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	return &appError{nil, "method not allowed; use " + strings.Join(allowed, " or "), http.StatusMethodNotAllowed}
+}
+
+// apiRouter dispatches API requests to their handlers by path and method.
+func apiRouter(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "overlays":
+		switch r.Method {
+		case "GET":
+			if e := requireScope(p, scopeRead); e != nil {
+				return e
+			}
+			return apiList(c, p, w, r)
+		case "POST":
+			if e := requireScope(p, scopeUpload); e != nil {
+				return e
+			}
+			return apiUploadURL(c, w, r)
+		}
+		return methodNotAllowed(w, "GET", "POST")
+	case len(parts) == 1 && parts[0] == "upload":
+		if r.Method != "POST" {
+			return methodNotAllowed(w, "POST")
+		}
+		if e := requireScope(p, scopeUpload); e != nil {
+			return e
+		}
+		return apiUpload(c, p, w, r)
+	case len(parts) == 1 && parts[0] == "search":
+		if r.Method != "GET" {
+			return methodNotAllowed(w, "GET")
+		}
+		if e := requireScope(p, scopeRead); e != nil {
+			return e
+		}
+		return apiSearch(c, p, w, r)
+	case parts[0] == "tokens":
+		return apiTokens(c, p, w, r, parts)
+	case parts[0] == "groups":
+		return apiGroups(c, p, w, r, parts)
+	case len(parts) < 2 || parts[0] != "overlays":
+		return &appError{nil, "no such resource", http.StatusNotFound}
+	}
+
+	k, o, err := loadOverlay(c, parts[1])
+	if err == errNoOverlay {
+		return &appError{err, "overlay not found", http.StatusNotFound}
+	} else if err != nil {
+		return appErrorf(err, "could not get overlay")
+	}
+	switch {
+	case len(parts) == 2 && r.Method == "PATCH":
+		return apiUpdate(c, p, w, r, k, o)
+	case len(parts) == 3 && parts[2] == "sharing":
+		return apiSharing(c, p, w, r, k, o)
+	case len(parts) == 3 && parts[2] == "links":
+		return apiLinks(c, p, w, r, k, o)
+	}
+	method, scope, need := "GET", scopeRead, accessView
+	if len(parts) == 3 && parts[2] == "process" {
+		method, scope, need = "POST", scopeProcess, accessEdit
+	}
+	if e := authorizeOverlay(c, p, o, need); e != nil {
+		return e
+	}
+	o.Role = overlayAccess(p, o).role()
+	if r.Method != method {
+		if len(parts) == 2 {
+			return methodNotAllowed(w, "GET", "PATCH")
+		}
+		return methodNotAllowed(w, method)
+	}
+	if e := requireScope(p, scope); e != nil {
+		return e
+	}
+	switch {
+	case len(parts) == 2:
+		writeJSON(w, http.StatusOK, newAPIOverlay(k, o))
+		return nil
+	case len(parts) == 3 && parts[2] == "process":
+		return apiProcess(c, p, w, r, k, o)
+	case len(parts) == 3 && parts[2] == "status":
+		return apiStatus(c, w, k, o)
+	case len(parts) == 3 && parts[2] == "tiles":
+		writeJSON(w, http.StatusOK, newAPITiles(k, o))
+		return nil
+	case len(parts) == 6 && parts[2] == "tiles":
+		return apiTile(c, w, k, parts[3:])
+	case len(parts) == 3 && parts[2] == "download":
+		return sendDownload(w, k, o, r.FormValue("format"))
+	}
+	return &appError{nil, "no such resource", http.StatusNotFound}
+}
+
+// An apiOverlay is the representation of an Overlay in the API.
+type apiOverlay struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`           // see Overlay.state
+	Error  string `json:"error,omitempty"` // why the image could not be split
+	Role   string `json:"role,omitempty"`  // the user's role
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+
+	// Metadata set by the user (see metadata.go).
+	Name        string     `json:"name,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Attribution string     `json:"attribution,omitempty"`
+	License     string     `json:"license,omitempty"`
+	Captured    *time.Time `json:"captured,omitempty"`
+
+	// The corners of the Overlay in world coordinates, once placed.
+	TopLeft     []float64 `json:"topLeft,omitempty"`
+	TopRight    []float64 `json:"topRight,omitempty"`
+	BottomRight []float64 `json:"bottomRight,omitempty"`
+
+	Layers  []string   `json:"layers,omitempty"` // IDs of a mosaic's layers
+	Tiles   int        `json:"tiles,omitempty"`  // number of tiles, once processed
+	Started *time.Time `json:"started,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Bounds  []float64  `json:"bounds,omitempty"` // west, south, east and north
+
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	PreviewURL   string `json:"previewUrl,omitempty"`
+	DownloadURL  string `json:"downloadUrl,omitempty"`
+}
+
+func newAPIOverlay(k *datastore.Key, o *Overlay) *apiOverlay {
+	o.Key = k.Encode()
+	o.setPreviewURLs()
+	a := &apiOverlay{
+		ID:           o.Key,
+		State:        o.state(),
+		Error:        o.RasterError,
+		Role:         o.Role,
+		Width:        o.Width,
+		Height:       o.Height,
+		Name:         o.Name,
+		Description:  o.Description,
+		Tags:         o.Tags,
+		Attribution:  o.Attribution,
+		License:      o.License,
+		TopLeft:      o.TopLeft,
+		TopRight:     o.TopRight,
+		BottomRight:  o.BottomRight,
+		Tiles:        o.Tiles,
+		URL:          apiPrefix + "overlays/" + o.Key,
+		ThumbnailURL: o.ThumbnailURL,
+		PreviewURL:   o.PreviewURL,
+	}
+	if !o.Started.IsZero() {
+		a.Started = &o.Started
+	}
+	if !o.Captured.IsZero() {
+		a.Captured = &o.Captured
+	}
+	if !o.Created.IsZero() {
+		a.Created = &o.Created
+	}
+	if !o.Updated.IsZero() {
+		a.Updated = &o.Updated
+	}
+	a.Bounds = o.bounds()
+	for _, l := range o.Layers {
+		a.Layers = append(a.Layers, l.Encode())
+	}
+	if a.State == stateDone {
+		a.DownloadURL = a.URL + "/download"
+	}
+	return a
+}
+
+// apiUpdate updates the metadata of an Overlay, as metadataHandler does, and
+// writes it.
+func apiUpdate(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, k *datastore.Key, o *Overlay) *appError {
+	if e := authorizeOverlay(c, p, o, accessEdit); e != nil {
+		return e
+	}
+	if e := requireScope(p, scopeProcess); e != nil {
+		return e
+	}
+	if e := updateMetadata(c, r, k, o); e != nil {
+		return e
+	}
+	o.Role = overlayAccess(p, o).role()
+	writeJSON(w, http.StatusOK, newAPIOverlay(k, o))
+	return nil
+}
+
+// summary returns the compact form of the apiOverlay, for lists.
+func (a *apiOverlay) summary() *apiOverlay {
+	return &apiOverlay{
+		ID:           a.ID,
+		State:        a.State,
+		Role:         a.Role,
+		Name:         a.Name,
+		Tags:         a.Tags,
+		Created:      a.Created,
+		Updated:      a.Updated,
+		Bounds:       a.Bounds,
+		URL:          a.URL,
+		ThumbnailURL: a.ThumbnailURL,
+	}
+}
+
+// Overlay states, as reported by the API.
+const (
+	stateRasterizing = "rasterizing" // the image is being split into a raster
+	stateFailed      = "failed"      // the image could not be split
+	stateUploaded    = "uploaded"    // ready to be placed and processed
+	stateProcessing  = "processing"  // tiles or the zip file are being made
+	stateDone        = "done"        // the zip file is ready to download
+)
+
+// state returns the state of the Overlay.
+func (o *Overlay) state() string {
+	switch {
+	case o.Raster == rasterSentinel:
+		return stateRasterizing
+	case o.RasterError != "":
+		return stateFailed
+	case o.Started.IsZero():
+		return stateUploaded
+	case o.Zip == "" || o.Zip == zipSentinel:
+		return stateProcessing
+	}
+	return stateDone
+}
+
+// apiList writes a page of the list of the user's Overlays and those shared
+// with them, as the request's parameters specify (see parseListRequest), and
+// the cursor of the next page, if there is one.
+func apiList(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "could not parse form", http.StatusBadRequest}
+	}
+	lr, err := parseListRequest(r.Form)
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	keys, overlays, next, err := listOverlays(c, p, lr)
+	if err != nil {
+		return appErrorf(err, "could not get overlays")
+	}
+	list := make([]*apiOverlay, len(keys))
+	for i, k := range keys {
+		list[i] = newAPIOverlay(k, overlays[i])
+		if lr.Summary {
+			list[i] = list[i].summary()
+		}
+	}
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r, next)))
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Overlays   []*apiOverlay `json:"overlays"`
+		NextCursor string        `json:"nextCursor,omitempty"`
+	}{list, next})
+	return nil
+}
+
+// apiSearch writes the Overlays that the user may see that lie within the
+// area given by the request's parameters (see parseSearchRequest), and
+// whether there are more than were written.
+func apiSearch(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "could not parse form", http.StatusBadRequest}
+	}
+	lr, err := parseSearchRequest(r.Form)
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	keys, overlays, more, err := searchOverlays(c, p, lr)
+	if err != nil {
+		return appErrorf(err, "could not search overlays")
+	}
+	list := make([]*apiOverlay, len(keys))
+	for i, k := range keys {
+		list[i] = newAPIOverlay(k, overlays[i])
+		if lr.Summary {
+			list[i] = list[i].summary()
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Overlays []*apiOverlay `json:"overlays"`
+		More     bool          `json:"more"`
+	}{list, more})
+	return nil
+}
+
+// apiUploadURL writes a URL to which the image of a new Overlay, and its
+// optional sidecar and mask files, may be posted as with the editor. The
+// response to that post is that of apiUpload.
+func apiUploadURL(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	u, err := blobstore.UploadURL(c, apiPrefix+"upload", &blobstore.UploadURLOptions{
+		MaxUploadBytesPerBlob: maxUploadBytes,
+	})
+	if err != nil {
+		return appErrorf(err, "could not create blobstore upload url")
+	}
+	writeJSON(w, http.StatusOK, struct {
+		UploadURL string `json:"uploadUrl"`
+	}{u.String()})
+	return nil
+}
+
+// apiUpload creates an Overlay from an upload, as uploadHandler does, and
+// writes it.
+func apiUpload(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	k, o, e := upload(c, p, r)
+	if e != nil {
+		return e
+	}
+	a := newAPIOverlay(k, o)
+	w.Header().Set("Location", a.URL)
+	writeJSON(w, http.StatusCreated, a)
+	return nil
+}
+
+// apiProcess starts processing an Overlay, as processHandler does, and writes
+// the token of the channel on which its progress is reported.
+func apiProcess(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, k *datastore.Key, o *Overlay) *appError {
+	token, e := process(c, p, r, k, o)
+	if e != nil {
+		return e
+	}
+	a := newAPIOverlay(k, o)
+	w.Header().Set("Location", a.URL+"/status")
+	writeJSON(w, http.StatusAccepted, struct {
+		*apiOverlay
+		ChannelToken string `json:"channelToken"`
+	}{a, token})
+	return nil
+}
+
+// apiStatus writes the progress of processing an Overlay.
+func apiStatus(c appengine.Context, w http.ResponseWriter, k *datastore.Key, o *Overlay) *appError {
+	done := 0
+	if !o.Started.IsZero() {
+		var err error
+		if done, err = datastore.NewQuery("Tile").Ancestor(k).KeysOnly().Count(c); err != nil {
+			return appErrorf(err, "could not count tiles")
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID         string `json:"id"`
+		State      string `json:"state"`
+		Tiles      int    `json:"tiles"`
+		TilesDone  int    `json:"tilesDone"`
+		ZipDone    bool   `json:"zipDone"`
+		ExportDone bool   `json:"exportDone"`
+	}{
+		ID:         k.Encode(),
+		State:      o.state(),
+		Tiles:      o.Tiles,
+		TilesDone:  done,
+		ZipDone:    o.Zip != "" && o.Zip != zipSentinel,
+		ExportDone: o.Export != "" && o.Export != exportSentinel,
+	})
+	return nil
+}
+
+// apiTiles describes the tiles of a processed Overlay. Tiles are addressed in
+// the URL template by their column and row counted from the north-west
+// corner of the Overlay's tile matrix set, whatever its tiling scheme.
+type apiTiles struct {
+	Name          string `json:"name,omitempty"`
+	Attribution   string `json:"attribution,omitempty"`
+	URL           string `json:"url"` // template with {z}, {x} and {y}
+	TileSize      int    `json:"tileSize"`
+	Retina        bool   `json:"retina"`
+	MinZoom       int64  `json:"minZoom"`
+	MaxZoom       int64  `json:"maxZoom"`
+	Scheme        string `json:"scheme"`
+	TileMatrixSet int    `json:"tileMatrixSet"`
+}
+
+func newAPITiles(k *datastore.Key, o *Overlay) *apiTiles {
+	return &apiTiles{
+		Name:          o.Name,
+		Attribution:   o.Attribution,
+		URL:           apiPrefix + "overlays/" + k.Encode() + "/tiles/{z}/{x}/{y}.png",
+		TileSize:      o.tileSize(),
+		Retina:        o.Retina,
+		MinZoom:       o.MinZoom,
+		MaxZoom:       o.MaxZoom,
+		Scheme:        o.scheme(),
+		TileMatrixSet: o.tileMatrixSet().EPSG,
+	}
+}
+
+// apiTile writes the tile of an Overlay with the specified zoom level, column
+// and row, in that order, the last being suffixed with ".png" or "@2x.png".
+func apiTile(c appengine.Context, w http.ResponseWriter, k *datastore.Key, zxy []string) *appError {
+	name, retina := zxy[2], false
+	switch {
+	case strings.HasSuffix(name, "@2x.png"):
+		name, retina = strings.TrimSuffix(name, "@2x.png"), true
+	case strings.HasSuffix(name, ".png"):
+		name = strings.TrimSuffix(name, ".png")
+	default:
+		return &appError{nil, "no such tile", http.StatusNotFound}
+	}
+	var v [3]int64
+	for i, s := range []string{zxy[0], zxy[1], name} {
+		var err error
+		if v[i], err = strconv.ParseInt(s, 10, 64); err != nil || v[i] < 0 {
+			return &appError{err, "no such tile", http.StatusNotFound}
+		}
+	}
+	t := &Tile{Zoom: v[0], X: v[1], Y: v[2]}
+	tk := t.Key(c, k)
+	if retina {
+		tk = t.RetinaKey(c, k)
+	}
+	if err := datastore.Get(c, tk, t); err == datastore.ErrNoSuchEntity {
+		return &appError{err, fmt.Sprintf("no tile %d/%d/%d", t.Zoom, t.X, t.Y), http.StatusNotFound}
+	} else if err != nil {
+		return appErrorf(err, "could not get tile")
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(t.Image)
+	return nil
+}
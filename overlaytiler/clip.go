@@ -0,0 +1,265 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/blobstore"
+)
+
+// An Overlay may be clipped to hide the legends, borders and collars of a
+// scanned map: by a polygon in image pixels, by an alpha mask image that is
+// stretched over the image, or by both. Clipping is applied as the image is
+// read, so pixels outside the clipped area are transparent in tiles, mosaics
+// and exports alike, and tiles that lie wholly outside it are not generated.
+
+const (
+	maxClipVertices = 1000
+	maxMaskPixels   = 1 << 24 // pixel count limit for mask images
+)
+
+// parseClip parses the "clip" parameter of a process request: a polygon of
+// at least three vertices, given as x,y pairs in image pixels separated by
+// semicolons, that lies within the Overlay's image.
+func parseClip(o *Overlay, s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	pairs := strings.Split(s, ";")
+	if len(pairs) < 3 || len(pairs) > maxClipVertices {
+		return nil, fmt.Errorf("invalid parameter clip: polygon must have from 3 to %d vertices", maxClipVertices)
+	}
+	var clip []float64
+	for _, v := range pairs {
+		p, err := parsePair(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter clip: %v", err)
+		}
+		x, y := p[0], p[1]
+		if !(x >= 0 && x <= float64(o.Width) && y >= 0 && y <= float64(o.Height)) {
+			return nil, fmt.Errorf("invalid parameter clip: vertex (%g, %g) is outside the %dx%d image", x, y, o.Width, o.Height)
+		}
+		clip = append(clip, x, y)
+	}
+	return clip, nil
+}
+
+// clipped reports whether the Overlay is clipped.
+func (o *Overlay) clipped() bool {
+	return o.Clip != nil || o.Mask != ""
+}
+
+// outline returns, in world coordinates, the vertices of the polygon that
+// bounds the visible part of the Overlay: its clip polygon, or else the
+// bounds of its mask, or else its corners.
+func (o *Overlay) outline() [][]float64 {
+	var pts []float64
+	switch {
+	case o.Clip != nil:
+		pts = o.Clip
+	case o.MaskBounds != nil:
+		b := o.MaskBounds
+		pts = []float64{b[0], b[1], b[2], b[1], b[2], b[3], b[0], b[3]}
+	default:
+		return [][]float64{o.TopLeft, o.TopRight, o.BottomRight, o.BottomLeft()}
+	}
+	w, h := float64(o.Width), float64(o.Height)
+	bl := o.BottomLeft()
+	var poly [][]float64
+	for i := 0; i+1 < len(pts); i += 2 {
+		u, v := pts[i]/w, pts[i+1]/h
+		p := make([]float64, 2)
+		for j := range p {
+			p[j] = o.TopLeft[j] + u*(o.TopRight[j]-o.TopLeft[j]) + v*(bl[j]-o.TopLeft[j])
+		}
+		poly = append(poly, p)
+	}
+	return poly
+}
+
+// coveredTiles returns those of the specified tiles that hold part of the
+// clipped Overlay.
+func (o *Overlay) coveredTiles(tiles []*Tile) []*Tile {
+	ms := o.tileMatrixSet()
+	poly, err := ms.outline(o)
+	if err != nil {
+		return nil
+	}
+	var covered []*Tile
+	for _, t := range tiles {
+		// The tile's bounds in pixels at zoom level 0.
+		size := float64(o.tileSize()) / math.Pow(2, float64(t.Zoom))
+		x, y := float64(t.X)*size, float64(t.Y)*size
+		for k := -1; k <= 1; k++ {
+			if k != 0 && !ms.wraps() {
+				continue
+			}
+			xk := x + float64(k)*float64(ms.Width)
+			if rectIntersectsPolygon(xk, y, xk+size, y+size, poly) {
+				covered = append(covered, t)
+				break
+			}
+		}
+	}
+	return covered
+}
+
+// insidePolygon reports whether the point (x, y) lies inside the polygon
+// whose vertices are given as consecutive x, y pairs.
+func insidePolygon(poly []float64, x, y float64) bool {
+	in := false
+	n := len(poly) / 2
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		xi, yi, xj, yj := poly[2*i], poly[2*i+1], poly[2*j], poly[2*j+1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+// rectIntersectsPolygon reports whether the rectangle from (x0, y0) to
+// (x1, y1) intersects the polygon with the specified vertices.
+func rectIntersectsPolygon(x0, y0, x1, y1 float64, poly [][]float64) bool {
+	var flat []float64
+	for _, p := range poly {
+		if p[0] >= x0 && p[0] <= x1 && p[1] >= y0 && p[1] <= y1 {
+			return true
+		}
+		flat = append(flat, p[0], p[1])
+	}
+	if insidePolygon(flat, (x0+x1)/2, (y0+y1)/2) {
+		return true
+	}
+	rect := [][]float64{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}}
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		for j := range rect {
+			if segmentsIntersect(a, b, rect[j], rect[(j+1)%4]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect reports whether the line segments ab and cd intersect.
+func segmentsIntersect(a, b, c, d []float64) bool {
+	cross := func(o, p, q []float64) float64 {
+		return (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+	}
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return (d1 > 0) != (d2 > 0) && (d3 > 0) != (d4 > 0)
+}
+
+// readMask reads the mask image uploaded for an image of the specified size,
+// and returns the bounds of its non-transparent pixels as x0, y0, x1, y1 in
+// pixels of the image.
+func readMask(c appengine.Context, info *blobstore.BlobInfo, w, h int) ([]float64, *appError) {
+	cfg, _, err := image.DecodeConfig(blobstore.NewReader(c, info.BlobKey))
+	if err != nil {
+		return nil, rejectUpload(http.StatusUnsupportedMediaType, rejectMask, "could not read mask image: %v", err)
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > maxMaskPixels {
+		return nil, rejectLimit(http.StatusRequestEntityTooLarge, rejectMask, pixels, maxMaskPixels,
+			"mask image has %d pixels; the limit is %d pixels", pixels, maxMaskPixels)
+	}
+	m, err := imageBlob(c, info.BlobKey)
+	if err != nil {
+		return nil, rejectUpload(http.StatusUnsupportedMediaType, rejectMask, "could not read mask image: %v", err)
+	}
+	r := image.Rectangle{}
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a != 0 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if r.Empty() {
+		return nil, rejectUpload(http.StatusBadRequest, rejectMask, "mask image is completely transparent")
+	}
+	r = r.Sub(b.Min)
+	sx, sy := float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy())
+	return []float64{float64(r.Min.X) * sx, float64(r.Min.Y) * sy, float64(r.Max.X) * sx, float64(r.Max.Y) * sy}, nil
+}
+
+// clipSource returns src clipped as the Overlay specifies. Its mask, if any,
+// is decoded in full.
+func clipSource(c appengine.Context, o *Overlay, src imageSource) (imageSource, error) {
+	if !o.clipped() {
+		return src, nil
+	}
+	cs := &clippedSource{src: src, clip: o.Clip, w: o.Width, h: o.Height}
+	if o.Mask != "" {
+		var err error
+		if cs.mask, err = imageBlob(c, o.Mask); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// A clippedSource is an imageSource whose pixels outside a clip polygon are
+// transparent, and whose pixels are otherwise faded by an alpha mask.
+type clippedSource struct {
+	src  imageSource
+	clip []float64   // polygon in image pixels, if any
+	mask image.Image // mask stretched over the image, if any
+	w, h int         // size of the image
+}
+
+func (s *clippedSource) levels() int {
+	return s.src.levels()
+}
+
+func (s *clippedSource) level(n int) image.Image {
+	return &clippedImage{s, s.src.level(n), math.Pow(2, float64(n))}
+}
+
+func (s *clippedSource) err() error {
+	return s.src.err()
+}
+
+// A clippedImage is a level of detail of a clippedSource.
+type clippedImage struct {
+	s     *clippedSource
+	m     image.Image
+	scale float64 // image pixels per pixel of m
+}
+
+func (m *clippedImage) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (m *clippedImage) Bounds() image.Rectangle {
+	return m.m.Bounds()
+}
+
+func (m *clippedImage) At(x, y int) color.Color {
+	// The center of the pixel, in image pixels.
+	px, py := (float64(x)+0.5)*m.scale, (float64(y)+0.5)*m.scale
+	if m.s.clip != nil && !insidePolygon(m.s.clip, px, py) {
+		return color.RGBA64{}
+	}
+	a := uint32(0xffff)
+	if mask := m.s.mask; mask != nil {
+		b := mask.Bounds()
+		mx := b.Min.X + int(px*float64(b.Dx())/float64(m.s.w))
+		my := b.Min.Y + int(py*float64(b.Dy())/float64(m.s.h))
+		if _, _, _, a = mask.At(mx, my).RGBA(); a == 0 {
+			return color.RGBA64{}
+		}
+	}
+	r, g, b, sa := m.m.At(x, y).RGBA()
+	return color.RGBA64{uint16(r * a / 0xffff), uint16(g * a / 0xffff), uint16(b * a / 0xffff), uint16(sa * a / 0xffff)}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+)
+
+// Phone cameras store photos as the sensor saw them and record in EXIF tags
+// how they must be turned to be upright, and often where they were taken.
+// When a JPEG image is uploaded its EXIF orientation and GPS position are
+// read, its width and height are recorded as those of the upright image, and
+// it is turned upright as it is split into a raster.
+
+// exifData is the metadata read from the EXIF tags of an image.
+type exifData struct {
+	Orientation int       // 1 to 8, or 0 if not recorded
+	Location    []float64 // longitude and latitude in degrees, if recorded
+}
+
+// EXIF tags.
+const (
+	exifOrientation = 0x0112
+	exifGPSIFD      = 0x8825
+
+	gpsLatitudeRef  = 1
+	gpsLatitude     = 2
+	gpsLongitudeRef = 3
+	gpsLongitude    = 4
+)
+
+// maxExif is the size limit for the APP1 segment holding the EXIF tags.
+const maxExif = 1 << 16
+
+// readExif reads the EXIF tags of the JPEG image read from r. It returns nil
+// if the image is not a JPEG image or has no EXIF tags.
+func readExif(r io.Reader) (*exifData, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, nil
+	}
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return nil, err
+		}
+		if h[0] != 0xff {
+			return nil, errors.New("exif: invalid JPEG marker")
+		}
+		marker, n := h[1], int(binary.BigEndian.Uint16(h[2:]))-2
+		if marker == 0xda || marker == 0xd9 {
+			// The image data starts before any EXIF tags.
+			return nil, nil
+		}
+		if n < 0 {
+			return nil, errors.New("exif: invalid JPEG segment length")
+		}
+		if marker != 0xe1 || n > maxExif {
+			if _, err := io.CopyN(ioutil.Discard, br, int64(n)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		if len(b) < 6 || string(b[:6]) != "Exif\x00\x00" {
+			continue
+		}
+		return parseExif(b[6:])
+	}
+}
+
+// parseExif parses the TIFF structure that holds the EXIF tags.
+func parseExif(b []byte) (*exifData, error) {
+	if len(b) < 8 {
+		return nil, errors.New("exif: short TIFF header")
+	}
+	var bo binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, errors.New("exif: invalid TIFF byte order")
+	}
+	t := &exifTIFF{b, bo}
+	d := new(exifData)
+	ifd0, err := t.ifd(bo.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := ifd0[exifOrientation]; ok {
+		if v := int(t.short(e)); v >= 1 && v <= 8 {
+			d.Orientation = v
+		}
+	}
+	e, ok := ifd0[exifGPSIFD]
+	if !ok {
+		return d, nil
+	}
+	gps, err := t.ifd(bo.Uint32(e[8:]))
+	if err != nil {
+		// The orientation is still of use.
+		return d, nil
+	}
+	lat, ok1 := t.degrees(gps[gpsLatitude])
+	lng, ok2 := t.degrees(gps[gpsLongitude])
+	if !ok1 || !ok2 {
+		return d, nil
+	}
+	if ref, ok := gps[gpsLatitudeRef]; ok && ref[8] == 'S' {
+		lat = -lat
+	}
+	if ref, ok := gps[gpsLongitudeRef]; ok && ref[8] == 'W' {
+		lng = -lng
+	}
+	if lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 {
+		d.Location = []float64{lng, lat}
+	}
+	return d, nil
+}
+
+// exifTIFF is the TIFF structure of an EXIF segment.
+type exifTIFF struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+// ifd returns the 12-byte entries of the IFD at the specified offset, by tag.
+func (t *exifTIFF) ifd(off uint32) (map[uint16][]byte, error) {
+	if uint64(off)+2 > uint64(len(t.b)) {
+		return nil, errors.New("exif: IFD offset out of range")
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	start := int(off) + 2
+	if start+12*n > len(t.b) {
+		return nil, errors.New("exif: IFD out of range")
+	}
+	entries := make(map[uint16][]byte, n)
+	for i := 0; i < n; i++ {
+		e := t.b[start+12*i : start+12*i+12]
+		entries[t.bo.Uint16(e)] = e
+	}
+	return entries, nil
+}
+
+// short returns the value of an entry of type SHORT.
+func (t *exifTIFF) short(e []byte) uint16 {
+	return t.bo.Uint16(e[8:])
+}
+
+// degrees returns the value of a GPS entry of three RATIONALs, the degrees,
+// minutes and seconds of an angle, in degrees.
+func (t *exifTIFF) degrees(e []byte) (float64, bool) {
+	const rational = 5
+	if e == nil || t.bo.Uint16(e[2:]) != rational || t.bo.Uint32(e[4:]) != 3 {
+		return 0, false
+	}
+	off := int(t.bo.Uint32(e[8:]))
+	if off < 0 || off+24 > len(t.b) {
+		return 0, false
+	}
+	var v float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num := t.bo.Uint32(t.b[off+8*i:])
+		den := t.bo.Uint32(t.b[off+8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		v += float64(num) / float64(den) / unit
+	}
+	return v, true
+}
+
+// transposes reports whether an image of the specified EXIF orientation is
+// turned on its side, so that its upright width is its stored height.
+func transposes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// storedPoint returns the point of a stored image w by h pixels, of the
+// specified EXIF orientation, that is shown at x, y once it is turned
+// upright, as orient turns it. Points are in pixels from the image's top left
+// corner.
+func storedPoint(orientation, w, h int, x, y float64) (float64, float64) {
+	W, H := float64(w), float64(h)
+	switch orientation {
+	case 2:
+		return W - x, y
+	case 3:
+		return W - x, H - y
+	case 4:
+		return x, H - y
+	case 5:
+		return y, x
+	case 6:
+		return y, H - x
+	case 7:
+		return W - y, H - x
+	case 8:
+		return W - y, x
+	}
+	return x, y
+}
+
+// orientRows returns a rowReader for the upright image of the specified EXIF
+// orientation read from rr. The image is held in memory to turn it.
+func orientRows(rr rowReader, orientation int) (rowReader, error) {
+	if orientation <= 1 {
+		return rr, nil
+	}
+	var m *image.RGBA
+	if ir, ok := rr.(*imageRows); ok && ir.y == 0 {
+		b := ir.m.Bounds()
+		m = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(m, m.Rect, ir.m, b.Min, draw.Src)
+	} else {
+		w, h := rr.Size()
+		m = image.NewRGBA(image.Rect(0, 0, w, h))
+		if err := rr.Read(m); err != nil {
+			return nil, err
+		}
+	}
+	return &imageRows{m: orient(m, orientation)}, nil
+}
+
+// orient returns the upright image of m, whose EXIF orientation is given.
+func orient(m *image.RGBA, orientation int) *image.RGBA {
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	W, H := w, h
+	if transposes(orientation) {
+		W, H = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, W, H))
+	for y := 0; y < H; y++ {
+		for x := 0; x < W; x++ {
+			// The pixel of m that is shown at x, y. The cases describe
+			// how m is turned from upright.
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // turned half around
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored top to bottom
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // turned a quarter anticlockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned a quarter clockwise
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], m.Pix[m.PixOffset(sx, sy):m.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
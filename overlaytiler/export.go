@@ -0,0 +1,286 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"archive/zip"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+
+	"code.google.com/p/graphics-go/graphics"
+	"code.google.com/p/graphics-go/graphics/interp"
+
+	"geotiff"
+)
+
+// An export is the Overlay's image warped into a coordinate reference system
+// and written as a GeoTIFF, bundled in a zip file with a world file and a
+// projection file for software that does not read GeoTIFF tags.
+
+const (
+	exportSentinel  = "EXPORT_RUNNING"
+	maxExportPixels = 1 << 26 // limit on the size of exported images
+	maxExportZoom   = 24
+)
+
+// prjWKT holds the projection file contents, in ESRI WKT, of the coordinate
+// reference systems that exports may use.
+var prjWKT = map[int]string{
+	3857:  `PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]],PROJECTION["Mercator_Auxiliary_Sphere"],PARAMETER["False_Easting",0.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",0.0],PARAMETER["Standard_Parallel_1",0.0],PARAMETER["Auxiliary_Sphere_Type",0.0],UNIT["Meter",1.0]]`,
+	27700: `PROJCS["British_National_Grid",GEOGCS["GCS_OSGB_1936",DATUM["D_OSGB_1936",SPHEROID["Airy_1830",6377563.396,299.3249646]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]],PROJECTION["Transverse_Mercator"],PARAMETER["False_Easting",400000.0],PARAMETER["False_Northing",-100000.0],PARAMETER["Central_Meridian",-2.0],PARAMETER["Scale_Factor",0.9996012717],PARAMETER["Latitude_Of_Origin",49.0],UNIT["Meter",1.0]]`,
+	2056:  `PROJCS["CH1903+_LV95",GEOGCS["GCS_CH1903+",DATUM["D_CH1903+",SPHEROID["Bessel_1841",6377397.155,299.1528128]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]],PROJECTION["Hotine_Oblique_Mercator_Azimuth_Center"],PARAMETER["False_Easting",2600000.0],PARAMETER["False_Northing",1200000.0],PARAMETER["Scale_Factor",1.0],PARAMETER["Azimuth",90.0],PARAMETER["Longitude_Of_Center",7.439583333333333],PARAMETER["Latitude_Of_Center",46.95240555555556],UNIT["Meter",1.0]]`,
+	4326:  `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`,
+}
+
+// An exportGrid describes the pixels of an exported image in the coordinate
+// reference system it is exported in.
+type exportGrid struct {
+	EPSG          int
+	Zoom          int64   // zoom level whose tiles have the grid's resolution
+	X, Y          float64 // model coordinates of the top-left corner
+	Res           float64 // pixel size in model units
+	Width, Height int
+}
+
+// parseExportGrid returns the grid on which to export the Overlay, given the
+// "crs" and "zoom" parameters of an export request. By default the Overlay
+// is exported in Web Mercator, at the zoom level closest to the resolution of
+// its image at which the export is not too large.
+func parseExportGrid(o *Overlay, crs, zoom string) (*exportGrid, error) {
+	epsg := 3857
+	if crs != "" {
+		var err error
+		if epsg, err = parseEPSG(crs); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := prjWKT[epsg]; !ok {
+		return nil, fmt.Errorf("cannot export in EPSG:%d", epsg)
+	}
+	if zoom == "" {
+		for z := nativeZoom(o); z >= 0; z-- {
+			g, err := newExportGrid(o, epsg, z)
+			if err != nil || g.pixels() <= maxExportPixels {
+				return g, err
+			}
+		}
+		return nil, fmt.Errorf("overlay is too large to export")
+	}
+	z, err := strconv.ParseInt(zoom, 10, 64)
+	if err != nil || z < 0 || z > maxExportZoom {
+		return nil, fmt.Errorf("zoom must be an integer from 0 to %d", maxExportZoom)
+	}
+	g, err := newExportGrid(o, epsg, z)
+	if err != nil {
+		return nil, err
+	}
+	if g.pixels() > maxExportPixels {
+		return nil, fmt.Errorf("export at zoom %d would be %dx%d pixels; the limit is %d pixels",
+			z, g.Width, g.Height, maxExportPixels)
+	}
+	return g, nil
+}
+
+// nativeZoom returns the zoom level at which tile pixels are closest in size
+// to those of the Overlay's image, rounding towards finer detail.
+func nativeZoom(o *Overlay) int64 {
+	t := o.Transform
+	// Image pixels per world unit, along each world axis.
+	s := math.Max(math.Hypot(t[0], t[3]), math.Hypot(t[1], t[4]))
+	z := int64(math.Ceil(math.Log2(s)))
+	if z < 0 {
+		z = 0
+	}
+	if z > maxExportZoom {
+		z = maxExportZoom
+	}
+	return z
+}
+
+// newExportGrid returns the grid covering the Overlay in the coordinate
+// reference system identified by the specified EPSG code, with pixels the
+// size, at the equator, of those of tiles at the specified zoom level. The
+// grid is aligned to multiples of its pixel size.
+func newExportGrid(o *Overlay, epsg int, zoom int64) (*exportGrid, error) {
+	g := &exportGrid{EPSG: epsg, Zoom: zoom}
+	if geographic(epsg) {
+		g.Res = 360 / (256 * math.Pow(2, float64(zoom)))
+	} else {
+		g.Res = 2 * math.Pi * earthRadius / (256 * math.Pow(2, float64(zoom)))
+	}
+	var xs, ys []float64
+	for _, p := range [][]float64{o.TopLeft, o.TopRight, o.BottomRight, o.BottomLeft()} {
+		m, err := worldToModel(epsg, p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+		xs, ys = append(xs, m[0]), append(ys, m[1])
+	}
+	g.X = math.Floor(min(xs...)/g.Res) * g.Res
+	g.Y = math.Ceil(max(ys...)/g.Res) * g.Res
+	g.Width = int(math.Ceil((max(xs...) - g.X) / g.Res))
+	g.Height = int(math.Ceil((g.Y - min(ys...)) / g.Res))
+	if g.Width < 1 {
+		g.Width = 1
+	}
+	if g.Height < 1 {
+		g.Height = 1
+	}
+	return g, nil
+}
+
+func (g *exportGrid) pixels() int64 {
+	return int64(g.Width) * int64(g.Height)
+}
+
+// georeference returns the georeferencing of an image on the grid.
+func (g *exportGrid) georeference() *geotiff.Georeference {
+	return &geotiff.Georeference{
+		Transform:  [6]float64{g.Res, 0, g.X, 0, -g.Res, g.Y},
+		EPSG:       g.EPSG,
+		Geographic: geographic(g.EPSG),
+	}
+}
+
+// render draws the rows of the grid covered by dst, using the given
+// transformation and source image. Rows outside the Web Mercator world, near
+// the poles, are left transparent.
+func (g *exportGrid) render(dst *image.RGBA, transform []float64, src imageSource) error {
+	var t graphics.Affine
+	copy(t[:], transform)
+	if _, ok := projections[g.EPSG]; ok {
+		return g.renderPixels(dst, t, src)
+	}
+	// Rows are drawn one at a time, as only along a row is the mapping from
+	// grid pixels to world coordinates affine in every supported system.
+	for j := dst.Rect.Min.Y; j < dst.Rect.Max.Y; j++ {
+		y := g.Y - (float64(j)+0.5)*g.Res
+		p0, err := modelToWorld(g.EPSG, g.X, y)
+		if err != nil {
+			return err
+		}
+		p1, err := modelToWorld(g.EPSG, g.X+g.Res, y-g.Res)
+		if err != nil {
+			return err
+		}
+		if !inWorld(p0[1]) || !inWorld(p1[1]) {
+			continue
+		}
+		// World units per grid pixel, along each axis, near the row.
+		dx, dy := p1[0]-p0[0], p1[1]-p0[1]
+		row := dst.SubImage(image.Rect(dst.Rect.Min.X, j, dst.Rect.Max.X, j+1)).(*image.RGBA)
+
+		// Overlays that cross the antimeridian extend beyond the world, so
+		// the row may hold parts of the Overlay from the world to the west
+		// or east.
+		for k := -1; k <= 1; k++ {
+			a := t.Mul(graphics.Affine{
+				dx, 0, p0[0] - float64(k*worldSize),
+				0, dy, p0[1] - dy*(float64(j)+0.5),
+				0, 0, 1,
+			})
+			n := sourceLevel(a, src.levels())
+			f := math.Pow(2, float64(n))
+			a = graphics.I.Scale(f, f).Mul(a)
+			level := src.level(n)
+			if !overlaps(a, row.Rect, level.Bounds()) {
+				continue
+			}
+			if err := a.Transform(row, level, interp.Bilinear); err != nil {
+				return err
+			}
+		}
+	}
+	return src.err()
+}
+
+// renderPixels draws the pixels of the grid covered by dst one at a time, for
+// projections in which the mapping from grid pixels to world coordinates is
+// not affine even along a row: the center of each pixel is projected back to
+// world coordinates, and then to source image pixels by t.
+func (g *exportGrid) renderPixels(dst *image.RGBA, t graphics.Affine, src imageSource) error {
+	for j := dst.Rect.Min.Y; j < dst.Rect.Max.Y; j++ {
+		y := g.Y - (float64(j)+0.5)*g.Res
+		var level image.Image
+		var f float64
+		for i := dst.Rect.Min.X; i < dst.Rect.Max.X; i++ {
+			x := g.X + (float64(i)+0.5)*g.Res
+			p, err := modelToWorld(g.EPSG, x, y)
+			if err != nil {
+				return err
+			}
+			if !inWorld(p[1]) {
+				continue
+			}
+			if level == nil {
+				// Choose the level of detail from the world units per
+				// grid pixel at the first pixel of the row in the world.
+				px, err := modelToWorld(g.EPSG, x+g.Res, y)
+				if err != nil {
+					return err
+				}
+				py, err := modelToWorld(g.EPSG, x, y-g.Res)
+				if err != nil {
+					return err
+				}
+				a := t.Mul(graphics.Affine{
+					px[0] - p[0], py[0] - p[0], 0,
+					px[1] - p[1], py[1] - p[1], 0,
+					0, 0, 1,
+				})
+				n := sourceLevel(a, src.levels())
+				f = math.Pow(2, float64(n))
+				level = src.level(n)
+			}
+			sx := (t[0]*p[0] + t[1]*p[1] + t[2]) / f
+			sy := (t[3]*p[0] + t[4]*p[1] + t[5]) / f
+			if !image.Pt(int(math.Floor(sx)), int(math.Floor(sy))).In(level.Bounds()) {
+				continue
+			}
+			dst.Set(i, j, interp.Bilinear.Interp(level, sx, sy))
+		}
+	}
+	return src.err()
+}
+
+// inWorld reports whether the world y coordinate lies within the world.
+func inWorld(y float64) bool {
+	return y >= 0 && y <= worldSize
+}
+
+// writeExport writes to w a zip file holding the Overlay's image, exported on
+// the grid, as name.tif, name.wld and name.prj.
+func writeExport(w io.Writer, name string, g *exportGrid, o *Overlay, src imageSource) error {
+	z := zip.NewWriter(w)
+	f, err := z.Create(name + ".tif")
+	if err != nil {
+		return err
+	}
+	err = geotiff.EncodeRows(f, g.Width, g.Height, g.georeference(), func(dst *image.RGBA) error {
+		return g.render(dst, o.Transform, src)
+	})
+	if err != nil {
+		return err
+	}
+
+	// A world file gives the model coordinates of pixel centers.
+	if f, err = z.Create(name + ".wld"); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%.12g\n0\n0\n%.12g\n%.12f\n%.12f\n",
+		g.Res, -g.Res, g.X+g.Res/2, g.Y-g.Res/2)
+	if err != nil {
+		return err
+	}
+
+	if f, err = z.Create(name + ".prj"); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, prjWKT[g.EPSG]); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"image"
+
+	"appengine"
+	"appengine/blobstore"
+
+	"geotiff"
+)
+
+// imageConfig reads the dimensions of the image stored in the specified blob.
+// For GeoTIFF images it also returns their georeferencing, if any.
+func imageConfig(c appengine.Context, k appengine.BlobKey) (image.Config, *geotiff.Georeference, error) {
+	d, err := geotiff.NewReader(blobstore.NewReader(c, k))
+	if err == nil {
+		w, h := d.Size()
+		return image.Config{Width: w, Height: h}, d.Georeference(), nil
+	}
+	if err != image.ErrFormat {
+		return image.Config{}, nil, err
+	}
+	m, _, err := image.DecodeConfig(blobstore.NewReader(c, k))
+	return m, nil, err
+}
+
+// georeference places the Overlay using the georeferencing read from its
+// image, or from a sidecar file, setting its corners and transformation
+// matrix. The georeferencing is of the image as stored, before it is turned
+// upright. The Overlay is left unplaced if the placement is not valid (see
+// placeOverlay).
+func georeference(o *Overlay, g *geotiff.Georeference) error {
+	w, h := o.Width, o.Height
+	if transposes(o.Orientation) {
+		w, h = h, w
+	}
+	corners := [][]float64{{0, 0}, {float64(o.Width), 0}, {float64(o.Width), float64(o.Height)}}
+	var world [3][]float64
+	for i, p := range corners {
+		x, y := g.Apply(storedPoint(o.Orientation, w, h, p[0], p[1]))
+		var err error
+		if world[i], err = modelToWorld(g.EPSG, x, y); err != nil {
+			return err
+		}
+	}
+	o.TopLeft, o.TopRight, o.BottomRight = world[0], world[1], world[2]
+	if err := placeOverlay(o); err != nil {
+		o.TopLeft, o.TopRight, o.BottomRight = nil, nil, nil
+		return err
+	}
+	o.Transform = overlayTransform(o)
+	return nil
+}
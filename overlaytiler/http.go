@@ -10,6 +10,8 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"appengine"
 	"appengine/blobstore"
@@ -18,24 +20,39 @@ import (
 	"appengine/taskqueue"
 	"appengine/user"
 
-	"code.google.com/p/graphics-go/graphics"
+	"geotiff"
 )
 
 func init() {
 	// User-facing HTTP handlers.
 	http.Handle("/", appHandler(rootHandler))
-	http.Handle("/download", appHandler(downloadHandler))
-	http.Handle("/overlays.json", appHandler(listHandler))
-	http.Handle("/process", appHandler(processHandler))
-	http.Handle("/upload", appHandler(uploadHandler))
+
+	// These also accept API tokens with the given scopes (see token.go).
+	http.Handle("/download", authHandler(scopeRead, downloadHandler))
+	http.Handle("/export", authHandler(scopeProcess, exportHandler))
+	http.Handle("/metadata", authHandler(scopeProcess, metadataHandler))
+	http.Handle("/mosaic", authHandler(scopeProcess, mosaicHandler))
+	http.Handle("/overlays.json", authHandler(scopeRead, listHandler))
+	http.Handle("/preview", authHandler(scopeRead, previewHandler))
+	http.Handle("/process", authHandler(scopeProcess, processHandler))
+	http.Handle("/search.json", authHandler(scopeRead, searchHandler))
+	http.Handle("/thumbnail", authHandler(scopeRead, thumbnailHandler))
+	http.Handle("/upload", authHandler(scopeUpload, uploadHandler))
+
+	// The JSON API (see api.go).
+	http.Handle(apiPrefix, apiHandler(authHandler("", apiRouter)))
+
+	// Signed links, which need no login (see links.go).
+	http.Handle(sharedPrefix, appHandler(sharedHandler))
 }
 
 var rootTemplate = template.Must(template.ParseFiles("templates/root.html"))
 
 type rootTemplateData struct {
-	LogoutURL string
-	UploadURL string
-	User      string
+	LogoutURL      string
+	UploadURL      string
+	MaxUploadBytes int64
+	User           string
 }
 
 // rootHandler returns the landing page, which includes a blobstore upload URL.
@@ -45,18 +62,25 @@ func rootHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *a
 		c.Warningf("creating logout URL: %v", err)
 		logoutURL = "/"
 	}
-	uploadURL, err := blobstore.UploadURL(c, "/upload", nil)
+	uploadURL, err := blobstore.UploadURL(c, "/upload", &blobstore.UploadURLOptions{
+		MaxUploadBytesPerBlob: maxUploadBytes,
+	})
 	if err != nil {
 		return appErrorf(err, "could not create blobstore upload url")
 	}
 	username := "none"
+	q := &defaultQuota
 	if u := user.Current(c); u != nil {
 		username = u.String()
+		if q, err = userQuota(c, u.ID); err != nil {
+			return appErrorf(err, "could not get quota")
+		}
 	}
 	err = rootTemplate.Execute(w, &rootTemplateData{
-		LogoutURL: logoutURL,
-		UploadURL: uploadURL.String(),
-		User:      username,
+		LogoutURL:      logoutURL,
+		UploadURL:      uploadURL.String(),
+		MaxUploadBytes: q.MaxBytes,
+		User:           username,
 	})
 	if err != nil {
 		return appErrorf(err, "could not write template")
@@ -65,102 +89,263 @@ func rootHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *a
 }
 
 // uploadHandler handles the image upload and stores a new Overlay in the
-// datastore. If successful, it writes the Overlay's key to the response.
-func uploadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+// datastore. If successful, it writes the Overlay's key to the response;
+// rejected uploads are explained by an uploadError (see checkUpload).
+func uploadHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	k, _, e := upload(c, p, r)
+	if e != nil {
+		return e
+	}
+
+	// It will be known hereafter by its datastore-provided key.
+	fmt.Fprintf(w, "%s", k.Encode())
+	return nil
+}
+
+// upload handles the image upload and stores a new Overlay in the datastore.
+// The Overlay is placed using the georeferencing in the optional "sidecar"
+// file, in the coordinate system given by the "crs" parameter if the file
+// does not specify one, or else using that of a GeoTIFF image.
+func upload(c appengine.Context, p *principal, r *http.Request) (*datastore.Key, *Overlay, *appError) {
 	// Handle the upload, and get the image's BlobKey.
-	blobs, _, err := blobstore.ParseUpload(r)
+	blobs, other, err := blobstore.ParseUpload(r)
 	if err != nil {
-		return appErrorf(err, "could not parse blobs from blobstore upload")
+		return nil, nil, appErrorf(err, "could not parse blobs from blobstore upload")
 	}
+
+	// Uploaded blobs are deleted from blob store, but for the image and
+	// mask of an accepted upload, which are kept with the Overlay.
+	kept := make(map[appengine.BlobKey]bool)
+	defer func() {
+		for _, list := range blobs {
+			for _, b := range list {
+				if kept[b.BlobKey] {
+					continue
+				}
+				if err := blobstore.Delete(c, b.BlobKey); err != nil {
+					c.Warningf("deleting uploaded blob: %v", err)
+				}
+			}
+		}
+	}()
+
 	b := blobs["overlay"]
 	if len(b) < 1 {
-		return appErrorf(nil, "could not find overlay blob")
+		return nil, nil, rejectUpload(http.StatusBadRequest, rejectMissing, "no image was uploaded")
+	}
+	info := b[0]
+	bk := info.BlobKey
+
+	// Read the georeferencing from the sidecar file, if one was uploaded.
+	var sidecar *geotiff.Georeference
+	if s := blobs["sidecar"]; len(s) > 0 {
+		epsg, err := parseEPSG(other.Get("crs"))
+		if err != nil {
+			return nil, nil, rejectUpload(http.StatusBadRequest, rejectSidecar, "invalid parameter crs: %v", err)
+		}
+		sidecar, err = parseSidecar(s[0].Filename, blobstore.NewReader(c, s[0].BlobKey), epsg)
+		if err != nil {
+			return nil, nil, rejectUpload(http.StatusBadRequest, rejectSidecar, "could not read sidecar file: %v", err)
+		}
+	}
+
+	// Read the image header from blob store to find its width and height,
+	// and check the image against the user's quota. The image itself is
+	// decoded by the raster task.
+	uid := p.UserID
+	q, err := userQuota(c, uid)
+	if err != nil {
+		return nil, nil, appErrorf(err, "could not get quota")
+	}
+	m, geo, err := imageConfig(c, bk)
+	if err != nil {
+		return nil, nil, rejectUpload(http.StatusUnsupportedMediaType, rejectFormat, "could not read image: %v", err)
+	}
+	if e := checkUpload(c, info, m, uid, q); e != nil {
+		return nil, nil, e
 	}
-	bk := b[0].BlobKey
 
-	// Fetch image from blob store to find its width and height.
-	m, err := imageBlob(c, bk)
+	// Read the orientation and position of photos from their EXIF tags.
+	// Images that are turned on their side are recorded as they will be
+	// once turned upright.
+	ex, err := readExif(blobstore.NewReader(c, bk))
 	if err != nil {
-		return appErrorf(err, "could not get image")
+		c.Warningf("ignoring unreadable EXIF tags: %v", err)
+	}
+	if ex == nil {
+		ex = new(exifData)
+	}
+	if transposes(ex.Orientation) {
+		m.Width, m.Height = m.Height, m.Width
 	}
 
 	// Create and store a new Overlay in the datastore.
+	now := time.Now()
 	o := &Overlay{
-		Owner:  user.Current(c).ID,
-		Image:  bk,
-		Width:  m.Bounds().Dx(),
-		Height: m.Bounds().Dy(),
+		Owner:      uid,
+		Image:      bk,
+		ImageBytes: info.Size,
+		Width:      m.Width,
+		Height:     m.Height,
+		Raster:     rasterSentinel,
+		Created:    now,
+		Updated:    now,
+
+		Orientation: ex.Orientation,
+		Location:    ex.Location,
 	}
+
+	// Clip the image by its alpha mask, if one was uploaded. The mask is
+	// kept with the image.
+	if mb := blobs["mask"]; len(mb) > 0 {
+		o.Mask = mb[0].BlobKey
+		var e *appError
+		if o.MaskBounds, e = readMask(c, mb[0], m.Width, m.Height); e != nil {
+			return nil, nil, e
+		}
+	}
+	// Set the metadata given with the upload. Overlays are named after
+	// their image file unless given a name.
+	o.Name = defaultName(info.Filename)
+	if err := parseMetadata(o, other); err != nil {
+		return nil, nil, rejectUpload(http.StatusBadRequest, rejectMetadata, "%v", err)
+	}
+	if sidecar != nil {
+		if err := georeference(o, sidecar); err != nil {
+			return nil, nil, rejectUpload(http.StatusBadRequest, rejectSidecar, "could not place overlay using sidecar file: %v", err)
+		}
+	} else if geo != nil {
+		if err := georeference(o, geo); err != nil {
+			c.Warningf("ignoring image georeferencing: %v", err)
+		}
+	}
+	o.setCells()
 	k := datastore.NewIncompleteKey(c, "Overlay", nil)
 	k, err = datastore.Put(c, k, o)
 	if err != nil {
-		return appErrorf(err, "could not save new overlay to datastore")
+		return nil, nil, appErrorf(err, "could not save new overlay to datastore")
 	}
 
-	// It will be known hereafter by its datastore-provided key.
-	fmt.Fprintf(w, "%s", k.Encode())
-	return nil
+	// Create a task to split the image into a raster,
+	// targeting the slicer backend.
+	task := taskqueue.NewPOSTTask("/raster", url.Values{"key": {k.Encode()}})
+	if !appengine.IsDevAppServer() {
+		host := appengine.BackendHostname(c, sliceBackend, -1)
+		task.Header.Set("Host", host)
+	}
+	if _, err := taskqueue.Add(c, task, rasterQueue); err != nil {
+		return nil, nil, appErrorf(err, "could not start raster task")
+	}
+	kept[bk] = true
+	if o.Mask != "" {
+		kept[o.Mask] = true
+	}
+	return k, o, nil
 }
 
 // processHandler initiates the processing of an Overlay, including kicking off
-// appropriate slice tasks.
-func processHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+// appropriate slice tasks, and writes the token of a channel on which its
+// progress is reported to the response.
+func processHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
 	if r.Method != "POST" {
 		return &appError{nil, "must use POST", http.StatusMethodNotAllowed}
 	}
 
 	// Get the Overlay from the datastore.
-	k, o, err := getOverlay(r)
-	if err != nil {
-		return appErrorf(err, "overlay not found")
-	}
-
-	// Process the request.
-	if o.TopLeft, err = parsePair(r.FormValue("topLeft")); err != nil {
-		return appErrorf(err, "invalid parameter topLeft")
-	}
-	if o.TopRight, err = parsePair(r.FormValue("topRight")); err != nil {
-		return appErrorf(err, "invalid parameter topLeft")
+	k, o, e := requestOverlay(c, p, r, accessEdit)
+	if e != nil {
+		return e
 	}
-	if o.BottomRight, err = parsePair(r.FormValue("bottomRight")); err != nil {
-		return appErrorf(err, "invalid parameter bottomRight")
+	token, e := process(c, p, r, k, o)
+	if e != nil {
+		return e
 	}
 
-	// Compute the transformation matrix.
-	a := graphics.I.Scale(1/float64(o.Width), 1/float64(o.Height)).
-		Mul(inverse(graphics.Affine{
-		o.TopRight[0] - o.TopLeft[0], o.BottomRight[0] - o.TopRight[0], o.TopLeft[0],
-		o.TopRight[1] - o.TopLeft[1], o.BottomRight[1] - o.TopRight[1], o.TopLeft[1],
-		0, 0, 1,
-	}))
-	o.Transform = []float64(a[:])
-
-	// TODO(cbro): get min/max zoom from user.
-	o.MinZoom = 0
-	o.MaxZoom = 21
+	// Send channel token as response.
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+	return nil
+}
 
-	// Compute tiles to be generated.
-	var tiles []*Tile
-	for zoom := o.MinZoom; zoom <= o.MaxZoom; zoom++ {
-		tiles = append(tiles, tilesForZoom(o, zoom)...)
+// process initiates the processing of the Overlay with the specified key as
+// the request's parameters specify, and returns the token of the channel on
+// which its progress is reported. If the "pyramid" parameter is true, lower
+// zoom levels are built from the tiles of higher ones instead of the source
+// image. The principal must still be allowed to see the layers of a mosaic.
+func process(c appengine.Context, p *principal, r *http.Request, k *datastore.Key, o *Overlay) (string, *appError) {
+	// Check the request before the transaction, which retries, and before
+	// the tiles of the earlier run are discarded.
+	if e := processable(o); e != nil {
+		return "", e
+	}
+	if o.isMosaic() {
+		if e := checkLayers(c, p, o.Layers, o.layers); e != nil {
+			return "", e
+		}
+	}
+	if _, e := configure(o, r); e != nil {
+		return "", e
 	}
-	o.Tiles = len(tiles)
 
 	// Create a channel between the app and the client's browser.
 	token, err := channel.Create(c, k.Encode())
 	if err != nil {
-		return appErrorf(err, "couldn't create browser channel")
+		return "", appErrorf(err, "couldn't create browser channel")
 	}
 
-	// Put the updated Overlay into the datastore.
-	if _, err := datastore.Put(c, k, o); err != nil {
-		return appErrorf(err, "could not save overlay to datastore")
+	// Discard the tiles and downloads of an earlier run, so that they are
+	// neither counted as done nor built upon.
+	if err := deleteTiles(c, k); err != nil {
+		return "", appErrorf(err, "could not delete previous tiles")
+	}
+	if err := deleteTileTasks(c, k); err != nil {
+		return "", appErrorf(err, "could not delete previous tile tasks")
+	}
+
+	// Update the Overlay in a transaction, as its image may have been
+	// split, or its sharing changed, since it was loaded. It is loaded
+	// afresh, as Get appends to the slices of a loaded Overlay.
+	var (
+		cur               *Overlay
+		queued            []*Tile
+		oldZip, oldExport appengine.BlobKey
+		e                 *appError
+	)
+	tx := func(c appengine.Context) error {
+		cur = &Overlay{Key: o.Key, Role: o.Role, layers: o.layers}
+		if err := datastore.Get(c, k, cur); err != nil {
+			return err
+		}
+		if e = processable(cur); e != nil {
+			return nil
+		}
+		if queued, e = configure(cur, r); e != nil {
+			return nil
+		}
+		oldZip, oldExport = cur.Zip, cur.Export
+		cur.Zip, cur.Export = "", ""
+		_, err := datastore.Put(c, k, cur)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return "", appErrorf(err, "could not save overlay to datastore")
+	}
+	if e != nil {
+		return "", e
+	}
+	*o = *cur
+	for _, b := range []appengine.BlobKey{oldZip, oldExport} {
+		if b != "" && b != zipSentinel {
+			if err := blobstore.Delete(c, b); err != nil {
+				c.Warningf("deleting previous download: %v", err)
+			}
+		}
 	}
 
 	// Create tasks to generate tiles.
-	tasks := tileTasks(k.Encode(), tiles)
+	tasks := tileTasks(k.Encode(), queued)
 	if err := addTasks(c, tasks, tileQueue); err != nil {
-		return appErrorf(err, "could not start tiling process")
+		return "", appErrorf(err, "could not start tiling process")
 	}
 
 	// Create task to start slice process.
@@ -169,37 +354,275 @@ func processHandler(c appengine.Context, w http.ResponseWriter, r *http.Request)
 		host := appengine.BackendHostname(c, sliceBackend, i)
 		task.Header.Set("Host", host)
 		if _, err := taskqueue.Add(c, task, sliceQueue); err != nil {
-			return appErrorf(err, "could not start tiling process")
+			return "", appErrorf(err, "could not start tiling process")
 		}
 	}
 
-	// Send channel token as response.
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(token))
+	return token, nil
+}
+
+// processable returns an error if the Overlay cannot be processed yet.
+func processable(o *Overlay) *appError {
+	switch {
+	case o.Raster == rasterSentinel:
+		// The tiles would be cut from the image before it is split.
+		return &appError{nil, "overlay image is still being processed", http.StatusConflict}
+	case o.RasterError != "":
+		return &appError{nil, "overlay image could not be split: " + o.RasterError, http.StatusBadRequest}
+	case o.Export == exportSentinel:
+		// A running export would store its result over the new run's.
+		return &appError{nil, "an export of this overlay is running; wait for it to finish", http.StatusConflict}
+	case o.Zip == zipSentinel:
+		// A running zip would store a download of the old tiles, and its
+		// task would be left to wait for a run that has started again.
+		return &appError{nil, "a zip file of this overlay is being made; wait for it to finish", http.StatusConflict}
+	}
 	return nil
 }
 
-// tilesForZoom returns a slice of Tiles at the specified zoom level.  If the
-// number of tiles to be generated is too large (greater than tilesPerZoom),
-// an empty slice is returned.
-func tilesForZoom(o *Overlay, zoom int64) (tiles []*Tile) {
-	l := scaleCoord(min(o.TopLeft[0], o.TopRight[0], o.BottomRight[0], o.BottomLeft()[0]), zoom)
-	r := scaleCoord(max(o.TopLeft[0], o.TopRight[0], o.BottomRight[0], o.BottomLeft()[0]), zoom)
-	t := scaleCoord(min(o.TopLeft[1], o.TopRight[1], o.BottomRight[1], o.BottomLeft()[1]), zoom)
-	b := scaleCoord(max(o.TopLeft[1], o.TopRight[1], o.BottomRight[1], o.BottomLeft()[1]), zoom)
+// configure sets the Overlay's placement and the settings of its tiles from
+// the request's parameters, and returns the tiles to queue first.
+func configure(o *Overlay, r *http.Request) ([]*Tile, *appError) {
+	var err error
+
+	// Overlays that were placed on upload, using
+	// georeferencing read from their image, need not be given corners. The
+	// corners of a mosaic enclose its layers, which are placed already.
+	placed := o.TopLeft != nil && r.FormValue("topLeft") == "" &&
+		r.FormValue("topRight") == "" && r.FormValue("bottomRight") == ""
+	if o.isMosaic() {
+		placed = true
+	}
+	if !placed {
+		if o.TopLeft, err = parsePair(r.FormValue("topLeft")); err != nil {
+			return nil, &appError{err, "invalid parameter topLeft: " + err.Error(), http.StatusBadRequest}
+		}
+		if o.TopRight, err = parsePair(r.FormValue("topRight")); err != nil {
+			return nil, &appError{err, "invalid parameter topRight: " + err.Error(), http.StatusBadRequest}
+		}
+		if o.BottomRight, err = parsePair(r.FormValue("bottomRight")); err != nil {
+			return nil, &appError{err, "invalid parameter bottomRight: " + err.Error(), http.StatusBadRequest}
+		}
+	}
+	if !o.isMosaic() {
+		if err := placeOverlay(o); err != nil {
+			return nil, &appError{err, err.Error(), http.StatusBadRequest}
+		}
+
+		// Compute the transformation matrix.
+		o.Transform = overlayTransform(o)
+
+		if o.Clip, err = parseClip(o, r.FormValue("clip")); err != nil {
+			return nil, &appError{err, err.Error(), http.StatusBadRequest}
+		}
+	} else if r.FormValue("clip") != "" {
+		return nil, &appError{nil, "invalid parameter clip: mosaics cannot be clipped; clip their layers", http.StatusBadRequest}
+	} else if err := o.enclose(); err != nil {
+		// The layers may have been placed again since the mosaic was made.
+		return nil, &appError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	o.TileSize = defaultTileSize
+	if v := r.FormValue("tileSize"); v != "" {
+		if o.TileSize, err = strconv.Atoi(v); err != nil || (o.TileSize != 256 && o.TileSize != 512) {
+			return nil, &appError{err, "invalid parameter tileSize: must be 256 or 512", http.StatusBadRequest}
+		}
+	}
+	o.Retina = false
+	if v := r.FormValue("retina"); v != "" {
+		if o.Retina, err = strconv.ParseBool(v); err != nil {
+			return nil, &appError{err, "invalid parameter retina", http.StatusBadRequest}
+		}
+	}
+	if o.Retina && o.TileSize != 256 {
+		// 1024-pixel tiles may not fit in a datastore entity.
+		return nil, &appError{nil, "invalid parameter retina: high-DPI tiles need a tileSize of 256", http.StatusBadRequest}
+	}
+	if err := parseScheme(o, r.FormValue("scheme"), r.FormValue("tileMatrixSet")); err != nil {
+		return nil, &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	err = parseTransparency(o, r.FormValue("colorKey"), r.FormValue("tolerance"),
+		r.FormValue("lumaAlpha"), r.FormValue("opacity"))
+	if err != nil {
+		return nil, &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	// The layers of a mosaic are adjusted as each of them specifies.
+	if !o.isMosaic() {
+		if err := parseAdjustments(o, r.FormValue); err != nil {
+			return nil, &appError{err, err.Error(), http.StatusBadRequest}
+		}
+	}
+
+	// TODO(cbro): get min/max zoom from user.
+	// At zoom level 0 the world is 256 pixels wide, so larger tiles start
+	// at the zoom level where the world is one tile wide. Quadkeys have no
+	// zoom level 0.
+	o.MinZoom = 0
+	if o.TileSize == 512 || o.Scheme == schemeQuadkey {
+		o.MinZoom = 1
+	}
+	o.MaxZoom = 21
 
-	if (r-l+1)*(b-t+1) > tilesPerZoom {
-		return
+	o.Pyramid = false
+	if v := r.FormValue("pyramid"); v != "" {
+		if o.Pyramid, err = strconv.ParseBool(v); err != nil {
+			return nil, &appError{err, "invalid parameter pyramid", http.StatusBadRequest}
+		}
 	}
+	o.setCells()
+	o.Started = time.Now()
+	o.Updated = o.Started
 
-	for x := l; x <= r; x++ {
-		for y := t; y <= b; y++ {
-			tiles = append(tiles, &Tile{X: x, Y: y, Zoom: zoom})
+	// Compute tiles to be generated. In pyramid mode only the tiles at the
+	// base zoom level are queued now; the slicers queue the others once
+	// their children are stored.
+	var tiles, queued []*Tile
+	base := pyramidBase(o)
+	for zoom := o.MinZoom; zoom <= o.MaxZoom; zoom++ {
+		t := tilesForZoom(o, zoom)
+		tiles = append(tiles, t...)
+		if !o.Pyramid || zoom == base {
+			queued = append(queued, t...)
+		}
+	}
+	o.Tiles = len(tiles)
+	if o.Tiles == 0 {
+		return nil, &appError{nil, fmt.Sprintf("overlay lies outside the tiles of EPSG:%d", o.TileMatrixSet), http.StatusBadRequest}
+	}
+	return queued, nil
+}
+
+// deleteTiles deletes the Tiles, and the high-DPI tiles, of the Overlay with
+// the specified key.
+func deleteTiles(c appengine.Context, oKey *datastore.Key) error {
+	for _, kind := range []string{"Tile", "RetinaTile"} {
+		keys, err := datastore.NewQuery(kind).Ancestor(oKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > deleteBatch {
+				n = deleteBatch
+			}
+			if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+	}
+	return nil
+}
+
+// deleteTileTasks deletes the tasks of the Overlay with the specified key
+// that are waiting in the tileQueue, so that slicers do not render them with
+// the new run's settings. Tasks leased by a slicer are not deleted.
+func deleteTileTasks(c appengine.Context, oKey *datastore.Key) error {
+	for {
+		tasks, err := taskqueue.LeaseByTag(c, maxTaskLease, tileQueue, 60, oKey.Encode())
+		if err != nil || len(tasks) == 0 {
+			return err
+		}
+		if err := taskqueue.DeleteMulti(c, tasks, tileQueue); err != nil {
+			return err
+		}
+	}
+}
+
+// tilesForZoom returns a slice of Tiles at the specified zoom level of the
+// Overlay's tile matrix set.  If the number of tiles to be generated is too
+// large (greater than tilesPerZoom), an empty slice is returned. The columns
+// of Overlays that cross the antimeridian are wrapped into the world.
+func tilesForZoom(o *Overlay, zoom int64) []*Tile {
+	if o.isMosaic() {
+		return mosaicTiles(o, zoom)
+	}
+	tr, ok := tileRangeForZoom(o, zoom)
+	if !ok || tr.count() > tilesPerZoom {
+		return nil
+	}
+	if o.clipped() {
+		return o.coveredTiles(tr.tiles())
+	}
+	return tr.tiles()
+}
+
+// A tileRange is a block of tiles at one zoom level: the columns l to r,
+// which are wrapped into a grid n columns wide, and the rows t to b.
+type tileRange struct {
+	zoom, l, t, r, b, n int64
+}
+
+func (tr *tileRange) count() int64 {
+	return (tr.r - tr.l + 1) * (tr.b - tr.t + 1)
+}
+
+func (tr *tileRange) tiles() (tiles []*Tile) {
+	for _, cols := range wrapColumns(tr.l, tr.r, tr.n) {
+		for x := cols[0]; x <= cols[1]; x++ {
+			for y := tr.t; y <= tr.b; y++ {
+				tiles = append(tiles, &Tile{X: x, Y: y, Zoom: tr.zoom})
+			}
 		}
 	}
 	return
 }
 
+// tileRangeForZoom returns the range of tiles at the specified zoom level
+// that the Overlay covers, reporting whether it covers any.
+func tileRangeForZoom(o *Overlay, zoom int64) (*tileRange, bool) {
+	size := o.tileSize()
+	ms := o.tileMatrixSet()
+	minX, minY, maxX, maxY, err := ms.extent(o)
+	if err != nil {
+		return nil, false
+	}
+	l := scaleCoord(minX, zoom, size)
+	r := scaleCoord(maxX, zoom, size)
+	t := scaleCoord(minY, zoom, size)
+	b := scaleCoord(maxY, zoom, size)
+
+	// A corner on the south or east edge of the grid lies in the tile
+	// beyond it. Only the part of the Overlay within grids that do not
+	// wrap around the world is tiled.
+	n, rows := ms.size(zoom, size)
+	if t < 0 {
+		t = 0
+	}
+	if b > rows-1 {
+		b = rows - 1
+	}
+	if ms.wraps() {
+		if r-l+1 > n {
+			l, r = 0, n-1
+		}
+	} else {
+		if l < 0 {
+			l = 0
+		}
+		if r > n-1 {
+			r = n - 1
+		}
+	}
+	if l > r || t > b {
+		return nil, false
+	}
+	return &tileRange{zoom, l, t, r, b, n}, true
+}
+
+// wrapColumns returns the ranges of tile columns, in a world n tiles wide,
+// that hold the unwrapped columns l to r, which span at most n columns. The
+// columns of an Overlay that crosses the antimeridian are split into two
+// ranges, one each side of it.
+func wrapColumns(l, r, n int64) [][2]int64 {
+	l0 := (l%n + n) % n
+	r0 := l0 + r - l
+	if r0 < n {
+		return [][2]int64{{l0, r0}}
+	}
+	return [][2]int64{{l0, n - 1}, {0, r0 - n}}
+}
+
 // tileTasks returns tasks to generate the provided Tiles.
 func tileTasks(key string, tiles []*Tile) (tasks []*taskqueue.Task) {
 	for _, tile := range tiles {
@@ -217,33 +640,301 @@ func tileTasks(key string, tiles []*Tile) (tasks []*taskqueue.Task) {
 	return
 }
 
-// downloadHandler serves the zip file generated by zipHandler.
-func downloadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
-	k, o, err := getOverlay(r)
-	if err != nil {
-		return appErrorf(err, "overlay not found")
+// downloadHandler serves the zip file generated by zipHandler or, if the
+// "format" parameter is "geotiff", the one generated by geotiffHandler.
+func downloadHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	k, o, e := requestOverlay(c, p, r, accessView)
+	if e != nil {
+		return e
 	}
-	if o.Zip == "" || o.Zip == zipSentinel {
-		return appErrorf(nil, "overlay's zip not generated yet")
+	return sendDownload(w, k, o, r.FormValue("format"))
+}
+
+// sendDownload sends the Overlay's zip file in the specified format, "zip"
+// or "geotiff", as an attachment.
+func sendDownload(w http.ResponseWriter, k *datastore.Key, o *Overlay, format string) *appError {
+	var blob appengine.BlobKey
+	name := k.Encode()
+	switch format {
+	case "", "zip":
+		if o.Zip == "" || o.Zip == zipSentinel {
+			return &appError{nil, "overlay's zip not generated yet", http.StatusConflict}
+		}
+		blob = o.Zip
+	case "geotiff":
+		if o.Export == "" || o.Export == exportSentinel {
+			return &appError{nil, "overlay's export not generated yet", http.StatusConflict}
+		}
+		blob = o.Export
+		name += "-geotiff"
+	default:
+		return &appError{nil, "unknown download format", http.StatusBadRequest}
 	}
-	attachment := fmt.Sprintf(`attachment;filename="%s.zip"`, k.Encode())
+	attachment := fmt.Sprintf(`attachment;filename="%s.zip"`, name)
 	w.Header().Add("Content-Disposition", attachment)
-	blobstore.Send(w, o.Zip)
+	blobstore.Send(w, blob)
+	return nil
+}
+
+// exportHandler starts the export of an Overlay's image as a GeoTIFF, in the
+// coordinate reference system given by the "crs" parameter and at the
+// resolution of the tiles of the zoom level given by the "zoom" parameter
+// (see parseExportGrid for the defaults). It writes a channel token to the
+// response, on which the client is told when the export can be downloaded.
+func exportHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, "must use POST", http.StatusMethodNotAllowed}
+	}
+
+	k, o, e := requestOverlay(c, p, r, accessEdit)
+	if e != nil {
+		return e
+	}
+	if o.isMosaic() {
+		return &appError{nil, "mosaics cannot be exported", http.StatusBadRequest}
+	}
+	if o.Transform == nil {
+		return &appError{nil, "overlay has not been placed", http.StatusBadRequest}
+	}
+	if o.Raster == rasterSentinel {
+		return &appError{nil, "overlay image is still being processed", http.StatusConflict}
+	}
+	g, err := parseExportGrid(o, r.FormValue("crs"), r.FormValue("zoom"))
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	// Create a channel between the app and the client's browser.
+	token, err := channel.Create(c, k.Encode())
+	if err != nil {
+		return appErrorf(err, "couldn't create browser channel")
+	}
+
+	// Mark the export as running and create a task to run it, targeting
+	// the zipper backend. The previous export, if any, is discarded.
+	var old appengine.BlobKey
+	running := false
+	tx := func(c appengine.Context) error {
+		if err := reloadOverlay(c, k, o); err != nil {
+			return err
+		}
+		if running = o.Export == exportSentinel; running {
+			return nil
+		}
+		task := taskqueue.NewPOSTTask("/geotiff", url.Values{
+			"key":  {k.Encode()},
+			"crs":  {strconv.Itoa(g.EPSG)},
+			"zoom": {strconv.FormatInt(g.Zoom, 10)},
+		})
+		if !appengine.IsDevAppServer() {
+			host := appengine.BackendHostname(c, zipBackend, -1)
+			task.Header.Set("Host", host)
+		}
+		if _, err := taskqueue.Add(c, task, zipQueue); err != nil {
+			return err
+		}
+		old, o.Export = o.Export, exportSentinel
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return appErrorf(err, "could not start export")
+	}
+	if running {
+		return &appError{nil, "an export of this overlay is already running", http.StatusConflict}
+	}
+	if old != "" {
+		if err := blobstore.Delete(c, old); err != nil {
+			c.Warningf("deleting previous export: %v", err)
+		}
+	}
+
+	// Send channel token as response.
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+	return nil
+}
+
+// previewHandler returns a PNG image of the Overlay's image, reduced to fit
+// within maxPreviewSize pixels and adjusted as the request's parameters
+// specify (see parseAdjustments), so that adjustments may be tried before the
+// Overlay is processed. The Overlay is not changed.
+func previewHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	_, o, e := requestOverlay(c, p, r, accessView)
+	if e != nil {
+		return e
+	}
+	if o.isMosaic() {
+		return &appError{nil, "mosaics have no image to preview", http.StatusBadRequest}
+	}
+	if o.Raster == rasterSentinel {
+		return &appError{nil, "overlay image is still being processed", http.StatusConflict}
+	}
+	if err := parseAdjustments(o, r.FormValue); err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	src, err := overlaySource(c, o)
+	if err != nil {
+		return appErrorf(err, "could not read overlay image")
+	}
+	m := previewImage(src, maxPreviewSize)
+	if err := src.err(); err != nil {
+		return appErrorf(err, "could not read overlay image")
+	}
+	b, err := encodePNG(m)
+	if err != nil {
+		return appErrorf(err, "could not encode preview")
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+	return nil
+}
+
+// thumbnailHandler returns a PNG thumbnail of the Overlay's image that fits
+// within the number of pixels given by the "size" parameter, one of
+// thumbnailSizes. If the "placed" parameter is true, it instead returns a
+// preview of the placed Overlay on a blank Web Mercator canvas.
+func thumbnailHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	_, o, e := requestOverlay(c, p, r, accessView)
+	if e != nil {
+		return e
+	}
+	placed := false
+	if v := r.FormValue("placed"); v != "" {
+		var err error
+		if placed, err = strconv.ParseBool(v); err != nil {
+			return &appError{err, "invalid parameter placed", http.StatusBadRequest}
+		}
+	}
+	if placed {
+		if o.Transform == nil && !o.isMosaic() {
+			return &appError{nil, "overlay has not been placed", http.StatusBadRequest}
+		}
+		if o.Raster == rasterSentinel {
+			return &appError{nil, "overlay image is still being processed", http.StatusConflict}
+		}
+		m, err := placedPreview(c, o)
+		if err != nil {
+			return appErrorf(err, "could not draw preview")
+		}
+		b, err := encodePNG(m)
+		if err != nil {
+			return appErrorf(err, "could not encode preview")
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(b)
+		return nil
+	}
+
+	size := defaultThumbnailSize
+	if v := r.FormValue("size"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil {
+			return &appError{err, fmt.Sprintf("invalid parameter size: must be one of %v", thumbnailSizes), http.StatusBadRequest}
+		}
+	}
+	bk, ok := o.thumbnailKey(size)
+	if !ok {
+		if len(o.Thumbnails) == 0 {
+			return &appError{nil, "overlay has no thumbnails", http.StatusNotFound}
+		}
+		return &appError{nil, fmt.Sprintf("invalid parameter size: must be one of %v", thumbnailSizes), http.StatusBadRequest}
+	}
+	blobstore.Send(w, bk)
 	return nil
 }
 
-// listHandler returns a JSON-encoded list of Overlays that belong to the
-// logged-in user.
-func listHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
-	q := datastore.NewQuery("Overlay").
-		Filter("Owner = ", user.Current(c).ID)
+// mosaicHandler creates a mosaic of the Overlays given, from the bottom
+// layer to the top, in the "overlays" parameter (at most maxLayers). The
+// optional "feather" parameter sets the width of feathered seams, in image
+// pixels. The mosaic is then processed like any other Overlay, by its
+// datastore key.
+func mosaicHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, "must use POST", http.StatusMethodNotAllowed}
+	}
+
+	feather := 0
+	if v := r.FormValue("feather"); v != "" {
+		var err error
+		if feather, err = strconv.Atoi(v); err != nil {
+			return &appError{err, "invalid parameter feather", http.StatusBadRequest}
+		}
+	}
+	o, e := newMosaic(c, p, r.FormValue("overlays"), feather)
+	if e != nil {
+		return e
+	}
+	k, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Overlay", nil), o)
+	if err != nil {
+		return appErrorf(err, "could not save mosaic to datastore")
+	}
+
+	// It will be known hereafter by its datastore-provided key.
+	fmt.Fprintf(w, "%s", k.Encode())
+	return nil
+}
 
-	var overlays []*Overlay
-	if _, err := q.GetAll(c, &overlays); err != nil {
+// listHandler returns a JSON-encoded page of the list of Overlays that belong
+// to the user making the request or are shared with them, with their Role,
+// as the request's parameters specify (see parseListRequest). The URL of the
+// next page, if there is one, is given in a Link header.
+func listHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "could not parse form", http.StatusBadRequest}
+	}
+	lr, err := parseListRequest(r.Form)
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	keys, overlays, next, err := listOverlays(c, p, lr)
+	if err != nil {
 		return appErrorf(err, "could not get overlays")
 	}
+	for i, k := range keys {
+		overlays[i].Key = k.Encode()
+		overlays[i].setPreviewURLs()
+	}
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r, next)))
+	}
+	return writeOverlays(w, overlays, lr.Summary)
+}
 
-	if err := json.NewEncoder(w).Encode(overlays); err != nil {
+// searchHandler returns a JSON-encoded list of the Overlays that the user
+// making the request may see that lie within the area given by the request's
+// parameters (see parseSearchRequest), as listHandler does. It lists at most
+// the number of Overlays given by the "limit" parameter.
+func searchHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "could not parse form", http.StatusBadRequest}
+	}
+	lr, err := parseSearchRequest(r.Form)
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	keys, overlays, _, err := searchOverlays(c, p, lr)
+	if err != nil {
+		return appErrorf(err, "could not search overlays")
+	}
+	for i, k := range keys {
+		overlays[i].Key = k.Encode()
+		overlays[i].setPreviewURLs()
+	}
+	return writeOverlays(w, overlays, lr.Summary)
+}
+
+// writeOverlays writes the Overlays as JSON, in full or as overlaySummaries.
+func writeOverlays(w http.ResponseWriter, overlays []*Overlay, summary bool) *appError {
+	var v interface{} = overlays
+	if summary {
+		summaries := make([]*overlaySummary, len(overlays))
+		for i, o := range overlays {
+			summaries[i] = newOverlaySummary(o)
+		}
+		v = summaries
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
 		return appErrorf(err, "could not marshal overlay json")
 	}
 	return nil
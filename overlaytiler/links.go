@@ -0,0 +1,174 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Signed links let anyone, without logging in, get an Overlay's tiles and
+// downloads until they expire:
+//
+//	/shared/{id}/{expires}/{signature}/download?format=zip
+//	/shared/{id}/{expires}/{signature}/tiles/{z}/{x}/{y}.png
+//
+// The signature is an HMAC of the Overlay's key, the expiry time in seconds
+// since the Unix epoch and the Overlay's LinkEpoch, so that its owner revokes
+// every link to it by incrementing LinkEpoch.
+
+const sharedPrefix = "/shared/"
+
+const (
+	defaultLinkTTL = 7 * 24 * time.Hour  // how long links last by default
+	maxLinkTTL     = 90 * 24 * time.Hour // limit on how long links last
+)
+
+// LinkSecret holds the key with which links are signed. It is stored in the
+// datastore as the only entity of its kind, and made when first needed.
+type LinkSecret struct {
+	Key []byte
+}
+
+// linkKey caches the key of the LinkSecret.
+var linkKey struct {
+	sync.Mutex
+	key []byte
+}
+
+// signingKey returns the key with which links are signed.
+func signingKey(c appengine.Context) ([]byte, error) {
+	linkKey.Lock()
+	defer linkKey.Unlock()
+	if linkKey.key != nil {
+		return linkKey.key, nil
+	}
+	k := datastore.NewKey(c, "LinkSecret", "links", 0, nil)
+	s := new(LinkSecret)
+	tx := func(c appengine.Context) error {
+		if err := datastore.Get(c, k, s); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Key = make([]byte, sha256.Size)
+		if _, err := rand.Read(s.Key); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, k, s)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return nil, err
+	}
+	linkKey.key = s.Key
+	return s.Key, nil
+}
+
+// linkSignature returns the signature of a link to the Overlay with the
+// specified encoded key and LinkEpoch that expires at the specified time.
+func linkSignature(key []byte, id string, expires int64, epoch int) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%s\n%d\n%d", id, expires, epoch)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// apiLinks makes, with POST, signed links to an Overlay that expire after
+// the number of seconds given by the "ttl" parameter or, with DELETE,
+// revokes all of its links.
+func apiLinks(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, k *datastore.Key, o *Overlay) *appError {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		return methodNotAllowed(w, "POST", "DELETE")
+	}
+	if e := authorizeOverlay(c, p, o, accessOwn); e != nil {
+		return e
+	}
+	if e := requireScope(p, scopeShare); e != nil {
+		return e
+	}
+
+	if r.Method == "DELETE" {
+		tx := func(c appengine.Context) error {
+			if err := reloadOverlay(c, k, o); err != nil {
+				return err
+			}
+			o.LinkEpoch++
+			_, err := datastore.Put(c, k, o)
+			return err
+		}
+		if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+			return appErrorf(err, "could not store overlay")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	ttl := defaultLinkTTL
+	if v := r.FormValue("ttl"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || time.Duration(n)*time.Second > maxLinkTTL {
+			return &appError{err, fmt.Sprintf("invalid parameter ttl: must be from 1 to %d seconds", int64(maxLinkTTL/time.Second)), http.StatusBadRequest}
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+	key, err := signingKey(c)
+	if err != nil {
+		return appErrorf(err, "could not get signing key")
+	}
+	id := k.Encode()
+	expires := time.Now().Add(ttl)
+	base := fmt.Sprintf("%s%s/%d/%s", sharedPrefix, id, expires.Unix(),
+		linkSignature(key, id, expires.Unix(), o.LinkEpoch))
+	writeJSON(w, http.StatusCreated, struct {
+		DownloadURL string    `json:"downloadUrl"`
+		TilesURL    string    `json:"tilesUrl"` // template with {z}, {x} and {y}
+		Expires     time.Time `json:"expires"`
+	}{base + "/download", base + "/tiles/{z}/{x}/{y}.png", expires})
+	return nil
+}
+
+// sharedHandler serves the tiles and downloads of an Overlay to anyone with
+// a valid signed link to them.
+func sharedHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, sharedPrefix), "/")
+	if len(parts) < 4 {
+		return &appError{nil, "no such resource", http.StatusNotFound}
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return &appError{err, "no such resource", http.StatusNotFound}
+	}
+	if time.Now().Unix() > expires {
+		return &appError{nil, "this link has expired", http.StatusGone}
+	}
+	k, o, err := loadOverlay(c, parts[0])
+	if err == errNoOverlay {
+		return &appError{err, "overlay not found", http.StatusNotFound}
+	} else if err != nil {
+		return appErrorf(err, "could not get overlay")
+	}
+	key, err := signingKey(c)
+	if err != nil {
+		return appErrorf(err, "could not get signing key")
+	}
+	sig := linkSignature(key, parts[0], expires, o.LinkEpoch)
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return &appError{nil, "this link is invalid or has been revoked", http.StatusForbidden}
+	}
+	switch {
+	case len(parts) == 4 && parts[3] == "download":
+		return sendDownload(w, k, o, r.FormValue("format"))
+	case len(parts) == 7 && parts[3] == "tiles":
+		return apiTile(c, w, k, parts[4:])
+	}
+	return &appError{nil, "no such resource", http.StatusNotFound}
+}
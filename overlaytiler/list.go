@@ -0,0 +1,495 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Lists of Overlays are read a page at a time. A user's Overlays, and those
+// shared with them, are read by separate datastore queries, in the same
+// order, and merged. Filters that the datastore cannot apply without an
+// index for every combination of them are applied as the Overlays are read,
+// up to maxListScan Overlays per page; a page may then be short, but still
+// gives a cursor from which to read on. Cursors name the sort value and key
+// of the last Overlay read, so that they hold across the merged queries.
+
+const (
+	defaultListLimit = 100  // Overlays per page by default
+	maxListLimit     = 500  // limit on Overlays per page
+	maxListScan      = 2000 // limit on Overlays read per page
+)
+
+// listOrders are the orders in which lists of Overlays may be sorted, by the
+// Overlay fields they sort on; a "-" prefix reverses them. Overlays stored
+// before a field was recorded are not listed when sorting on it. Lists are
+// in key order by default.
+var listOrders = map[string]string{
+	"created": "Created",
+	"updated": "Updated",
+	"name":    "Name",
+}
+
+// A listOrder is the order of a list of Overlays.
+type listOrder struct {
+	field string // the Overlay field sorted on, or "" for key order
+	desc  bool
+}
+
+// parseListOrder parses the sort order given by the "sort" parameter.
+func parseListOrder(s string) (listOrder, error) {
+	if s == "" {
+		return listOrder{}, nil
+	}
+	desc := strings.HasPrefix(s, "-")
+	field, ok := listOrders[strings.TrimPrefix(s, "-")]
+	if !ok {
+		return listOrder{}, errors.New("invalid parameter sort: must be created, updated or name, optionally prefixed by -")
+	}
+	return listOrder{field, desc}, nil
+}
+
+// value returns the Overlay's value of the field sorted on.
+func (lo listOrder) value(o *Overlay) interface{} {
+	switch lo.field {
+	case "Created":
+		return o.Created
+	case "Updated":
+		return o.Updated
+	case "Name":
+		return o.Name
+	}
+	return nil
+}
+
+// less reports whether the Overlay a, with key ka, is listed before b.
+// Overlays with equal values are listed in key order.
+func (lo listOrder) less(a *Overlay, ka *datastore.Key, b *Overlay, kb *datastore.Key) bool {
+	if c := compareValues(lo.value(a), lo.value(b)); c != 0 {
+		return c < 0 != lo.desc
+	}
+	return keyLess(ka, kb)
+}
+
+// compareValues compares two values of the same field sorted on.
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	case string:
+		b := b.(string)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+// keyLess reports whether the Overlay key a is ordered before b by the
+// datastore: integer IDs before names.
+func keyLess(a, b *datastore.Key) bool {
+	switch {
+	case a.IntID() != 0 && b.IntID() != 0:
+		return a.IntID() < b.IntID()
+	case a.IntID() != 0 || b.IntID() != 0:
+		return a.IntID() != 0
+	}
+	return a.StringID() < b.StringID()
+}
+
+// A listCursor names the last Overlay read for a page of a list.
+type listCursor struct {
+	Value string `json:"v,omitempty"` // the value sorted on
+	Key   string `json:"k"`           // the encoded key
+	key   *datastore.Key
+	value interface{}
+}
+
+// newListCursor returns the cursor naming the Overlay with the specified key.
+func newListCursor(lo listOrder, k *datastore.Key, o *Overlay) string {
+	cur := &listCursor{Key: k.Encode()}
+	switch v := lo.value(o).(type) {
+	case time.Time:
+		cur.Value = v.Format(time.RFC3339Nano)
+	case string:
+		cur.Value = v
+	}
+	b, _ := json.Marshal(cur)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// parseListCursor parses a cursor made by newListCursor for the same order.
+func parseListCursor(lo listOrder, s string) (*listCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	errCursor := errors.New("invalid parameter cursor")
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errCursor
+	}
+	cur := new(listCursor)
+	if err := json.Unmarshal(b, cur); err != nil {
+		return nil, errCursor
+	}
+	if cur.key, err = datastore.DecodeKey(cur.Key); err != nil {
+		return nil, errCursor
+	}
+	switch lo.value(new(Overlay)).(type) {
+	case time.Time:
+		if cur.value, err = time.Parse(time.RFC3339Nano, cur.Value); err != nil {
+			return nil, errCursor
+		}
+	case string:
+		cur.value = cur.Value
+	}
+	return cur, nil
+}
+
+// after reports whether the Overlay with the specified key is listed after
+// the one named by the cursor.
+func (cur *listCursor) after(lo listOrder, k *datastore.Key, o *Overlay) bool {
+	if c := compareValues(lo.value(o), cur.value); c != 0 {
+		return c > 0 != lo.desc
+	}
+	return keyLess(cur.key, k)
+}
+
+// queries returns the queries that read q in the order, from after the
+// cursor, if there is one, one after the other. Past a cursor, the Overlays
+// with the cursor's value and a later key are read first, and then those
+// with later values, so that however many share a value none is read twice.
+func (lo listOrder) queries(q *datastore.Query, cur *listCursor) []*datastore.Query {
+	if lo.field == "" {
+		q = q.Order("__key__")
+		if cur != nil {
+			q = q.Filter("__key__ >", cur.key)
+		}
+		return []*datastore.Query{q}
+	}
+	order, op := lo.field, " >"
+	if lo.desc {
+		order, op = "-"+lo.field, " <"
+	}
+	if cur == nil {
+		return []*datastore.Query{q.Order(order)}
+	}
+	return []*datastore.Query{
+		q.Filter(lo.field+" =", cur.value).Filter("__key__ >", cur.key).Order("__key__"),
+		q.Filter(lo.field+op, cur.value).Order(order),
+	}
+}
+
+// An overlayFilter selects Overlays by their metadata, state and position.
+type overlayFilter struct {
+	Query         string   // in the name or description, in lower case
+	Tags          []string // all of which the Overlay has
+	License       string
+	After, Before time.Time // bounds on the capture date, unless zero
+	State         string    // see Overlay.state
+	Bounds        []float64 // west, south, east and north bounds it overlaps
+}
+
+// parseFilter parses an overlayFilter from the form values "q", "tag" (which
+// may be repeated, or comma-separated), "license", "capturedAfter",
+// "capturedBefore", "state" and "bbox" (west,south,east,north in degrees).
+func parseFilter(v url.Values) (*overlayFilter, error) {
+	f := &overlayFilter{
+		Query:   strings.ToLower(strings.TrimSpace(v.Get("q"))),
+		License: strings.TrimSpace(v.Get("license")),
+		State:   v.Get("state"),
+	}
+	tags, err := parseTags(strings.Join(v["tag"], ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter tag: %v", err)
+	}
+	f.Tags = tags
+	if f.After, err = parseDate(v.Get("capturedAfter")); err != nil {
+		return nil, fmt.Errorf("invalid parameter capturedAfter: %v", err)
+	}
+	if f.Before, err = parseDate(v.Get("capturedBefore")); err != nil {
+		return nil, fmt.Errorf("invalid parameter capturedBefore: %v", err)
+	}
+	switch f.State {
+	case "", stateRasterizing, stateFailed, stateUploaded, stateProcessing, stateDone:
+	default:
+		return nil, fmt.Errorf("invalid parameter state: must be %s, %s, %s, %s or %s",
+			stateRasterizing, stateFailed, stateUploaded, stateProcessing, stateDone)
+	}
+	if s := v.Get("bbox"); s != "" {
+		if f.Bounds, err = parseBounds(s); err != nil {
+			return nil, fmt.Errorf("invalid parameter bbox: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// parseBounds parses bounds given as west,south,east,north in degrees.
+func parseBounds(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("must be west,south,east,north")
+	}
+	b := make([]float64, 4)
+	for i, p := range parts {
+		var err error
+		if b[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return nil, errors.New("must be west,south,east,north")
+		}
+	}
+	if b[0] > b[2] || b[1] > b[3] || b[1] < -90 || b[3] > 90 {
+		return nil, errors.New("must be west,south,east,north with west <= east and south <= north")
+	}
+	return b, nil
+}
+
+// matches reports whether the Overlay is selected by the filter.
+func (f *overlayFilter) matches(o *Overlay) bool {
+	if f.Query != "" &&
+		!strings.Contains(strings.ToLower(o.Name), f.Query) &&
+		!strings.Contains(strings.ToLower(o.Description), f.Query) {
+		return false
+	}
+	if f.License != "" && !strings.EqualFold(o.License, f.License) {
+		return false
+	}
+	for _, t := range f.Tags {
+		found := false
+		for _, ot := range o.Tags {
+			found = found || ot == t
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.State != "" && o.state() != f.State {
+		return false
+	}
+	if f.Bounds != nil && !boundsIntersect(o.bounds(), f.Bounds) {
+		return false
+	}
+	if f.After.IsZero() && f.Before.IsZero() {
+		return true
+	}
+	return !o.Captured.IsZero() &&
+		(f.After.IsZero() || !o.Captured.Before(f.After)) &&
+		(f.Before.IsZero() || !o.Captured.After(f.Before))
+}
+
+// A listRequest describes a page of a list of Overlays.
+type listRequest struct {
+	Order   listOrder
+	Filter  *overlayFilter
+	Cursor  *listCursor
+	Limit   int
+	Summary bool // whether the compact form of Overlays is wanted
+}
+
+// parseListRequest parses a listRequest from the form values "sort",
+// "cursor", "limit" and "view" ("full" or "summary"), and those of
+// parseFilter.
+func parseListRequest(v url.Values) (*listRequest, error) {
+	lr := &listRequest{Limit: defaultListLimit}
+	var err error
+	if lr.Order, err = parseListOrder(v.Get("sort")); err != nil {
+		return nil, err
+	}
+	if lr.Filter, err = parseFilter(v); err != nil {
+		return nil, err
+	}
+	if lr.Cursor, err = parseListCursor(lr.Order, v.Get("cursor")); err != nil {
+		return nil, err
+	}
+	if err := lr.parseView(v); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+// parseView sets the listRequest's Limit and Summary from the form values
+// "limit" and "view".
+func (lr *listRequest) parseView(v url.Values) error {
+	if s := v.Get("limit"); s != "" {
+		var err error
+		if lr.Limit, err = strconv.Atoi(s); err != nil || lr.Limit < 1 || lr.Limit > maxListLimit {
+			return fmt.Errorf("invalid parameter limit: must be from 1 to %d", maxListLimit)
+		}
+	}
+	switch v.Get("view") {
+	case "", "full":
+	case "summary":
+		lr.Summary = true
+	default:
+		return errors.New("invalid parameter view: must be full or summary")
+	}
+	return nil
+}
+
+// listSource is one of the queries whose Overlays are merged into a list,
+// read by one or more datastore queries in turn.
+type listSource struct {
+	its  []*datastore.Iterator
+	key  *datastore.Key // of the next Overlay, or nil if there are no more
+	next *Overlay
+}
+
+func (s *listSource) advance() error {
+	for len(s.its) > 0 {
+		o := new(Overlay)
+		k, err := s.its[0].Next(o)
+		if err == datastore.Done {
+			s.its = s.its[1:]
+			continue
+		} else if err != nil {
+			return err
+		}
+		s.key, s.next = k, o
+		return nil
+	}
+	s.key, s.next = nil, nil
+	return nil
+}
+
+// accessQueries returns queries for the Overlays that the principal owns and
+// those shared with it, as an editor and as a viewer, loading its Groups.
+func accessQueries(c appengine.Context, p *principal) ([]*datastore.Query, error) {
+	if err := p.loadGroups(c); err != nil {
+		return nil, err
+	}
+	queries := []*datastore.Query{datastore.NewQuery("Overlay").Filter("Owner = ", p.UserID)}
+	for _, field := range []string{"Editors", "Viewers"} {
+		for _, id := range p.identities() {
+			queries = append(queries, datastore.NewQuery("Overlay").Filter(field+" = ", id))
+		}
+	}
+	return queries, nil
+}
+
+// listOverlays returns a page of the Overlays that the principal owns or
+// that are shared with it, with their Role set, and the cursor of the next
+// page, if there is one. Only owners are told who their Overlays are shared
+// with.
+func listOverlays(c appengine.Context, p *principal, lr *listRequest) ([]*datastore.Key, []*Overlay, string, error) {
+	queries, err := accessQueries(c, p)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var sources []*listSource
+	for _, q := range queries {
+		s := new(listSource)
+		for _, q := range lr.Order.queries(q, lr.Cursor) {
+			s.its = append(s.its, q.Run(c))
+		}
+		if err := s.advance(); err != nil {
+			return nil, nil, "", err
+		}
+		sources = append(sources, s)
+	}
+
+	var keys []*datastore.Key
+	var overlays []*Overlay
+	var lastKey *datastore.Key
+	var last *Overlay
+	seen := make(map[string]bool)
+	scanned := 0
+	for len(keys) <= lr.Limit && scanned < maxListScan {
+		// Read the first Overlay of those next in each query.
+		var s *listSource
+		for _, t := range sources {
+			if t.key != nil && (s == nil || lr.Order.less(t.next, t.key, s.next, s.key)) {
+				s = t
+			}
+		}
+		if s == nil {
+			break
+		}
+		k, o := s.key, s.next
+		if err := s.advance(); err != nil {
+			return nil, nil, "", err
+		}
+		scanned++
+		if seen[k.Encode()] || lr.Cursor != nil && !lr.Cursor.after(lr.Order, k, o) {
+			continue
+		}
+		seen[k.Encode()] = true
+		lastKey, last = k, o
+		if !lr.Filter.matches(o) {
+			continue
+		}
+		o.Role = overlayAccess(p, o).role()
+		if o.Role != roleOwner {
+			o.Viewers, o.Editors = nil, nil
+		}
+		keys, overlays = append(keys, k), append(overlays, o)
+	}
+
+	// There is more to read if a further Overlay was read, or if reading
+	// stopped short.
+	next := ""
+	switch {
+	case len(keys) > lr.Limit:
+		keys, overlays = keys[:lr.Limit], overlays[:lr.Limit]
+		next = newListCursor(lr.Order, keys[lr.Limit-1], overlays[lr.Limit-1])
+	case scanned >= maxListScan && lastKey != nil:
+		next = newListCursor(lr.Order, lastKey, last)
+	}
+	return keys, overlays, next, nil
+}
+
+// An overlaySummary is the compact form of an Overlay in lists.
+type overlaySummary struct {
+	Key          string
+	Name         string    `json:",omitempty"`
+	State        string    // see Overlay.state
+	Role         string    // the user's role
+	Tags         []string  `json:",omitempty"`
+	Bounds       []float64 `json:",omitempty"` // west, south, east and north
+	Created      time.Time
+	Updated      time.Time
+	ThumbnailURL string `json:",omitempty"`
+}
+
+func newOverlaySummary(o *Overlay) *overlaySummary {
+	return &overlaySummary{
+		Key:          o.Key,
+		Name:         o.Name,
+		State:        o.state(),
+		Role:         o.Role,
+		Tags:         o.Tags,
+		Bounds:       o.bounds(),
+		Created:      o.Created,
+		Updated:      o.Updated,
+		ThumbnailURL: o.ThumbnailURL,
+	}
+}
+
+// nextPageURL returns the URL of the page of a list that starts at the
+// specified cursor, with the other parameters of the request r.
+func nextPageURL(r *http.Request, cursor string) string {
+	q := make(url.Values)
+	for k, v := range r.Form {
+		q[k] = v
+	}
+	q.Set("cursor", cursor)
+	return r.URL.Path + "?" + q.Encode()
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"math"
+)
+
+// World coordinates are Web Mercator (EPSG:3857) pixel coordinates at zoom
+// level 0, at which the world is a single 256x256 tile with (0, 0) at its
+// north-west corner.
+
+// earthRadius is the radius of the sphere used by Web Mercator, in meters.
+const earthRadius = 6378137
+
+// maxLatitude is the latitude, in degrees, of the north and south edges of
+// the world.
+const maxLatitude = 85.0511287798
+
+// lngLatToWorld converts a longitude and latitude in degrees to world
+// coordinates.
+func lngLatToWorld(lng, lat float64) []float64 {
+	siny := math.Sin(lat * math.Pi / 180)
+	return []float64{
+		(lng + 180) / 360 * 256,
+		(0.5 - math.Log((1+siny)/(1-siny))/(4*math.Pi)) * 256,
+	}
+}
+
+// mercatorToWorld converts Web Mercator coordinates in meters to world
+// coordinates.
+func mercatorToWorld(x, y float64) []float64 {
+	c := 2 * math.Pi * earthRadius
+	return []float64{(x/c + 0.5) * 256, (0.5 - y/c) * 256}
+}
+
+// worldToLngLat converts world coordinates to a longitude and latitude in
+// degrees.
+func worldToLngLat(x, y float64) []float64 {
+	return []float64{
+		x/256*360 - 180,
+		math.Atan(math.Sinh(math.Pi*(1-2*y/256))) * 180 / math.Pi,
+	}
+}
+
+// worldToMercator converts world coordinates to Web Mercator coordinates in
+// meters.
+func worldToMercator(x, y float64) []float64 {
+	c := 2 * math.Pi * earthRadius
+	return []float64{(x/256 - 0.5) * c, (0.5 - y/256) * c}
+}
+
+// modelToWorld converts coordinates in the coordinate reference system
+// identified by the specified EPSG code to world coordinates. Only geographic
+// systems based on WGS 84 or close equivalents, Web Mercator, and the
+// projections in projection.go are supported.
+func modelToWorld(epsg int, x, y float64) ([]float64, error) {
+	switch epsg {
+	case 4326, 4258, 4269, 4283, 4167:
+		return lngLatToWorld(x, y), nil
+	case 3857, 3785, 900913, 102100, 102113:
+		return mercatorToWorld(x, y), nil
+	case 0:
+		return nil, fmt.Errorf("unknown coordinate reference system")
+	}
+	if p, ok := projections[epsg]; ok {
+		return lngLatToWorld(p.inverse(x, y)), nil
+	}
+	return nil, fmt.Errorf("unsupported coordinate reference system EPSG:%d", epsg)
+}
+
+// worldToModel converts world coordinates to coordinates in the coordinate
+// reference system identified by the specified EPSG code. It supports the
+// same systems as modelToWorld.
+func worldToModel(epsg int, x, y float64) ([]float64, error) {
+	switch epsg {
+	case 4326, 4258, 4269, 4283, 4167:
+		return worldToLngLat(x, y), nil
+	case 3857, 3785, 900913, 102100, 102113:
+		return worldToMercator(x, y), nil
+	case 0:
+		return nil, fmt.Errorf("unknown coordinate reference system")
+	}
+	if p, ok := projections[epsg]; ok {
+		ll := worldToLngLat(x, y)
+		x, y := p.forward(ll[0], ll[1])
+		return []float64{x, y}, nil
+	}
+	return nil, fmt.Errorf("unsupported coordinate reference system EPSG:%d", epsg)
+}
+
+// geographic reports whether the coordinate reference system identified by
+// the specified EPSG code has coordinates in degrees of longitude and
+// latitude.
+func geographic(epsg int) bool {
+	switch epsg {
+	case 4326, 4258, 4269, 4283, 4167:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Overlays carry metadata that their users set when they upload them or
+// later: a name, a description, tags, an attribution of their source, a
+// licence and the date they were captured. Lists of Overlays may be filtered
+// by it, and it is written into the zip file, both in the viewer and as
+// TileJSON and MBTiles metadata.
+
+const (
+	maxNameLength        = 200
+	maxDescriptionLength = 5000
+	maxAttributionLength = 500
+	maxLicenseLength     = 100
+	maxTags              = 20
+	maxTagLength         = 50
+)
+
+// parseMetadata sets the Overlay's metadata from the form values present in
+// v: "name", "description", "tags" (comma-separated), "attribution",
+// "license" and "captured" (a date, or a time in RFC 3339 format). Empty
+// values clear the metadata they set.
+func parseMetadata(o *Overlay, v url.Values) error {
+	for _, f := range []struct {
+		name string
+		max  int
+		dst  *string
+	}{
+		{"name", maxNameLength, &o.Name},
+		{"description", maxDescriptionLength, &o.Description},
+		{"attribution", maxAttributionLength, &o.Attribution},
+		{"license", maxLicenseLength, &o.License},
+	} {
+		if _, ok := v[f.name]; !ok {
+			continue
+		}
+		s := strings.TrimSpace(v.Get(f.name))
+		if !utf8.ValidString(s) || utf8.RuneCountInString(s) > f.max {
+			return fmt.Errorf("invalid parameter %s: must be valid text of at most %d characters", f.name, f.max)
+		}
+		*f.dst = s
+	}
+	if _, ok := v["tags"]; ok {
+		tags, err := parseTags(v.Get("tags"))
+		if err != nil {
+			return fmt.Errorf("invalid parameter tags: %v", err)
+		}
+		o.Tags = tags
+	}
+	if _, ok := v["captured"]; ok {
+		t, err := parseDate(v.Get("captured"))
+		if err != nil {
+			return fmt.Errorf("invalid parameter captured: %v", err)
+		}
+		o.Captured = t
+	}
+	return nil
+}
+
+// parseTags parses a comma-separated list of tags, which are kept in lower
+// case.
+func parseTags(s string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if !utf8.ValidString(t) || utf8.RuneCountInString(t) > maxTagLength {
+			return nil, fmt.Errorf("tags must be valid text of at most %d characters", maxTagLength)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return tags, nil
+}
+
+// parseDate parses a date, as YYYY-MM-DD, or a time in RFC 3339 format. An
+// empty string gives the zero time.
+func parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("must be a date, as YYYY-MM-DD, or an RFC 3339 time")
+	}
+	return t, nil
+}
+
+// defaultName returns the name given to an Overlay uploaded without one:
+// the name of its image file, without its extension.
+func defaultName(filename string) string {
+	name := path.Base(strings.Replace(filename, `\`, "/", -1))
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "." || name == "/" {
+		return ""
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		name = string([]rune(name)[:maxNameLength])
+	}
+	return name
+}
+
+// updateMetadata sets the metadata of an Overlay from the request's form
+// values, as parseMetadata does, and stores it.
+func updateMetadata(c appengine.Context, r *http.Request, k *datastore.Key, o *Overlay) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "could not parse form", http.StatusBadRequest}
+	}
+	// Check the values before the transaction, which retries.
+	if err := parseMetadata(new(Overlay), r.Form); err != nil {
+		return &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	tx := func(c appengine.Context) error {
+		if err := reloadOverlay(c, k, o); err != nil {
+			return err
+		}
+		if err := parseMetadata(o, r.Form); err != nil {
+			return err
+		}
+		o.Updated = time.Now()
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return appErrorf(err, "could not store overlay")
+	}
+	return nil
+}
+
+// metadataHandler updates the metadata of the Overlay identified by the
+// "key" parameter (see parseMetadata) and writes it as JSON.
+func metadataHandler(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, "must use POST", http.StatusMethodNotAllowed}
+	}
+	k, o, e := requestOverlay(c, p, r, accessEdit)
+	if e != nil {
+		return e
+	}
+	if e := updateMetadata(c, r, k, o); e != nil {
+		return e
+	}
+	o.Key = k.Encode()
+	o.Role = overlayAccess(p, o).role()
+	o.setPreviewURLs()
+	if err := json.NewEncoder(w).Encode(o); err != nil {
+		return appErrorf(err, "could not marshal overlay json")
+	}
+	return nil
+}
+
+// bounds returns the west, south, east and north bounds of the placed
+// Overlay in degrees of longitude and latitude.
+func (o *Overlay) bounds() []float64 {
+	if o.TopLeft == nil {
+		return nil
+	}
+	var b []float64
+	for _, p := range [][]float64{o.TopLeft, o.TopRight, o.BottomRight, o.BottomLeft()} {
+		ll := worldToLngLat(p[0], p[1])
+		if b == nil {
+			b = []float64{ll[0], ll[1], ll[0], ll[1]}
+		}
+		b[0], b[1] = min(b[0], ll[0]), min(b[1], ll[1])
+		b[2], b[3] = max(b[2], ll[0]), max(b[3], ll[1])
+	}
+	return b
+}
+
+// A tileJSON describes an Overlay's tiles in the TileJSON 2.2.0 format, for
+// Web Mercator tiles named by the XYZ or TMS scheme.
+type tileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Attribution string    `json:"attribution,omitempty"`
+	Scheme      string    `json:"scheme"`
+	Tiles       []string  `json:"tiles"`
+	MinZoom     int64     `json:"minzoom"`
+	MaxZoom     int64     `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds,omitempty"`
+}
+
+// newTileJSON returns the TileJSON describing the Overlay's tiles, at the
+// URL template given, or nil if TileJSON cannot describe them.
+func newTileJSON(o *Overlay, tiles string) *tileJSON {
+	if o.tileMatrixSet().EPSG != 3857 || o.scheme() == schemeQuadkey {
+		return nil
+	}
+	return &tileJSON{
+		TileJSON:    "2.2.0",
+		Name:        o.Name,
+		Description: o.Description,
+		Attribution: o.Attribution,
+		Scheme:      o.scheme(),
+		Tiles:       []string{tiles},
+		MinZoom:     o.MinZoom,
+		MaxZoom:     o.MaxZoom,
+		Bounds:      o.bounds(),
+	}
+}
+
+// mbtilesMetadata returns the Overlay's metadata as the name and value pairs
+// of the metadata table of an MBTiles file.
+func mbtilesMetadata(o *Overlay) map[string]string {
+	m := map[string]string{
+		"name":    o.Name,
+		"format":  "png",
+		"type":    "overlay",
+		"version": "1",
+		"minzoom": strconv.FormatInt(o.MinZoom, 10),
+		"maxzoom": strconv.FormatInt(o.MaxZoom, 10),
+		"scheme":  o.scheme(),
+	}
+	if b := o.bounds(); b != nil {
+		m["bounds"] = fmt.Sprintf("%g,%g,%g,%g", b[0], b[1], b[2], b[3])
+		m["center"] = fmt.Sprintf("%g,%g,%d", (b[0]+b[2])/2, (b[1]+b[3])/2, o.MinZoom)
+	}
+	for name, v := range map[string]string{
+		"description": o.Description,
+		"attribution": o.Attribution,
+		"license":     o.License,
+		"tags":        strings.Join(o.Tags, ","),
+	} {
+		if v != "" {
+			m[name] = v
+		}
+	}
+	if !o.Captured.IsZero() {
+		m["captured"] = o.Captured.Format(time.RFC3339)
+	}
+	return m
+}
+
+// addMetadataToZip adds the Overlay's metadata to the provided zip file, as
+// metadata.json, holding its MBTiles metadata, and as tilejson.json, if
+// TileJSON can describe its tiles.
+func addMetadataToZip(z *zip.Writer, oKey *datastore.Key, o *Overlay) error {
+	files := map[string]interface{}{"metadata.json": mbtilesMetadata(o)}
+	if tj := newTileJSON(o, "{z}/{x}/{y}.png"); tj != nil {
+		files["tilejson.json"] = tj
+	}
+	for name, v := range files {
+		w, err := z.Create(fmt.Sprintf("%s/%s", oKey.Encode(), name))
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
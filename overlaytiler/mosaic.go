@@ -0,0 +1,281 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"code.google.com/p/graphics-go/graphics"
+)
+
+// A mosaic is an Overlay that combines the images of several placed Overlays,
+// its layers, into one set of tiles. It has no image of its own: each of its
+// tiles is drawn by compositing the layers that cover it, from the bottom up,
+// so that adjacent map sheets are tiled without seams. Its corners enclose
+// those of its layers.
+
+const (
+	maxFeather = 256 // limit on the width of feathered seams, in image pixels
+	maxLayers  = 16  // limit on the layers of a mosaic, whose images are all open while tiling
+)
+
+// isMosaic reports whether the Overlay is a mosaic.
+func (o *Overlay) isMosaic() bool {
+	return len(o.Layers) > 0
+}
+
+// getLayers returns the Overlays with the specified keys. Those that have
+// been deleted are nil.
+func getLayers(c appengine.Context, keys []*datastore.Key) ([]*Overlay, error) {
+	layers := make([]*Overlay, len(keys))
+	for i := range layers {
+		layers[i] = new(Overlay)
+	}
+	err := datastore.GetMulti(c, keys, layers)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	for i := range merr {
+		switch merr[i] {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			layers[i] = nil
+		default:
+			return nil, merr[i]
+		}
+	}
+	return layers, nil
+}
+
+// checkLayers returns an error unless the principal may see each of the
+// specified layers of a mosaic, which must not have been deleted, must be
+// placed, and whose images must be ready.
+func checkLayers(c appengine.Context, p *principal, keys []*datastore.Key, layers []*Overlay) *appError {
+	if err := p.loadGroups(c); err != nil {
+		return appErrorf(err, "could not get groups")
+	}
+	for i, l := range layers {
+		switch {
+		case l == nil || overlayAccess(p, l) < accessView:
+			return &appError{errNoOverlay, fmt.Sprintf("overlay %s not found", keys[i].Encode()), http.StatusNotFound}
+		case l.isMosaic():
+			return &appError{nil, fmt.Sprintf("overlay %s is a mosaic", keys[i].Encode()), http.StatusBadRequest}
+		case l.Transform == nil:
+			return &appError{nil, fmt.Sprintf("overlay %s has not been placed", keys[i].Encode()), http.StatusBadRequest}
+		case l.Raster == rasterSentinel:
+			return &appError{nil, fmt.Sprintf("overlay %s image is still being processed", keys[i].Encode()), http.StatusConflict}
+		case l.RasterError != "":
+			return &appError{nil, fmt.Sprintf("overlay %s image could not be split", keys[i].Encode()), http.StatusBadRequest}
+		}
+	}
+	return nil
+}
+
+// newMosaic returns a mosaic owned by the specified principal of the Overlays
+// whose encoded keys are given as a comma-separated list, from the bottom
+// layer to the top. The principal must be allowed to see the layers, which
+// must be placed, and their images must be ready.
+func newMosaic(c appengine.Context, p *principal, list string, feather int) (*Overlay, *appError) {
+	if list == "" {
+		return nil, &appError{nil, "missing parameter overlays", http.StatusBadRequest}
+	}
+	if feather < 0 || feather > maxFeather {
+		return nil, &appError{nil, fmt.Sprintf("invalid parameter feather: must be from 0 to %d", maxFeather), http.StatusBadRequest}
+	}
+	if n := len(strings.Split(list, ",")); n > maxLayers {
+		return nil, &appError{nil, fmt.Sprintf("invalid parameter overlays: a mosaic may have at most %d layers", maxLayers), http.StatusBadRequest}
+	}
+	var keys []*datastore.Key
+	for _, s := range strings.Split(list, ",") {
+		k, err := datastore.DecodeKey(s)
+		if err != nil || k.Kind() != "Overlay" {
+			return nil, &appError{err, fmt.Sprintf("invalid parameter overlays: bad key %q", s), http.StatusBadRequest}
+		}
+		keys = append(keys, k)
+	}
+	layers, err := getLayers(c, keys)
+	if err != nil {
+		return nil, appErrorf(err, "could not get overlays")
+	}
+	if e := checkLayers(c, p, keys, layers); e != nil {
+		return nil, e
+	}
+	now := time.Now()
+	o := &Overlay{Owner: p.UserID, Created: now, Updated: now, Layers: keys, Feather: feather, layers: layers}
+	if err := o.enclose(); err != nil {
+		return nil, &appError{err, err.Error(), http.StatusBadRequest}
+	}
+	o.setCells()
+	return o, nil
+}
+
+// enclose sets the corners of a mosaic to the smallest rectangle in world
+// coordinates that holds its layers. Layers on the far side of the
+// antimeridian from the bottom layer are unwrapped to lie beside it.
+func (o *Overlay) enclose() error {
+	var xs, ys []float64
+	ref := o.layers[0].TopLeft[0]
+	for _, l := range o.layers {
+		shift := math.Floor((ref-l.TopLeft[0])/worldSize+0.5) * worldSize
+		for _, p := range [][]float64{l.TopLeft, l.TopRight, l.BottomRight, l.BottomLeft()} {
+			xs, ys = append(xs, p[0]+shift), append(ys, p[1])
+		}
+	}
+	minX, maxX := min(xs...), max(xs...)
+	if maxX-minX > worldSize {
+		return errors.New("overlays span more than the width of the world")
+	}
+	shift := math.Floor(minX/worldSize) * worldSize
+	minX, maxX = minX-shift, maxX-shift
+	o.TopLeft = []float64{minX, min(ys...)}
+	o.TopRight = []float64{maxX, min(ys...)}
+	o.BottomRight = []float64{maxX, max(ys...)}
+	return nil
+}
+
+// layerTiling returns a copy of the mosaic's layer l with the tile size and
+// tile matrix set of the mosaic, for finding the tiles it covers.
+func (o *Overlay) layerTiling(l *Overlay) *Overlay {
+	t := *l
+	t.TileSize, t.TileMatrixSet = o.TileSize, o.TileMatrixSet
+	return &t
+}
+
+// mosaicTiles returns the tiles at the specified zoom level that are covered
+// by any of the mosaic's layers. If their number is greater than
+// tilesPerZoom, no tiles are returned.
+func mosaicTiles(o *Overlay, zoom int64) (tiles []*Tile) {
+	seen := make(map[string]bool)
+	for _, l := range o.layers {
+		lt := o.layerTiling(l)
+		tr, ok := tileRangeForZoom(lt, zoom)
+		if !ok {
+			continue
+		}
+		if tr.count() > tilesPerZoom {
+			return nil
+		}
+		lts := tr.tiles()
+		if lt.clipped() {
+			lts = lt.coveredTiles(lts)
+		}
+		for _, t := range lts {
+			if !seen[t.String()] {
+				seen[t.String()] = true
+				tiles = append(tiles, t)
+			}
+		}
+		if len(tiles) > tilesPerZoom {
+			return nil
+		}
+	}
+	return tiles
+}
+
+// layerSources returns the imageSources of the mosaic's layers.
+func layerSources(c appengine.Context, o *Overlay) ([]imageSource, error) {
+	srcs := make([]imageSource, len(o.layers))
+	for i, l := range o.layers {
+		if l == nil {
+			return nil, fmt.Errorf("layer %s has been deleted", o.Layers[i].Encode())
+		}
+		var err error
+		if srcs[i], err = overlaySource(c, l); err != nil {
+			return nil, err
+		}
+	}
+	return srcs, nil
+}
+
+// sliceMosaic draws the specified tile of a mosaic from the given sources of
+// its layers, as slice does for other Overlays.
+func sliceMosaic(tile *Tile, o *Overlay, srcs []imageSource) error {
+	m, err := mosaicTile(tile, o, 1, srcs)
+	if err != nil {
+		return err
+	}
+	o.applyTransparency(m)
+	if err := encodeTile(tile, m); err != nil {
+		return err
+	}
+	if !o.Retina {
+		return nil
+	}
+	if m, err = mosaicTile(tile, o, 2, srcs); err != nil {
+		return err
+	}
+	o.applyTransparency(m)
+	tile.Retina, err = encodePNG(m)
+	return err
+}
+
+// mosaicTile draws the specified tile of a mosaic at the specified scale by
+// compositing, from the bottom up, the layers that cover it. If the mosaic
+// has feathered seams, each layer but the bottom one fades in from its edges
+// over the width of the seam. Each layer is first made as transparent as it
+// specifies.
+func mosaicTile(tile *Tile, o *Overlay, scale int, srcs []imageSource) (*image.RGBA, error) {
+	render := tileRenderer(o)
+	size := o.tileSize()
+	dst := image.NewRGBA(image.Rect(0, 0, size*scale, size*scale))
+	for i, l := range o.layers {
+		if !o.layerTiling(l).covers(tile) {
+			continue
+		}
+		var a graphics.Affine
+		copy(a[:], l.Transform)
+		m, err := render(a, tile, size, scale, srcs[i])
+		if err != nil {
+			return nil, err
+		}
+		l.applyTransparency(m)
+		var mask image.Image
+		if o.Feather > 0 && i > 0 {
+			fm := featherMask{l.Width, l.Height, float64(o.Feather)}
+			if mask, err = render(a, tile, size, scale, singleImage{fm}); err != nil {
+				return nil, err
+			}
+		}
+		draw.DrawMask(dst, dst.Rect, m, image.ZP, mask, image.ZP, draw.Over)
+	}
+	return dst, nil
+}
+
+// A featherMask is an image of the specified size whose alpha rises linearly
+// from zero at its edges to opaque at f pixels from them. It is computed as
+// it is read, so it takes no memory whatever its size.
+type featherMask struct {
+	w, h int
+	f    float64
+}
+
+func (m featherMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m featherMask) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.w, m.h)
+}
+
+func (m featherMask) At(x, y int) color.Color {
+	d := min(float64(x)+0.5, float64(m.w-x)-0.5, float64(y)+0.5, float64(m.h-y)-0.5)
+	if d >= m.f {
+		return color.Alpha{0xff}
+	}
+	if d <= 0 {
+		return color.Alpha{}
+	}
+	return color.Alpha{uint8(0xff * d / m.f)}
+}
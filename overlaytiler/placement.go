@@ -0,0 +1,145 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"math"
+)
+
+// Limits on the placement of an Overlay.
+const (
+	worldSize     = 256             // width and height of the world, in world units
+	minSide       = 1.0 / (1 << 17) // shortest side, in world units (16 pixels at zoom 21)
+	minSine       = 0.05            // sine of the smallest angle between sides (about 3°)
+	maxDistortion = 10              // limit on the stretching of the image along one side
+	maxNativeZoom = 30              // zoom level at which image pixels are tile-sized
+)
+
+// A placementError reports a problem with an Overlay's corners, naming the
+// processHandler parameter that is at fault.
+type placementError struct {
+	Param string
+	Err   string
+}
+
+func (e *placementError) Error() string {
+	return fmt.Sprintf("invalid parameter %s: %s", e.Param, e.Err)
+}
+
+func placementErrorf(param, format string, v ...interface{}) error {
+	return &placementError{param, fmt.Sprintf(format, v...)}
+}
+
+// checkPlacement checks that the corners of an Overlay describe a
+// parallelogram no wider than the world, and within it but for crossing the
+// antimeridian, onto which its image can be drawn: one with
+// sides neither too short nor almost parallel, that does not mirror the
+// image, and that neither stretches it too much in one direction nor makes
+// its pixels implausibly small.
+func checkPlacement(o *Overlay) error {
+	corners := []struct {
+		param string
+		p     []float64
+	}{
+		{"topLeft", o.TopLeft},
+		{"topRight", o.TopRight},
+		{"bottomRight", o.BottomRight},
+	}
+	for _, c := range corners {
+		if len(c.p) != 2 {
+			return placementErrorf(c.param, "point needs to be two numbers")
+		}
+		x, y := c.p[0], c.p[1]
+		if math.IsNaN(x) || math.IsInf(x, 0) || math.IsNaN(y) || math.IsInf(y, 0) {
+			return placementErrorf(c.param, "coordinates must be finite")
+		}
+		if x < -worldSize || x > 2*worldSize || y < 0 || y > worldSize {
+			return placementErrorf(c.param, "point (%g, %g) is outside the world (0 to %d)", x, y, worldSize)
+		}
+	}
+	bl := o.BottomLeft()
+	if bl[1] < 0 || bl[1] > worldSize {
+		return placementErrorf("bottomRight", "implied bottom-left corner (%g, %g) is outside the world", bl[0], bl[1])
+	}
+	xs := []float64{o.TopLeft[0], o.TopRight[0], o.BottomRight[0], bl[0]}
+	if w := max(xs...) - min(xs...); w > worldSize {
+		return placementErrorf("bottomRight", "overlay is %g world units wide, wider than the world", w)
+	}
+
+	// The top side runs from topLeft to topRight, and the right side from
+	// topRight to bottomRight.
+	tx, ty := o.TopRight[0]-o.TopLeft[0], o.TopRight[1]-o.TopLeft[1]
+	rx, ry := o.BottomRight[0]-o.TopRight[0], o.BottomRight[1]-o.TopRight[1]
+	top, right := math.Hypot(tx, ty), math.Hypot(rx, ry)
+	if top < minSide {
+		return placementErrorf("topRight", "top side is %g world units long; the minimum is %g", top, minSide)
+	}
+	if right < minSide {
+		return placementErrorf("bottomRight", "right side is %g world units long; the minimum is %g", right, minSide)
+	}
+
+	// In world coordinates y grows southward, so the corners of an image
+	// that is not mirrored run clockwise and det is positive.
+	det := tx*ry - ty*rx
+	if math.Abs(det) < minSine*top*right {
+		return placementErrorf("bottomRight", "corners are almost collinear")
+	}
+	if det < 0 {
+		return placementErrorf("bottomRight", "corners are mirrored; topLeft, topRight and bottomRight must run clockwise")
+	}
+
+	// Web Mercator preserves shapes locally, so the sides should have about
+	// the same proportions as the image.
+	stretch := (top / right) / (float64(o.Width) / float64(o.Height))
+	if stretch > maxDistortion || stretch < 1.0/maxDistortion {
+		return placementErrorf("bottomRight", "placement stretches the %dx%d image by a factor of %.3g", o.Width, o.Height, math.Max(stretch, 1/stretch))
+	}
+	if zoom := math.Log2(float64(o.Width) / top); zoom > maxNativeZoom {
+		return placementErrorf("topRight", "placement is too small for a %dx%d image", o.Width, o.Height)
+	}
+	return nil
+}
+
+// placeOverlay checks the corners of an Overlay, as checkPlacement does. An
+// Overlay that crosses the antimeridian may be given with its corners on
+// either side of it, wrapped into the world; if the corners are not valid as
+// given, they are unwrapped so that each is less than half the world away
+// from the one before, and checked again. The corners of a valid Overlay are
+// shifted by whole world widths so that its top-left corner is in the world;
+// the others may then lie east or west of it.
+func placeOverlay(o *Overlay) error {
+	err := checkPlacement(o)
+	if err != nil {
+		moved := unwrap(o.TopLeft, o.TopRight)
+		if !unwrap(o.TopRight, o.BottomRight) && !moved {
+			return err
+		}
+		if checkPlacement(o) != nil {
+			return err
+		}
+	}
+	shift := math.Floor(o.TopLeft[0]/worldSize) * worldSize
+	for _, p := range [][]float64{o.TopLeft, o.TopRight, o.BottomRight} {
+		p[0] -= shift
+	}
+	return nil
+}
+
+// unwrap shifts p by a world width east or west if that brings it closer to
+// the point prev, reporting whether it did. Points that are less than half
+// the world apart are not moved.
+func unwrap(prev, p []float64) bool {
+	if len(prev) != 2 || len(p) != 2 {
+		return false
+	}
+	switch d := p[0] - prev[0]; {
+	case d > worldSize/2:
+		p[0] -= worldSize
+	case d < -worldSize/2:
+		p[0] += worldSize
+	default:
+		return false
+	}
+	return true
+}
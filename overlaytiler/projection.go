@@ -0,0 +1,190 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import "math"
+
+// A projection converts between longitude and latitude on WGS 84, in degrees,
+// and the coordinates of a projected coordinate reference system. Projections
+// that use another datum include the datum shift, so their accuracy is
+// limited to that of the shift: a few meters.
+type projection struct {
+	forward func(lng, lat float64) (x, y float64)
+	inverse func(x, y float64) (lng, lat float64)
+}
+
+// projections holds the supported projected coordinate reference systems
+// other than Web Mercator, by EPSG code.
+var projections = map[int]*projection{
+	27700: {osgbForward, osgbInverse},
+	2056:  {lv95Forward, lv95Inverse},
+}
+
+const degree = math.Pi / 180
+
+// An ellipsoid is described by its semi-major and semi-minor axes in meters.
+type ellipsoid struct {
+	a, b float64
+}
+
+var (
+	wgs84 = ellipsoid{6378137, 6356752.314245}
+	airy  = ellipsoid{6377563.396, 6356256.909}
+)
+
+func (e ellipsoid) e2() float64 {
+	return (e.a*e.a - e.b*e.b) / (e.a * e.a)
+}
+
+// toCartesian converts geodetic coordinates in radians, at height zero, to
+// earth-centered cartesian coordinates on the ellipsoid.
+func (e ellipsoid) toCartesian(lng, lat float64) (x, y, z float64) {
+	nu := e.a / math.Sqrt(1-e.e2()*math.Sin(lat)*math.Sin(lat))
+	x = nu * math.Cos(lat) * math.Cos(lng)
+	y = nu * math.Cos(lat) * math.Sin(lng)
+	z = (1 - e.e2()) * nu * math.Sin(lat)
+	return
+}
+
+// fromCartesian converts earth-centered cartesian coordinates to geodetic
+// coordinates in radians on the ellipsoid.
+func (e ellipsoid) fromCartesian(x, y, z float64) (lng, lat float64) {
+	p := math.Hypot(x, y)
+	lat = math.Atan2(z, p*(1-e.e2()))
+	for i := 0; i < 10; i++ {
+		nu := e.a / math.Sqrt(1-e.e2()*math.Sin(lat)*math.Sin(lat))
+		lat = math.Atan2(z+e.e2()*nu*math.Sin(lat), p)
+	}
+	return math.Atan2(y, x), lat
+}
+
+// A helmert transformation shifts cartesian coordinates from one datum to
+// another: a translation in meters, a scale in parts per million and small
+// rotations in arc seconds.
+type helmert struct {
+	tx, ty, tz, s, rx, ry, rz float64
+}
+
+// wgs84ToOSGB36 is the Ordnance Survey's transformation from WGS 84 to OSGB36.
+var wgs84ToOSGB36 = helmert{-446.448, 125.157, -542.060, 20.4894, -0.1502, -0.2470, -0.8421}
+
+func (h helmert) apply(x, y, z float64) (float64, float64, float64) {
+	s := 1 + h.s*1e-6
+	sec := degree / 3600
+	rx, ry, rz := h.rx*sec, h.ry*sec, h.rz*sec
+	return h.tx + s*x - rz*y + ry*z,
+		h.ty + rz*x + s*y - rx*z,
+		h.tz - ry*x + rx*y + s*z
+}
+
+// inverse returns the approximate inverse of h, which is accurate to
+// millimeters for rotations as small as those between geodetic datums.
+func (h helmert) inverse() helmert {
+	return helmert{-h.tx, -h.ty, -h.tz, -h.s, -h.rx, -h.ry, -h.rz}
+}
+
+// shift converts longitude and latitude in degrees from the datum of the
+// ellipsoid from to that of the ellipsoid to, using h.
+func shift(from, to ellipsoid, h helmert, lng, lat float64) (float64, float64) {
+	x, y, z := from.toCartesian(lng*degree, lat*degree)
+	lng, lat = to.fromCartesian(h.apply(x, y, z))
+	return lng / degree, lat / degree
+}
+
+// The British National Grid is a transverse Mercator projection of the Airy
+// 1830 ellipsoid, as described in the Ordnance Survey's "A guide to
+// coordinate systems in Great Britain".
+const (
+	osgbF0   = 0.9996012717 // scale factor on the central meridian
+	osgbLat0 = 49 * degree  // true origin
+	osgbLng0 = -2 * degree
+	osgbE0   = 400000 // false origin
+	osgbN0   = -100000
+)
+
+// osgbArc returns the meridional arc from the true origin to latitude lat.
+func osgbArc(lat float64) float64 {
+	a, b := airy.a, airy.b
+	n := (a - b) / (a + b)
+	d, s := lat-osgbLat0, lat+osgbLat0
+	return b * osgbF0 * ((1+n+5.0/4*n*n+5.0/4*n*n*n)*d -
+		(3*n+3*n*n+21.0/8*n*n*n)*math.Sin(d)*math.Cos(s) +
+		(15.0/8*n*n+15.0/8*n*n*n)*math.Sin(2*d)*math.Cos(2*s) -
+		35.0/24*n*n*n*math.Sin(3*d)*math.Cos(3*s))
+}
+
+func osgbForward(lng, lat float64) (x, y float64) {
+	lng, lat = shift(wgs84, airy, wgs84ToOSGB36, lng, lat)
+	phi, lambda := lat*degree, lng*degree
+	a, e2 := airy.a, airy.e2()
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	nu := a * osgbF0 / math.Sqrt(1-e2*sin*sin)
+	rho := a * osgbF0 * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	eta2 := nu/rho - 1
+
+	m := osgbArc(phi)
+	i := m + osgbN0
+	ii := nu / 2 * sin * cos
+	iii := nu / 24 * sin * math.Pow(cos, 3) * (5 - tan*tan + 9*eta2)
+	iiia := nu / 720 * sin * math.Pow(cos, 5) * (61 - 58*tan*tan + math.Pow(tan, 4))
+	iv := nu * cos
+	v := nu / 6 * math.Pow(cos, 3) * (nu/rho - tan*tan)
+	vi := nu / 120 * math.Pow(cos, 5) * (5 - 18*tan*tan + math.Pow(tan, 4) + 14*eta2 - 58*tan*tan*eta2)
+
+	d := lambda - osgbLng0
+	y = i + ii*d*d + iii*math.Pow(d, 4) + iiia*math.Pow(d, 6)
+	x = osgbE0 + iv*d + v*math.Pow(d, 3) + vi*math.Pow(d, 5)
+	return
+}
+
+func osgbInverse(x, y float64) (lng, lat float64) {
+	a, e2 := airy.a, airy.e2()
+	phi := osgbLat0
+	for i := 0; i < 20; i++ {
+		phi += (y - osgbN0 - osgbArc(phi)) / (a * osgbF0)
+		if math.Abs(y-osgbN0-osgbArc(phi)) < 1e-5 {
+			break
+		}
+	}
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	nu := a * osgbF0 / math.Sqrt(1-e2*sin*sin)
+	rho := a * osgbF0 * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	eta2 := nu/rho - 1
+	sec := 1 / cos
+
+	vii := tan / (2 * rho * nu)
+	viii := tan / (24 * rho * math.Pow(nu, 3)) * (5 + 3*tan*tan + eta2 - 9*tan*tan*eta2)
+	ix := tan / (720 * rho * math.Pow(nu, 5)) * (61 + 90*tan*tan + 45*math.Pow(tan, 4))
+	x1 := sec / nu
+	xi := sec / (6 * math.Pow(nu, 3)) * (nu/rho + 2*tan*tan)
+	xii := sec / (120 * math.Pow(nu, 5)) * (5 + 28*tan*tan + 24*math.Pow(tan, 4))
+	xiia := sec / (5040 * math.Pow(nu, 7)) * (61 + 662*tan*tan + 1320*math.Pow(tan, 4) + 720*math.Pow(tan, 6))
+
+	d := x - osgbE0
+	phi = phi - vii*d*d + viii*math.Pow(d, 4) - ix*math.Pow(d, 6)
+	lambda := osgbLng0 + x1*d - xi*math.Pow(d, 3) + xii*math.Pow(d, 5) - xiia*math.Pow(d, 7)
+	return shift(airy, wgs84, wgs84ToOSGB36.inverse(), lambda/degree, phi/degree)
+}
+
+// The Swiss LV95 grid (CH1903+) is converted to and from WGS 84 using the
+// approximate formulas published by swisstopo, which are accurate to about a
+// meter within Switzerland.
+
+func lv95Forward(lng, lat float64) (x, y float64) {
+	// Auxiliary values in units of 10000 arc seconds.
+	p := (lat*3600 - 169028.66) / 10000
+	l := (lng*3600 - 26782.5) / 10000
+	x = 2600072.37 + 211455.93*l - 10938.51*l*p - 0.36*l*p*p - 44.54*l*l*l
+	y = 1200147.07 + 308807.95*p + 3745.25*l*l + 76.63*p*p - 194.56*l*l*p + 119.79*p*p*p
+	return
+}
+
+func lv95Inverse(x, y float64) (lng, lat float64) {
+	// Auxiliary values in units of 1000 km.
+	e := (x - 2600000) / 1000000
+	n := (y - 1200000) / 1000000
+	l := 2.6779094 + 4.728982*e + 0.791484*e*n + 0.1306*e*n*n - 0.0436*e*e*e
+	p := 16.9023892 + 3.238272*n - 0.270978*e*e - 0.002528*n*n - 0.0447*e*e*n - 0.0140*n*n*n
+	// l and p are in units of 10000 arc seconds.
+	return l * 100 / 36, p * 100 / 36
+}
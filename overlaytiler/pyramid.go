@@ -0,0 +1,224 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// In pyramid mode only the tiles of the base (highest) zoom level are rendered
+// from the source image. Every other tile is built by compositing its four
+// children and downsampling the result by a factor of two. A parent's tile
+// task is added to the tileQueue once all of its children have been stored.
+
+// pyramidBase returns the highest zoom level between the Overlay's MinZoom and
+// MaxZoom for which tiles are generated.
+func pyramidBase(o *Overlay) int64 {
+	for zoom := o.MaxZoom; zoom > o.MinZoom; zoom-- {
+		if len(tilesForZoom(o, zoom)) > 0 {
+			return zoom
+		}
+	}
+	return o.MinZoom
+}
+
+// parent returns the tile at the next lower zoom level that contains t.
+func (t *Tile) parent() *Tile {
+	return &Tile{X: t.X / 2, Y: t.Y / 2, Zoom: t.Zoom - 1}
+}
+
+// children returns the four tiles at the next higher zoom level that t
+// contains, in the order top-left, top-right, bottom-left, bottom-right.
+func (t *Tile) children() []*Tile {
+	var tiles []*Tile
+	for dy := int64(0); dy < 2; dy++ {
+		for dx := int64(0); dx < 2; dx++ {
+			tiles = append(tiles, &Tile{X: t.X*2 + dx, Y: t.Y*2 + dy, Zoom: t.Zoom + 1})
+		}
+	}
+	return tiles
+}
+
+// tileSet returns the set of tiles generated for the Overlay at the specified
+// zoom level, keyed by their String representation.
+func tileSet(o *Overlay, zoom int64) map[string]bool {
+	set := make(map[string]bool)
+	for _, t := range tilesForZoom(o, zoom) {
+		set[t.String()] = true
+	}
+	return set
+}
+
+// pyramidTile draws the specified tile from its stored children and stores the
+// result in the provided Tile's Image field, and its high-DPI variant in the
+// Retina field if the Overlay has them. Children that were not generated
+// (because they lie outside the Overlay) are left transparent.
+func pyramidTile(c appengine.Context, oKey *datastore.Key, o *Overlay, tile *Tile) error {
+	children := tile.children()
+	keys := make([]*datastore.Key, len(children))
+	for i, t := range children {
+		keys[i] = t.Key(c, oKey)
+	}
+	m, err := pyramidImage(c, keys, o.tileSize())
+	if err != nil {
+		return err
+	}
+	if err := encodeTile(tile, m); err != nil {
+		return err
+	}
+	if !o.Retina {
+		return nil
+	}
+	for i, t := range children {
+		keys[i] = t.RetinaKey(c, oKey)
+	}
+	if m, err = pyramidImage(c, keys, 2*o.tileSize()); err != nil {
+		return err
+	}
+	tile.Retina, err = encodePNG(m)
+	return err
+}
+
+// pyramidImage fetches the four child tiles with the specified keys, each
+// size pixels square, and returns an image of the same size drawn from them.
+func pyramidImage(c appengine.Context, keys []*datastore.Key, size int) (*image.RGBA, error) {
+	children := make([]*Tile, len(keys))
+	for i := range children {
+		children[i] = new(Tile)
+	}
+	err := datastore.GetMulti(c, keys, children)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+
+	// Composite the children into a single image of twice the tile size.
+	m := image.NewRGBA(image.Rect(0, 0, 2*size, 2*size))
+	for i, t := range children {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, merr[i]
+		}
+		cm, err := png.Decode(bytes.NewReader(t.Image))
+		if err != nil {
+			return nil, fmt.Errorf("decoding tile %v: %v", keys[i].StringID(), err)
+		}
+		p := image.Pt(i%2*size, i/2*size)
+		draw.Draw(m, image.Rectangle{p, p.Add(image.Pt(size, size))}, cm, image.ZP, draw.Src)
+	}
+	return downsample(m), nil
+}
+
+// downsample returns an image half the size of m, rounded up, each pixel of
+// which is the average of the corresponding 2x2 block of pixels of m.
+// Averaging alpha-premultiplied colors keeps transparent pixels from
+// darkening the edges of the Overlay.
+func downsample(m *image.RGBA) *image.RGBA {
+	b := m.Bounds()
+	d := image.NewRGBA(image.Rect(0, 0, (b.Dx()+1)/2, (b.Dy()+1)/2))
+	for y := 0; y < d.Rect.Dy(); y++ {
+		for x := 0; x < d.Rect.Dx(); x++ {
+			var sum [4]int
+			n := 0
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					p := image.Pt(b.Min.X+x*2+dx, b.Min.Y+y*2+dy)
+					if !p.In(b) {
+						continue
+					}
+					i := m.PixOffset(p.X, p.Y)
+					for k := range sum {
+						sum[k] += int(m.Pix[i+k])
+					}
+					n++
+				}
+			}
+			j := d.PixOffset(x, y)
+			for k, s := range sum {
+				d.Pix[j+k] = uint8((s + n/2) / n)
+			}
+		}
+	}
+	return d
+}
+
+// queueParents adds tasks to generate the parents of the provided tiles whose
+// children have all been stored. Tasks are named after the parent tile and
+// the time processing started, so that a parent is queued only once even if
+// several slicers store its last children at the same time.
+func queueParents(c appengine.Context, oKey *datastore.Key, o *Overlay, tiles []*Tile) error {
+	parents := make(map[string]*Tile)
+	for _, t := range tiles {
+		if t.Zoom <= o.MinZoom {
+			continue
+		}
+		p := t.parent()
+		parents[p.String()] = p
+	}
+
+	sets := make(map[int64]map[string]bool)
+	for _, p := range parents {
+		set, ok := sets[p.Zoom+1]
+		if !ok {
+			set = tileSet(o, p.Zoom+1)
+			sets[p.Zoom+1] = set
+		}
+		ready, err := childrenStored(c, oKey, p, set)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			continue
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		task := &taskqueue.Task{
+			Name:    fmt.Sprintf("%s-%d-%d-%d-%d", oKey.Encode(), o.Started.UnixNano(), p.Zoom, p.X, p.Y),
+			Method:  "PULL",
+			Tag:     oKey.Encode(),
+			Payload: b,
+		}
+		_, err = taskqueue.Add(c, task, tileQueue)
+		if err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+			return err
+		}
+	}
+	return nil
+}
+
+// childrenStored reports whether all children of the specified tile that are
+// members of set have been stored in the datastore.
+func childrenStored(c appengine.Context, oKey *datastore.Key, p *Tile, set map[string]bool) (bool, error) {
+	var keys []*datastore.Key
+	for _, t := range p.children() {
+		if set[t.String()] {
+			keys = append(keys, t.Key(c, oKey))
+		}
+	}
+	err := datastore.GetMulti(c, keys, make([]Tile, len(keys)))
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, err := range merr {
+			if err == datastore.ErrNoSuchEntity {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,424 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sync"
+
+	"appengine"
+	"appengine/blobstore"
+
+	"code.google.com/p/graphics-go/graphics"
+)
+
+// A raster is an Overlay image split into square blocks at several levels of
+// detail. Level 0 is the original image; each following level is half the
+// width and height of the one before, down to one no larger than rasterBlock
+// on either side. Blocks are rasterBlock pixels square, or smaller for wide
+// images, so that a band of a row of blocks fits in maxRasterBand bytes. The slicers read only the blocks that the tiles they render touch,
+// so the image never needs to be decoded in memory as a whole.
+//
+// A raster is stored in a single blob. The blocks come first, each holding
+// the zlib-compressed alpha-premultiplied RGBA pixels of its rows. They are
+// followed by an index and, in the last 8 bytes, the offset of the index:
+//
+//	"OTR1" width height blockSize levels    uint32 each
+//	offset length                           int64 each, for every block of
+//	                                        every level, in row-major order
+//	indexOffset                             int64
+
+const (
+	rasterBlock    = 1024     // largest block width and height in pixels
+	maxRasterBand  = 32 << 20 // limit on the bytes of a band of level 0 rows
+	rasterCache    = 32       // blocks held in memory by an open raster
+	rasterMagic    = "OTR1"
+	rasterSentinel = "RASTER_RUNNING"
+
+	maxRasterRetries = 5 // retries of a raster task before it gives up
+)
+
+// rasterSize returns the dimensions of each level of a raster of the
+// specified size.
+func rasterSize(width, height int) (levels []image.Point) {
+	for {
+		levels = append(levels, image.Pt(width, height))
+		if width <= rasterBlock && height <= rasterBlock {
+			return
+		}
+		width, height = (width+1)/2, (height+1)/2
+	}
+}
+
+// rasterBlockSize returns the block size of a raster of the specified width:
+// the largest power of two, up to rasterBlock, for which a band of a row of
+// blocks fits in maxRasterBand bytes. The bands of the other levels are at
+// most as large again in all.
+func rasterBlockSize(width int) int {
+	size := rasterBlock
+	for size > 1 && 4*width*size > maxRasterBand {
+		size /= 2
+	}
+	return size
+}
+
+// blocks returns the number of columns and rows of blocks of the specified
+// size in a level.
+func blocks(level image.Point, size int) (cols, rows int) {
+	return (level.X + size - 1) / size, (level.Y + size - 1) / size
+}
+
+type rasterEntry struct {
+	Offset, Length int64
+}
+
+// rasterWriter writes a raster to a stream, band by band.
+type rasterWriter struct {
+	w         io.Writer
+	off       int64
+	blockSize int // block width and height
+	levels    []*levelWriter
+}
+
+// levelWriter buffers a band of rows of a raster level until it holds enough
+// to write a row of blocks.
+type levelWriter struct {
+	size  image.Point
+	band  *image.RGBA
+	rows  int // rows held in band
+	y     int // level row of the first row in band
+	index []rasterEntry
+}
+
+// writeRaster reads an image from rr and writes it to w as a raster.
+func writeRaster(w io.Writer, rr rowReader) error {
+	width, height := rr.Size()
+	rw := &rasterWriter{w: w, blockSize: rasterBlockSize(width)}
+	for _, size := range rasterSize(width, height) {
+		cols, rows := blocks(size, rw.blockSize)
+		rw.levels = append(rw.levels, &levelWriter{
+			size:  size,
+			band:  image.NewRGBA(image.Rect(0, 0, size.X, rw.blockSize)),
+			index: make([]rasterEntry, 0, cols*rows),
+		})
+	}
+	l0 := rw.levels[0]
+	for l0.y < height {
+		n := rw.blockSize
+		if height-l0.y < n {
+			n = height - l0.y
+		}
+		if err := rr.Read(l0.band.SubImage(image.Rect(0, 0, width, n)).(*image.RGBA)); err != nil {
+			return err
+		}
+		l0.rows = n
+		if err := rw.flush(0); err != nil {
+			return err
+		}
+	}
+	return rw.writeIndex()
+}
+
+func (rw *rasterWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	rw.off += int64(n)
+	return n, err
+}
+
+// addRows appends the rows of m to the band of the specified level, writing
+// the band out when it is full or holds the last rows of the level.
+func (rw *rasterWriter) addRows(level int, m *image.RGBA) error {
+	lw := rw.levels[level]
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		i := m.PixOffset(m.Rect.Min.X, y)
+		copy(lw.band.Pix[lw.rows*lw.band.Stride:], m.Pix[i:i+4*lw.size.X])
+		lw.rows++
+		if lw.rows == rw.blockSize || lw.y+lw.rows == lw.size.Y {
+			if err := rw.flush(level); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush writes the blocks of the specified level's band, and passes the band
+// on to the next level at half its resolution.
+func (rw *rasterWriter) flush(level int) error {
+	lw := rw.levels[level]
+	band := lw.band.SubImage(image.Rect(0, 0, lw.size.X, lw.rows)).(*image.RGBA)
+	for x := 0; x < lw.size.X; x += rw.blockSize {
+		r := image.Rect(x, 0, x+rw.blockSize, lw.rows).Intersect(band.Rect)
+		e := rasterEntry{Offset: rw.off}
+		z, err := zlib.NewWriterLevel(rw, zlib.BestSpeed)
+		if err != nil {
+			return err
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i := band.PixOffset(r.Min.X, y)
+			if _, err := z.Write(band.Pix[i : i+4*r.Dx()]); err != nil {
+				return err
+			}
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		e.Length = rw.off - e.Offset
+		lw.index = append(lw.index, e)
+	}
+	lw.y += lw.rows
+	lw.rows = 0
+	if level+1 < len(rw.levels) {
+		return rw.addRows(level+1, downsample(band))
+	}
+	return nil
+}
+
+func (rw *rasterWriter) writeIndex() error {
+	off := rw.off
+	h := []int{rw.levels[0].size.X, rw.levels[0].size.Y, rw.blockSize, len(rw.levels)}
+	if _, err := io.WriteString(rw, rasterMagic); err != nil {
+		return err
+	}
+	for _, v := range h {
+		if err := binary.Write(rw, binary.BigEndian, uint32(v)); err != nil {
+			return err
+		}
+	}
+	for _, lw := range rw.levels {
+		if err := binary.Write(rw, binary.BigEndian, lw.index); err != nil {
+			return err
+		}
+	}
+	return binary.Write(rw, binary.BigEndian, off)
+}
+
+// raster reads the blocks of a stored raster, keeping the most recently used
+// ones in memory. It is safe for concurrent use.
+type raster struct {
+	r         io.ReaderAt
+	blockSize int           // block width and height
+	sizes     []image.Point // dimensions of each level
+	index     [][]rasterEntry
+
+	mu      sync.Mutex
+	cache   map[rasterBlockID]*list.Element
+	lru     *list.List // of *rasterBlockData, most recently used first
+	readErr error      // first error encountered reading a block
+}
+
+type rasterBlockID struct {
+	level, col, row int
+}
+
+type rasterBlockData struct {
+	id rasterBlockID
+	m  *image.RGBA
+}
+
+// openRaster opens the raster stored in the specified blob.
+func openRaster(c appengine.Context, k appengine.BlobKey) (*raster, error) {
+	info, err := blobstore.Stat(c, k)
+	if err != nil {
+		return nil, err
+	}
+	return readRaster(blobstore.NewReader(c, k), info.Size)
+}
+
+// readRaster reads the index of a raster of the specified size from r.
+func readRaster(r io.ReaderAt, size int64) (*raster, error) {
+	var b [8]byte
+	if n, err := r.ReadAt(b[:], size-8); n < len(b) {
+		return nil, err
+	}
+	off := int64(binary.BigEndian.Uint64(b[:]))
+	if off < 0 || off > size-8 {
+		return nil, errors.New("raster: bad index offset")
+	}
+	ib := make([]byte, size-8-off)
+	if n, err := r.ReadAt(ib, off); n < len(ib) {
+		return nil, err
+	}
+	ir := bytes.NewReader(ib)
+	var h struct {
+		Magic                        [4]byte
+		Width, Height, Block, Levels uint32
+	}
+	if err := binary.Read(ir, binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != rasterMagic || h.Block != uint32(rasterBlockSize(int(h.Width))) {
+		return nil, errors.New("raster: bad index header")
+	}
+	levels := rasterSize(int(h.Width), int(h.Height))
+	if len(levels) != int(h.Levels) {
+		return nil, errors.New("raster: bad level count")
+	}
+	index := make([][]rasterEntry, len(levels))
+	for i, size := range levels {
+		cols, rows := blocks(size, int(h.Block))
+		index[i] = make([]rasterEntry, cols*rows)
+		if err := binary.Read(ir, binary.BigEndian, index[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &raster{
+		r:         r,
+		blockSize: int(h.Block),
+		sizes:     levels,
+		index:     index,
+		cache:     make(map[rasterBlockID]*list.Element),
+		lru:       list.New(),
+	}, nil
+}
+
+// block returns the specified block, reading it if it is not in the cache.
+func (r *raster) block(id rasterBlockID) (*image.RGBA, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cache[id]; ok {
+		r.lru.MoveToFront(e)
+		return e.Value.(*rasterBlockData).m, nil
+	}
+
+	size := r.sizes[id.level]
+	cols, _ := blocks(size, r.blockSize)
+	e := r.index[id.level][id.row*cols+id.col]
+	bs := r.blockSize
+	rect := image.Rect(id.col*bs, id.row*bs, (id.col+1)*bs, (id.row+1)*bs)
+	m := image.NewRGBA(rect.Intersect(image.Rectangle{Max: size}))
+	z, err := zlib.NewReader(io.NewSectionReader(r.r, e.Offset, e.Length))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(z, m.Pix); err != nil {
+		return nil, fmt.Errorf("raster: reading block %v: %v", id, err)
+	}
+
+	r.cache[id] = r.lru.PushFront(&rasterBlockData{id, m})
+	if r.lru.Len() > rasterCache {
+		old := r.lru.Remove(r.lru.Back()).(*rasterBlockData)
+		delete(r.cache, old.id)
+	}
+	return m, nil
+}
+
+// setErr records the first error encountered while reading blocks.
+func (r *raster) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readErr == nil {
+		r.readErr = err
+	}
+}
+
+// An imageSource provides an Overlay's image at one or more levels of detail.
+// Level n is 2^n times smaller than the original image in each dimension.
+type imageSource interface {
+	levels() int
+	level(n int) image.Image
+	// err returns the first error encountered reading the image.
+	err() error
+}
+
+func (r *raster) levels() int {
+	return len(r.sizes)
+}
+
+func (r *raster) level(n int) image.Image {
+	return &rasterImage{r: r, level: n}
+}
+
+func (r *raster) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readErr
+}
+
+// rasterImage is an image.Image that reads the pixels of a raster level from
+// its blocks as they are needed.
+type rasterImage struct {
+	r     *raster
+	level int
+}
+
+func (m *rasterImage) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (m *rasterImage) Bounds() image.Rectangle {
+	return image.Rectangle{Max: m.r.sizes[m.level]}
+}
+
+func (m *rasterImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}).In(m.Bounds()) {
+		return color.RGBA{}
+	}
+	b, err := m.r.block(rasterBlockID{m.level, x / m.r.blockSize, y / m.r.blockSize})
+	if err != nil {
+		m.r.setErr(err)
+		return color.RGBA{}
+	}
+	return b.At(x, y)
+}
+
+// singleImage is an imageSource that holds a decoded image in memory.
+type singleImage struct {
+	m image.Image
+}
+
+func (s singleImage) levels() int           { return 1 }
+func (s singleImage) level(int) image.Image { return s.m }
+func (s singleImage) err() error            { return nil }
+
+// overlaySource returns the imageSource for an Overlay's image, adjusted and
+// clipped as the Overlay specifies. Overlays uploaded before rasters were introduced
+// have their image decoded in full.
+func overlaySource(c appengine.Context, o *Overlay) (imageSource, error) {
+	var src imageSource
+	switch o.Raster {
+	case "":
+		if o.RasterError != "" {
+			return nil, errors.New("overlay image could not be split: " + o.RasterError)
+		}
+		m, err := imageBlob(c, o.Image)
+		if err != nil {
+			return nil, err
+		}
+		src = singleImage{m}
+	case rasterSentinel:
+		return nil, errors.New("overlay image has not been split into blocks yet")
+	default:
+		var err error
+		if src, err = openRaster(c, o.Raster); err != nil {
+			return nil, err
+		}
+	}
+	return clipSource(c, o, adjustSource(o, src))
+}
+
+// sourceLevel returns the lowest-resolution level of detail that still has at
+// least one pixel for each destination pixel of a, which maps destination
+// pixels to source pixels at level 0.
+func sourceLevel(a graphics.Affine, levels int) int {
+	// Source pixels per destination pixel, along each destination axis.
+	sx := math.Hypot(a[0], a[3])
+	sy := math.Hypot(a[1], a[4])
+	n := int(math.Floor(math.Log2(math.Min(sx, sy))))
+	if n >= levels {
+		n = levels - 1
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
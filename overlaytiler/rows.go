@@ -0,0 +1,467 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+
+	"appengine"
+	"appengine/blobstore"
+
+	"geotiff"
+)
+
+// A rowReader reads an image from top to bottom, a band of rows at a time.
+type rowReader interface {
+	// Size returns the dimensions of the image.
+	Size() (width, height int)
+	// Read draws the next dst.Bounds().Dy() rows of the image into dst,
+	// whose width must be that of the image.
+	Read(dst *image.RGBA) error
+}
+
+// newRowReader returns a rowReader for the image stored in the specified
+// blob. TIFF and non-interlaced PNG images are decoded as they are read;
+// other images are decoded in full first.
+func newRowReader(c appengine.Context, k appengine.BlobKey) (rowReader, error) {
+	rr, err := newPNGRows(blobstore.NewReader(c, k))
+	if err == nil {
+		return rr, nil
+	}
+	if err != errNotPNG && err != errInterlaced {
+		return nil, err
+	}
+	d, err := geotiff.NewReader(blobstore.NewReader(c, k))
+	if err == nil {
+		return &tiffRows{d: d}, nil
+	}
+	if err != image.ErrFormat {
+		return nil, err
+	}
+	m, err := imageBlob(c, k)
+	if err != nil {
+		return nil, err
+	}
+	return &imageRows{m: m}, nil
+}
+
+// imageRows is a rowReader for an image that is held in memory.
+type imageRows struct {
+	m image.Image
+	y int // next row to read, relative to the image bounds
+}
+
+func (r *imageRows) Size() (int, int) {
+	b := r.m.Bounds()
+	return b.Dx(), b.Dy()
+}
+
+func (r *imageRows) Read(dst *image.RGBA) error {
+	b := r.m.Bounds()
+	if r.y+dst.Rect.Dy() > b.Dy() {
+		return io.ErrUnexpectedEOF
+	}
+	draw.Draw(dst, dst.Rect, r.m, image.Pt(b.Min.X, b.Min.Y+r.y), draw.Src)
+	r.y += dst.Rect.Dy()
+	return nil
+}
+
+// tiffRows is a rowReader for a TIFF image.
+type tiffRows struct {
+	d *geotiff.Reader
+	y int // next row to read
+}
+
+func (r *tiffRows) Size() (int, int) {
+	return r.d.Size()
+}
+
+func (r *tiffRows) Read(dst *image.RGBA) error {
+	if err := r.d.Read(dst, r.y); err != nil {
+		return err
+	}
+	r.y += dst.Rect.Dy()
+	return nil
+}
+
+var (
+	errNotPNG     = errors.New("not a PNG image")
+	errInterlaced = errors.New("interlaced PNG images cannot be read by row")
+)
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// PNG color types.
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// pngRows is a rowReader that decodes a non-interlaced PNG image one row at a
+// time, so that the whole image need never be held in memory.
+type pngRows struct {
+	width, height int
+	depth         int // bits per sample
+	ctype         int // color type
+
+	palette [256][4]uint16 // non-premultiplied RGBA, for pngPaletted
+	key     []uint16       // transparent color from tRNS, for pngGray and pngRGB
+
+	z         io.Reader
+	cur, prev []byte // current and previous row, including the filter byte
+	bpp       int    // bytes per complete pixel, rounded up to one
+}
+
+// newPNGRows reads the PNG header chunks from r, up to the first IDAT chunk.
+// It returns errNotPNG if r does not hold a PNG image, and errInterlaced if
+// the image is interlaced.
+func newPNGRows(r io.Reader) (*pngRows, error) {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(pngHeader))
+	if _, err := io.ReadFull(br, sig); err != nil || string(sig) != pngHeader {
+		return nil, errNotPNG
+	}
+	p := new(pngRows)
+	for i := 0; ; i++ {
+		typ, data, err := readChunkHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && typ != "IHDR" {
+			return nil, errors.New("png: missing IHDR chunk")
+		}
+		if typ == "IDAT" {
+			d := &idatReader{r: br, n: data, crc: crc32.NewIEEE()}
+			d.crc.Write([]byte(typ))
+			z, err := zlib.NewReader(d)
+			if err != nil {
+				return nil, err
+			}
+			p.z = z
+			break
+		}
+		b, err := readChunk(br, typ, data)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "IHDR":
+			err = p.parseIHDR(b)
+		case "PLTE":
+			err = p.parsePLTE(b)
+		case "tRNS":
+			err = p.parseTRNS(b)
+		case "IEND":
+			err = errors.New("png: no image data")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	bits := p.depth * pngSamples(p.ctype)
+	p.bpp = (bits + 7) / 8
+	rowBytes := (bits*p.width + 7) / 8
+	p.cur = make([]byte, 1+rowBytes)
+	p.prev = make([]byte, 1+rowBytes)
+	return p, nil
+}
+
+// readChunkHeader reads the length and type of the next chunk.
+func readChunkHeader(r io.Reader) (typ string, length uint32, err error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return "", 0, err
+	}
+	return string(h[4:]), binary.BigEndian.Uint32(h[:4]), nil
+}
+
+// maxChunk is the size limit for chunks other than IDAT, which are read
+// into memory in one piece.
+const maxChunk = 1 << 20
+
+// readChunk reads the data and CRC of a chunk whose header has been read.
+func readChunk(r io.Reader, typ string, length uint32) ([]byte, error) {
+	if length > maxChunk {
+		return nil, fmt.Errorf("png: %s chunk too large", typ)
+	}
+	b := make([]byte, length+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(b[:length])
+	if crc.Sum32() != binary.BigEndian.Uint32(b[length:]) {
+		return nil, fmt.Errorf("png: invalid checksum in %s chunk", typ)
+	}
+	return b[:length], nil
+}
+
+// pngSamples returns the number of samples per pixel of a color type.
+func pngSamples(ctype int) int {
+	switch ctype {
+	case pngRGB:
+		return 3
+	case pngGrayAlpha:
+		return 2
+	case pngRGBA:
+		return 4
+	}
+	return 1
+}
+
+func (p *pngRows) parseIHDR(b []byte) error {
+	if len(b) != 13 {
+		return errors.New("png: bad IHDR length")
+	}
+	p.width = int(binary.BigEndian.Uint32(b[0:4]))
+	p.height = int(binary.BigEndian.Uint32(b[4:8]))
+	p.depth = int(b[8])
+	p.ctype = int(b[9])
+	if p.width <= 0 || p.height <= 0 {
+		return errors.New("png: invalid dimensions")
+	}
+	if b[10] != 0 || b[11] != 0 {
+		return errors.New("png: unsupported compression or filter method")
+	}
+	if b[12] != 0 {
+		return errInterlaced
+	}
+	ok := false
+	switch p.ctype {
+	case pngGray:
+		ok = p.depth == 1 || p.depth == 2 || p.depth == 4 || p.depth == 8 || p.depth == 16
+	case pngPaletted:
+		ok = p.depth == 1 || p.depth == 2 || p.depth == 4 || p.depth == 8
+	case pngRGB, pngGrayAlpha, pngRGBA:
+		ok = p.depth == 8 || p.depth == 16
+	}
+	if !ok {
+		return fmt.Errorf("png: unsupported color type %d at bit depth %d", p.ctype, p.depth)
+	}
+	return nil
+}
+
+func (p *pngRows) parsePLTE(b []byte) error {
+	if len(b)%3 != 0 || len(b) > 256*3 {
+		return errors.New("png: bad PLTE length")
+	}
+	for i := 0; i < len(b)/3; i++ {
+		p.palette[i] = [4]uint16{
+			uint16(b[i*3]) * 0x101,
+			uint16(b[i*3+1]) * 0x101,
+			uint16(b[i*3+2]) * 0x101,
+			0xffff,
+		}
+	}
+	return nil
+}
+
+func (p *pngRows) parseTRNS(b []byte) error {
+	switch p.ctype {
+	case pngPaletted:
+		if len(b) > 256 {
+			return errors.New("png: bad tRNS length")
+		}
+		for i, a := range b {
+			p.palette[i][3] = uint16(a) * 0x101
+		}
+	case pngGray, pngRGB:
+		if len(b) != 2*pngSamples(p.ctype) {
+			return errors.New("png: bad tRNS length")
+		}
+		for i := 0; i < len(b); i += 2 {
+			p.key = append(p.key, binary.BigEndian.Uint16(b[i:]))
+		}
+	}
+	return nil
+}
+
+func (p *pngRows) Size() (int, int) {
+	return p.width, p.height
+}
+
+func (p *pngRows) Read(dst *image.RGBA) error {
+	for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+		if err := p.readRow(); err != nil {
+			return err
+		}
+		i := dst.PixOffset(dst.Rect.Min.X, y)
+		p.convertRow(dst.Pix[i : i+4*p.width])
+	}
+	return nil
+}
+
+// readRow reads and unfilters the next row into p.cur.
+func (p *pngRows) readRow() error {
+	p.cur, p.prev = p.prev, p.cur
+	if _, err := io.ReadFull(p.z, p.cur); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	cdat, pdat := p.cur[1:], p.prev[1:]
+	bpp := p.bpp
+	switch p.cur[0] {
+	case 0: // None
+	case 1: // Sub
+		for i := bpp; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bpp]
+		}
+	case 2: // Up
+		for i := range cdat {
+			cdat[i] += pdat[i]
+		}
+	case 3: // Average
+		for i := 0; i < bpp && i < len(cdat); i++ {
+			cdat[i] += pdat[i] / 2
+		}
+		for i := bpp; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-bpp]) + int(pdat[i])) / 2)
+		}
+	case 4: // Paeth
+		for i := range cdat {
+			var a, c uint8
+			if i >= bpp {
+				a, c = cdat[i-bpp], pdat[i-bpp]
+			}
+			cdat[i] += paeth(a, pdat[i], c)
+		}
+	default:
+		return errors.New("png: bad filter type")
+	}
+	return nil
+}
+
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// sample returns the nth sample of the current row, as read from the image.
+func (p *pngRows) sample(n int) uint16 {
+	b := p.cur[1:]
+	switch p.depth {
+	case 16:
+		return binary.BigEndian.Uint16(b[n*2:])
+	case 8:
+		return uint16(b[n])
+	}
+	bit := n * p.depth
+	shift := uint(8 - p.depth - bit%8)
+	return uint16(b[bit/8]>>shift) & (1<<uint(p.depth) - 1)
+}
+
+// scale converts a sample value to 16 bits.
+func (p *pngRows) scale(v uint16) uint16 {
+	return uint16(uint32(v) * 0xffff / (1<<uint(p.depth) - 1))
+}
+
+// convertRow writes the current row to pix as alpha-premultiplied RGBA.
+func (p *pngRows) convertRow(pix []byte) {
+	ns := pngSamples(p.ctype)
+	for x := 0; x < p.width; x++ {
+		var c [4]uint16
+		switch p.ctype {
+		case pngGray:
+			v := p.sample(x)
+			g := p.scale(v)
+			c = [4]uint16{g, g, g, 0xffff}
+			if len(p.key) == 1 && p.key[0] == v {
+				c[3] = 0
+			}
+		case pngRGB:
+			r, g, b := p.sample(x*3), p.sample(x*3+1), p.sample(x*3+2)
+			c = [4]uint16{p.scale(r), p.scale(g), p.scale(b), 0xffff}
+			if len(p.key) == 3 && p.key[0] == r && p.key[1] == g && p.key[2] == b {
+				c[3] = 0
+			}
+		case pngPaletted:
+			c = p.palette[p.sample(x)]
+		case pngGrayAlpha, pngRGBA:
+			for i := 0; i < ns; i++ {
+				c[i] = p.scale(p.sample(x*ns + i))
+			}
+			if p.ctype == pngGrayAlpha {
+				c = [4]uint16{c[0], c[0], c[0], c[1]}
+			}
+		}
+		a := uint32(c[3])
+		for i := 0; i < 3; i++ {
+			pix[x*4+i] = uint8(uint32(c[i]) * a / 0xffff >> 8)
+		}
+		pix[x*4+3] = uint8(a >> 8)
+	}
+}
+
+// idatReader reads the data of consecutive IDAT chunks as a single stream.
+type idatReader struct {
+	r   io.Reader
+	n   uint32 // bytes remaining in the current chunk
+	crc hash.Hash32
+	eof bool
+}
+
+func (d *idatReader) Read(p []byte) (int, error) {
+	for d.n == 0 {
+		if d.eof {
+			return 0, io.EOF
+		}
+		// Check the CRC of the finished chunk and move on to the next.
+		var b [4]byte
+		if _, err := io.ReadFull(d.r, b[:]); err != nil {
+			return 0, err
+		}
+		if d.crc.Sum32() != binary.BigEndian.Uint32(b[:]) {
+			return 0, errors.New("png: invalid checksum in IDAT chunk")
+		}
+		typ, n, err := readChunkHeader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			d.eof = true
+			return 0, io.EOF
+		}
+		d.n = n
+		d.crc.Reset()
+		d.crc.Write([]byte(typ))
+	}
+	if uint32(len(p)) > d.n {
+		p = p[:d.n]
+	}
+	n, err := d.r.Read(p)
+	d.crc.Write(p[:n])
+	d.n -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,208 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// pngRowsTests are the kinds of PNG image that pngRows decodes. Images with
+// a transparent color are made with few sample values, so that it occurs.
+var pngRowsTests = []struct {
+	desc         string
+	ctype, depth int
+	trns         bool // whether the image has a tRNS chunk
+}{
+	{"gray 1", pngGray, 1, false},
+	{"gray 2", pngGray, 2, false},
+	{"gray 4", pngGray, 4, false},
+	{"gray 8", pngGray, 8, false},
+	{"gray 16", pngGray, 16, false},
+	{"gray 8 with transparent color", pngGray, 8, true},
+	{"gray 16 with transparent color", pngGray, 16, true},
+	{"RGB 8", pngRGB, 8, false},
+	{"RGB 16", pngRGB, 16, false},
+	{"RGB 8 with transparent color", pngRGB, 8, true},
+	{"RGB 16 with transparent color", pngRGB, 16, true},
+	{"paletted 1", pngPaletted, 1, false},
+	{"paletted 2", pngPaletted, 2, false},
+	{"paletted 4", pngPaletted, 4, true},
+	{"paletted 8", pngPaletted, 8, false},
+	{"paletted 8 with alpha", pngPaletted, 8, true},
+	{"gray and alpha 8", pngGrayAlpha, 8, false},
+	{"gray and alpha 16", pngGrayAlpha, 16, false},
+	{"RGBA 8", pngRGBA, 8, false},
+	{"RGBA 16", pngRGBA, 16, false},
+}
+
+// pngFilters are the names of the PNG filter types.
+var pngFilters = []string{"None", "Sub", "Up", "Average", "Paeth"}
+
+// appendChunk appends a PNG chunk of the specified type and data to b.
+func appendChunk(b []byte, typ string, data []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b = append(b, n[:]...)
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(b[start:]))
+	return append(b, n[:]...)
+}
+
+// filterRow filters row, whose pixels are bpp bytes apart, with the
+// specified filter type, given the previous row, and returns it with its
+// filter type byte.
+func filterRow(filter int, row, prev []byte, bpp int) []byte {
+	out := make([]byte, len(row)+1)
+	out[0] = byte(filter)
+	for i := range row {
+		var a, c uint8
+		if i >= bpp {
+			a, c = row[i-bpp], prev[i-bpp]
+		}
+		b := prev[i]
+		switch filter {
+		case 0:
+			out[i+1] = row[i]
+		case 1:
+			out[i+1] = row[i] - a
+		case 2:
+			out[i+1] = row[i] - b
+		case 3:
+			out[i+1] = row[i] - uint8((int(a)+int(b))/2)
+		case 4:
+			out[i+1] = row[i] - paeth(a, b, c)
+		}
+	}
+	return out
+}
+
+// encodeTestPNG returns a non-interlaced PNG image of the specified size,
+// color type and bit depth, whose rows are all filtered with the specified
+// filter type, with random samples. If trns is true, it has a tRNS chunk.
+func encodeTestPNG(rnd *rand.Rand, width, height, ctype, depth int, trns bool, filter int) []byte {
+	b := []byte(pngHeader)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8], ihdr[9] = byte(depth), byte(ctype)
+	b = appendChunk(b, "IHDR", ihdr)
+
+	sample := func() byte { return byte(rnd.Intn(256)) }
+	if ctype == pngPaletted {
+		plte := make([]byte, 3<<uint(depth))
+		for i := range plte {
+			plte[i] = sample()
+		}
+		b = appendChunk(b, "PLTE", plte)
+		if trns {
+			alpha := make([]byte, 1<<uint(depth)/2)
+			for i := range alpha {
+				alpha[i] = sample()
+			}
+			b = appendChunk(b, "tRNS", alpha)
+		}
+	} else if trns {
+		// The transparent color has samples of 1, of which there are few.
+		sample = func() byte { return byte(rnd.Intn(2)) }
+		key := make([]byte, 2*pngSamples(ctype))
+		for i := 1; i < len(key); i += 2 {
+			key[i] = 1
+		}
+		b = appendChunk(b, "tRNS", key)
+	}
+
+	bits := pngSamples(ctype) * depth
+	bpp := (bits + 7) / 8
+	stride := (width*bits + 7) / 8
+	var raw bytes.Buffer
+	prev := make([]byte, stride)
+	for y := 0; y < height; y++ {
+		row := make([]byte, stride)
+		for i := range row {
+			row[i] = sample()
+		}
+		if trns && depth == 16 {
+			// Make 16-bit samples of 1 as common as those of 257.
+			for i := 0; i < len(row); i += 2 {
+				row[i] = 0
+			}
+		}
+		raw.Write(filterRow(filter, row, prev, bpp))
+		prev = row
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(raw.Bytes())
+	zw.Close()
+	b = appendChunk(b, "IDAT", z.Bytes())
+	return appendChunk(b, "IEND", nil)
+}
+
+func TestPNGRows(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const width, height = 13, 7
+	for _, tt := range pngRowsTests {
+		for filter, name := range pngFilters {
+			desc := fmt.Sprintf("%s, filter %s", tt.desc, name)
+			b := encodeTestPNG(rnd, width, height, tt.ctype, tt.depth, tt.trns, filter)
+			want, err := png.Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("%s: png.Decode: %v", desc, err)
+			}
+			rr, err := newPNGRows(bytes.NewReader(b))
+			if err != nil {
+				t.Errorf("%s: newPNGRows: %v", desc, err)
+				continue
+			}
+			// Read the image in two bands.
+			got := image.NewRGBA(image.Rect(0, 0, width, height))
+			for _, r := range []image.Rectangle{image.Rect(0, 0, width, 3), image.Rect(0, 3, width, height)} {
+				if err := rr.Read(got.SubImage(r).(*image.RGBA)); err != nil {
+					t.Fatalf("%s: Read: %v", desc, err)
+				}
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					r, g, b, a := want.At(x, y).RGBA()
+					w := [4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+					i := got.PixOffset(x, y)
+					if g := got.Pix[i : i+4]; !bytes.Equal(g, w[:]) {
+						t.Errorf("%s: pixel (%d, %d) is %v, want %v", desc, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPNGRowsTruncated(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const width, height = 64, 64
+	b := encodeTestPNG(rnd, width, height, pngRGB, 8, false, 4)
+
+	// Cut the compressed data short within a well-formed IDAT chunk, and the
+	// file short within the chunk.
+	idat := bytes.Index(b, []byte("IDAT")) - 4
+	n := int(binary.BigEndian.Uint32(b[idat:]))
+	short := appendChunk(append([]byte(nil), b[:idat]...), "IDAT", b[idat+8:idat+8+n/2])
+	short = appendChunk(short, "IEND", nil)
+	for _, tb := range [][]byte{short, b[:idat+8+n/2]} {
+		rr, err := newPNGRows(bytes.NewReader(tb))
+		if err != nil {
+			t.Fatalf("newPNGRows: %v", err)
+		}
+		if err := rr.Read(image.NewRGBA(image.Rect(0, 0, width, height))); err == nil {
+			t.Errorf("Read of %d of %d bytes: no error", len(tb), len(b))
+		}
+	}
+}
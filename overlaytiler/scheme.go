@@ -0,0 +1,255 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"code.google.com/p/graphics-go/graphics"
+)
+
+// Tiles are laid out on a tile matrix set, a grid of tiles at each zoom level
+// in some coordinate reference system, and named in the zip file according to
+// a tiling scheme. Tiles are always addressed internally, in their datastore
+// keys and tile tasks, by their column and row counted from the north-west
+// corner of the grid; the scheme only decides the names of their files.
+
+// Tiling schemes.
+const (
+	schemeXYZ     = "xyz"     // zoom/x/y.png, rows counted from the north
+	schemeTMS     = "tms"     // zoom/x/y.png, rows counted from the south
+	schemeQuadkey = "quadkey" // Bing Maps quadkey.png
+)
+
+// A tileMatrixSet describes the grid of tiles in a coordinate reference
+// system. Its size is given in pixels at zoom level 0; each zoom level is
+// twice as wide and tall as the one before, and is divided into tiles of the
+// Overlay's tile size.
+type tileMatrixSet struct {
+	EPSG          int
+	X, Y          float64 // model coordinates of the top-left corner
+	Res           float64 // pixel size in model units at zoom level 0
+	Width, Height int64
+}
+
+// tileMatrixSets holds the supported tile matrix sets by EPSG code: Web
+// Mercator, in which the grid is the world; the geographic grid of
+// EPSG:4326, which has two square tiles at zoom level 0 for 256-pixel tiles;
+// the British National Grid, with the origin and resolutions of the Ordnance
+// Survey's tiles; and the Swiss LV95 grid, covering Switzerland.
+var tileMatrixSets = map[int]*tileMatrixSet{
+	3857:  {EPSG: 3857, X: -math.Pi * earthRadius, Y: math.Pi * earthRadius, Res: 2 * math.Pi * earthRadius / 256, Width: 256, Height: 256},
+	4326:  {EPSG: 4326, X: -180, Y: 90, Res: 360.0 / 512, Width: 512, Height: 256},
+	27700: {EPSG: 27700, X: -238375, Y: 1376256, Res: 896, Width: 1280, Height: 1536},
+	2056:  {EPSG: 2056, X: 2420000, Y: 1350000, Res: 4000, Width: 120, Height: 80},
+}
+
+// tileMatrixSet returns the Overlay's tile matrix set. Overlays processed
+// before tile matrix sets were introduced use Web Mercator.
+func (o *Overlay) tileMatrixSet() *tileMatrixSet {
+	if ms, ok := tileMatrixSets[o.TileMatrixSet]; ok {
+		return ms
+	}
+	return tileMatrixSets[3857]
+}
+
+// scheme returns the Overlay's tiling scheme.
+func (o *Overlay) scheme() string {
+	if o.Scheme == "" {
+		return schemeXYZ
+	}
+	return o.Scheme
+}
+
+// point converts world coordinates to the coordinates of the grid, in pixels
+// at zoom level 0.
+func (ms *tileMatrixSet) point(p []float64) ([]float64, error) {
+	if ms.EPSG == 3857 {
+		return p, nil
+	}
+	m, err := worldToModel(ms.EPSG, p[0], p[1])
+	if err != nil {
+		return nil, err
+	}
+	return []float64{(m[0] - ms.X) / ms.Res, (ms.Y - m[1]) / ms.Res}, nil
+}
+
+// wraps reports whether the grid covers the whole world from west to east,
+// so that the columns of Overlays that cross the antimeridian wrap around.
+func (ms *tileMatrixSet) wraps() bool {
+	return ms.EPSG == 3857 || ms.EPSG == 4326
+}
+
+// extentSteps is the number of points along each side of an Overlay that are
+// projected to find its extent on a grid, on which its sides may be curved.
+const extentSteps = 16
+
+// outline returns the outline of the Overlay's visible area (see
+// Overlay.outline) on the grid, in pixels at zoom level 0.
+func (ms *tileMatrixSet) outline(o *Overlay) ([][]float64, error) {
+	poly := o.outline()
+	steps := extentSteps
+	if ms.EPSG == 3857 {
+		// The sides are straight on the world's own grid.
+		steps = 1
+	}
+	var out [][]float64
+	for i, a := range poly {
+		b := poly[(i+1)%len(poly)]
+		for s := 0; s < steps; s++ {
+			f := float64(s) / float64(steps)
+			p, err := ms.point([]float64{a[0] + f*(b[0]-a[0]), a[1] + f*(b[1]-a[1])})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// extent returns the bounds of the Overlay's visible area on the grid, in
+// pixels at zoom level 0.
+func (ms *tileMatrixSet) extent(o *Overlay) (minX, minY, maxX, maxY float64, err error) {
+	poly, err := ms.outline(o)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	var xs, ys []float64
+	for _, p := range poly {
+		xs, ys = append(xs, p[0]), append(ys, p[1])
+	}
+	return min(xs...), min(ys...), max(xs...), max(ys...), nil
+}
+
+// covers reports whether the tile may hold part of the Overlay, which is the
+// case if their extents on the Overlay's tile matrix set intersect.
+func (o *Overlay) covers(t *Tile) bool {
+	ms := o.tileMatrixSet()
+	minX, minY, maxX, maxY, err := ms.extent(o)
+	if err != nil {
+		return false
+	}
+	// The tile's size and position in pixels at zoom level 0.
+	size := float64(o.tileSize()) / math.Pow(2, float64(t.Zoom))
+	x, y := float64(t.X)*size, float64(t.Y)*size
+	if y > maxY || y+size < minY {
+		return false
+	}
+	if !ms.wraps() {
+		return x <= maxX && x+size >= minX
+	}
+	for k := -1; k <= 1; k++ {
+		xk := x + float64(k)*float64(ms.Width)
+		if xk <= maxX && xk+size >= minX {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the number of tile columns and rows of the grid at the
+// specified zoom level, for tiles of the specified size in pixels.
+func (ms *tileMatrixSet) size(zoom int64, tileSize int) (cols, rows int64) {
+	n := int64(tileSize)
+	cols = (ms.Width<<uint(zoom) + n - 1) / n
+	rows = (ms.Height<<uint(zoom) + n - 1) / n
+	return
+}
+
+// parseScheme sets the Overlay's tiling scheme and tile matrix set from the
+// "scheme" and "tileMatrixSet" parameters of a process request. It must be
+// called after the Overlay's tile size is set.
+func parseScheme(o *Overlay, scheme, matrixSet string) error {
+	o.Scheme = strings.ToLower(scheme)
+	switch o.Scheme {
+	case "":
+		o.Scheme = schemeXYZ
+	case schemeXYZ, schemeTMS, schemeQuadkey:
+	default:
+		return fmt.Errorf("invalid parameter scheme: must be %s, %s or %s", schemeXYZ, schemeTMS, schemeQuadkey)
+	}
+	epsg, err := parseEPSG(matrixSet)
+	if err != nil {
+		return fmt.Errorf("invalid parameter tileMatrixSet: %v", err)
+	}
+	if epsg == 0 {
+		epsg = 3857
+	}
+	if _, ok := tileMatrixSets[epsg]; !ok {
+		return fmt.Errorf("invalid parameter tileMatrixSet: EPSG:%d is not supported; use 3857, 4326, 27700 or 2056", epsg)
+	}
+	o.TileMatrixSet = epsg
+	if o.Scheme == schemeQuadkey && (epsg != 3857 || o.TileSize != defaultTileSize) {
+		return fmt.Errorf("invalid parameter scheme: quadkeys need 256-pixel Web Mercator tiles")
+	}
+	return nil
+}
+
+// tilePath returns the path of the tile's file in the zip file, relative to
+// the Overlay's directory and without an extension.
+func (o *Overlay) tilePath(t *Tile) string {
+	switch o.scheme() {
+	case schemeTMS:
+		_, rows := o.tileMatrixSet().size(t.Zoom, o.tileSize())
+		return fmt.Sprintf("%d/%d/%d", t.Zoom, t.X, rows-1-t.Y)
+	case schemeQuadkey:
+		return t.quadkey()
+	}
+	return fmt.Sprintf("%d/%d/%d", t.Zoom, t.X, t.Y)
+}
+
+// quadkey returns the Bing Maps quadkey of the tile: one digit per zoom
+// level, each giving the quadrant of the tile at that level that holds t.
+func (t *Tile) quadkey() string {
+	b := make([]byte, t.Zoom)
+	for i := int64(0); i < t.Zoom; i++ {
+		bit := uint(t.Zoom - 1 - i)
+		b[i] = '0' + byte(t.X>>bit&1) + 2*byte(t.Y>>bit&1)
+	}
+	return string(b)
+}
+
+// renderTile draws the specified tile of the grid, as renderTile does for
+// Web Mercator tiles, reprojecting each of its pixels to find it in the
+// source image.
+func (ms *tileMatrixSet) renderTile(a graphics.Affine, tile *Tile, size, scale int, src imageSource) (*image.RGBA, error) {
+	px := size * scale
+	res := ms.Res / float64(int64(scale)<<uint(tile.Zoom))
+	g := &exportGrid{
+		EPSG:   ms.EPSG,
+		Zoom:   tile.Zoom,
+		X:      ms.X + float64(tile.X*int64(px))*res,
+		Y:      ms.Y - float64(tile.Y*int64(px))*res,
+		Res:    res,
+		Width:  px,
+		Height: px,
+	}
+	m := image.NewRGBA(image.Rect(0, 0, px, px))
+	if err := g.render(m, a[:], src); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// gridInfo describes an Overlay's tile matrix set to the viewer in the zip
+// file.
+type gridInfo struct {
+	EPSG   int       `json:"epsg"`
+	Width  int64     `json:"width"` // in pixels at zoom level 0
+	Height int64     `json:"height"`
+	Wraps  bool      `json:"wraps"`
+	Extent []float64 `json:"extent"` // min x, min y, max x, max y of the Overlay
+}
+
+func overlayGrid(o *Overlay) (*gridInfo, error) {
+	ms := o.tileMatrixSet()
+	minX, minY, maxX, maxY, err := ms.extent(o)
+	if err != nil {
+		return nil, err
+	}
+	return &gridInfo{ms.EPSG, ms.Width, ms.Height, ms.wraps(), []float64{minX, minY, maxX, maxY}}, nil
+}
@@ -0,0 +1,423 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// The owner of an Overlay may share it with other users and Groups, as
+// viewers, who may see it, its tiles and downloads, or as editors, who may
+// also place, process and export it. Users are named by email address, as
+// their owner knows them, and Groups by their ID, which the datastore
+// assigns and never reuses, so that no one may take over a deleted Group's
+// shares. Overlays may be shared only with Groups their owner owns or is a
+// member of. Shared Overlays are listed along with a user's own, with the
+// user's role. The owner may also make signed links that let anyone
+// get an Overlay's tiles and downloads until they expire (see links.go).
+
+// Roles of users in an Overlay.
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+const (
+	groupPrefix  = "group:" // marks a Group, by ID, among the users an Overlay is shared with
+	maxSharees   = 100      // limit on the users and Groups an Overlay is shared with
+	maxGroupSize = 500      // limit on the members of a Group
+)
+
+var groupName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// Group is a named set of users, which Overlays may be shared with. It is
+// stored in the datastore with an integer ID, and managed by its Owner.
+type Group struct {
+	Owner   string   // user ID of the creator
+	Name    string   `datastore:",noindex"`
+	Members []string // email addresses, in lower case
+}
+
+// groupKey returns the key of the Group with the specified ID, or nil if the
+// ID is not well formed.
+func groupKey(c appengine.Context, id string) *datastore.Key {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	return datastore.NewKey(c, "Group", "", n, nil)
+}
+
+// loadGroups sets the principal's Groups, if they are not yet loaded.
+func (p *principal) loadGroups(c appengine.Context) error {
+	if p.groupsLoaded || p.Email == "" {
+		return nil
+	}
+	keys, err := datastore.NewQuery("Group").Filter("Members = ", p.Email).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	p.Groups = nil
+	for _, k := range keys {
+		p.Groups = append(p.Groups, strconv.FormatInt(k.IntID(), 10))
+	}
+	p.groupsLoaded = true
+	return nil
+}
+
+// identities returns the entries in the lists of users an Overlay is shared
+// with that name the principal: its email address and its Groups.
+func (p *principal) identities() []string {
+	if p.Email == "" {
+		return nil
+	}
+	ids := []string{p.Email}
+	for _, g := range p.Groups {
+		ids = append(ids, groupPrefix+g)
+	}
+	return ids
+}
+
+// sharedWithGroups reports whether the Overlay is shared with any Group.
+func (o *Overlay) sharedWithGroups() bool {
+	for _, l := range [][]string{o.Viewers, o.Editors} {
+		for _, s := range l {
+			if strings.HasPrefix(s, groupPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseSharees parses a comma-separated list of email addresses and Groups,
+// the latter given as groupPrefix and their ID.
+func parseSharees(s string) ([]string, error) {
+	var list []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		switch {
+		case v == "" || seen[v]:
+			continue
+		case strings.HasPrefix(v, groupPrefix):
+			if n, err := strconv.ParseInt(strings.TrimPrefix(v, groupPrefix), 10, 64); err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid group %q", v)
+			}
+		default:
+			if i := strings.Index(v, "@"); i < 1 || i == len(v)-1 {
+				return nil, fmt.Errorf("invalid email address %q", v)
+			}
+		}
+		seen[v] = true
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// apiSharees lists who an Overlay is shared with, in the API.
+type apiSharees struct {
+	Viewers []string `json:"viewers"`
+	Editors []string `json:"editors"`
+}
+
+// checkGroups returns an appError unless every Group among the sharees is
+// one that the principal owns or is a member of. Groups the Overlay is
+// already shared with are not checked, so that its owner may keep them.
+func checkGroups(c appengine.Context, p *principal, o *Overlay, sharees []string) *appError {
+	old := make(map[string]bool)
+	for _, s := range append(o.Viewers, o.Editors...) {
+		old[s] = true
+	}
+	if err := p.loadGroups(c); err != nil {
+		return appErrorf(err, "could not get groups")
+	}
+	member := make(map[string]bool)
+	for _, id := range p.Groups {
+		member[id] = true
+	}
+	for _, s := range sharees {
+		if !strings.HasPrefix(s, groupPrefix) || old[s] {
+			continue
+		}
+		id := strings.TrimPrefix(s, groupPrefix)
+		if member[id] {
+			continue
+		}
+		g := new(Group)
+		err := datastore.Get(c, groupKey(c, id), g)
+		if err == datastore.ErrNoSuchEntity || err == nil && g.Owner != p.UserID {
+			return &appError{err, fmt.Sprintf("group %s not found", id), http.StatusBadRequest}
+		} else if err != nil {
+			return appErrorf(err, "could not get group")
+		}
+	}
+	return nil
+}
+
+// apiSharing writes who an Overlay is shared with or, with PUT, first
+// replaces them with the comma-separated "viewers" and "editors" parameters.
+// Users in both lists are editors.
+func apiSharing(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, k *datastore.Key, o *Overlay) *appError {
+	scope := scopeRead
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		scope = scopeShare
+	default:
+		return methodNotAllowed(w, "GET", "PUT")
+	}
+	if e := authorizeOverlay(c, p, o, accessOwn); e != nil {
+		return e
+	}
+	if e := requireScope(p, scope); e != nil {
+		return e
+	}
+	if r.Method == "PUT" {
+		viewers, err := parseSharees(r.FormValue("viewers"))
+		if err != nil {
+			return &appError{err, "invalid parameter viewers: " + err.Error(), http.StatusBadRequest}
+		}
+		editors, err := parseSharees(r.FormValue("editors"))
+		if err != nil {
+			return &appError{err, "invalid parameter editors: " + err.Error(), http.StatusBadRequest}
+		}
+		isEditor := make(map[string]bool)
+		for _, s := range editors {
+			isEditor[s] = true
+		}
+		var onlyViewers []string
+		for _, s := range viewers {
+			if !isEditor[s] {
+				onlyViewers = append(onlyViewers, s)
+			}
+		}
+		if n := len(onlyViewers) + len(editors); n > maxSharees {
+			return &appError{nil, fmt.Sprintf("an overlay may be shared with at most %d users and groups", maxSharees), http.StatusBadRequest}
+		}
+		if e := checkGroups(c, p, o, append(onlyViewers, editors...)); e != nil {
+			return e
+		}
+
+		// Update the Overlay in a transaction, as it may be being
+		// processed.
+		tx := func(c appengine.Context) error {
+			if err := reloadOverlay(c, k, o); err != nil {
+				return err
+			}
+			o.Viewers, o.Editors = onlyViewers, editors
+			o.Updated = time.Now()
+			_, err := datastore.Put(c, k, o)
+			return err
+		}
+		if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+			return appErrorf(err, "could not store overlay")
+		}
+	}
+	writeJSON(w, http.StatusOK, &apiSharees{Viewers: o.Viewers, Editors: o.Editors})
+	return nil
+}
+
+// An apiGroup is the representation of a Group in the API. Only its owner
+// is told its members.
+type apiGroup struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Owner   bool     `json:"owner"` // whether the user owns it
+	Members []string `json:"members,omitempty"`
+}
+
+func newAPIGroup(k *datastore.Key, g *Group, owner bool) *apiGroup {
+	a := &apiGroup{ID: strconv.FormatInt(k.IntID(), 10), Name: g.Name, Owner: owner}
+	if owner {
+		a.Members = g.Members
+	}
+	return a
+}
+
+// apiGroups dispatches requests to manage Groups, whose path below apiPrefix
+// is given in parts:
+//
+//	GET    groups      list the Groups the user owns or is a member of
+//	POST   groups      create a Group
+//	PUT    groups/{id} replace a Group's name and members
+//	DELETE groups/{id} delete a Group, and stop sharing Overlays with it
+//
+// Groups are created and changed with the "name" and comma-separated
+// "members" parameters. Only a Group's owner may change it.
+func apiGroups(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, parts []string) *appError {
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		if e := requireScope(p, scopeRead); e != nil {
+			return e
+		}
+		return listGroups(c, w, p)
+	case len(parts) == 1 && r.Method != "POST":
+		return methodNotAllowed(w, "GET", "POST")
+	case len(parts) > 2:
+		return &appError{nil, "no such resource", http.StatusNotFound}
+	case len(parts) == 2 && r.Method != "PUT" && r.Method != "DELETE":
+		return methodNotAllowed(w, "PUT", "DELETE")
+	}
+	if e := requireScope(p, scopeShare); e != nil {
+		return e
+	}
+	g := &Group{Owner: p.UserID}
+	if r.Method != "DELETE" {
+		g.Name = strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+		if !groupName.MatchString(g.Name) {
+			return &appError{nil, "invalid parameter name", http.StatusBadRequest}
+		}
+		var err error
+		if g.Members, err = parseSharees(r.FormValue("members")); err != nil {
+			return &appError{err, "invalid parameter members: " + err.Error(), http.StatusBadRequest}
+		}
+		for _, m := range g.Members {
+			if strings.HasPrefix(m, groupPrefix) {
+				return &appError{nil, "groups may not be members of groups", http.StatusBadRequest}
+			}
+		}
+		if len(g.Members) > maxGroupSize {
+			return &appError{nil, fmt.Sprintf("a group may have at most %d members", maxGroupSize), http.StatusBadRequest}
+		}
+	}
+	if len(parts) == 1 {
+		k, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Group", nil), g)
+		if err != nil {
+			return appErrorf(err, "could not store group")
+		}
+		w.Header().Set("Location", apiPrefix+"groups/"+strconv.FormatInt(k.IntID(), 10))
+		writeJSON(w, http.StatusCreated, newAPIGroup(k, g, true))
+		return nil
+	}
+
+	k := groupKey(c, parts[1])
+	if k == nil {
+		return &appError{nil, "group not found", http.StatusNotFound}
+	}
+	errNotOwner := errors.New("group belongs to another user")
+	tx := func(c appengine.Context) error {
+		old := new(Group)
+		if err := datastore.Get(c, k, old); err != nil {
+			return err
+		}
+		if old.Owner != p.UserID {
+			return errNotOwner
+		}
+		if r.Method == "DELETE" {
+			return datastore.Delete(c, k)
+		}
+		_, err := datastore.Put(c, k, g)
+		return err
+	}
+	switch err := datastore.RunInTransaction(c, tx, nil); {
+	case err == datastore.ErrNoSuchEntity:
+		return &appError{err, "group not found", http.StatusNotFound}
+	case err == errNotOwner:
+		return &appError{err, "only the owner may change this group", http.StatusForbidden}
+	case err != nil:
+		return appErrorf(err, "could not store group")
+	}
+	if r.Method == "DELETE" {
+		if err := unshareGroup(c, parts[1]); err != nil {
+			return appErrorf(err, "could not stop sharing overlays with group")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	writeJSON(w, http.StatusOK, newAPIGroup(k, g, true))
+	return nil
+}
+
+// unshareGroup removes the Group with the specified ID from the Viewers and
+// Editors of every Overlay shared with it.
+func unshareGroup(c appengine.Context, id string) error {
+	sharee := groupPrefix + id
+	for _, field := range []string{"Viewers", "Editors"} {
+		keys, err := datastore.NewQuery("Overlay").Filter(field+" = ", sharee).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			tx := func(c appengine.Context) error {
+				o := new(Overlay)
+				if err := datastore.Get(c, k, o); err != nil {
+					return err
+				}
+				o.Viewers, o.Editors = without(o.Viewers, sharee), without(o.Editors, sharee)
+				_, err := datastore.Put(c, k, o)
+				return err
+			}
+			if err := datastore.RunInTransaction(c, tx, nil); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// without returns the list with every occurrence of s removed.
+func without(list []string, s string) []string {
+	var l []string
+	for _, v := range list {
+		if v != s {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// listGroups writes the Groups that the principal owns or is a member of.
+func listGroups(c appengine.Context, w http.ResponseWriter, p *principal) *appError {
+	var owned []*Group
+	keys, err := datastore.NewQuery("Group").Filter("Owner = ", p.UserID).GetAll(c, &owned)
+	if err != nil {
+		return appErrorf(err, "could not get groups")
+	}
+	list := []*apiGroup{}
+	isOwned := make(map[int64]bool)
+	for i, k := range keys {
+		isOwned[k.IntID()] = true
+		list = append(list, newAPIGroup(k, owned[i], true))
+	}
+	if err := p.loadGroups(c); err != nil {
+		return appErrorf(err, "could not get groups")
+	}
+	var others []*datastore.Key
+	for _, id := range p.Groups {
+		if k := groupKey(c, id); k != nil && !isOwned[k.IntID()] {
+			others = append(others, k)
+		}
+	}
+	groups := make([]*Group, len(others))
+	for i := range groups {
+		groups[i] = new(Group)
+	}
+	err = datastore.GetMulti(c, others, groups)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return appErrorf(err, "could not get groups")
+	}
+	for i, k := range others {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if merr != nil && merr[i] != nil {
+			return appErrorf(merr[i], "could not get groups")
+		}
+		list = append(list, newAPIGroup(k, groups[i], false))
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Groups []*apiGroup `json:"groups"`
+	}{list})
+	return nil
+}
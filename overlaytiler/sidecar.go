@@ -0,0 +1,287 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/graphics-go/graphics"
+
+	"geotiff"
+)
+
+// A sidecar file accompanies an image and georeferences it. Three kinds are
+// supported:
+//
+//   - world files (.wld, .pgw, .jgw, .gfw, .tfw, ...), which hold the six
+//     coefficients of an affine transformation but no coordinate system;
+//   - GDAL .aux.xml files, which hold a GeoTransform or a list of ground
+//     control points and the coordinate system as WKT;
+//   - QGIS georeferencer .points files, which hold ground control points and,
+//     optionally, the coordinate system as WKT.
+//
+// Ground control points are fitted with an affine transformation by least
+// squares.
+
+// maxSidecar is the size limit for sidecar files.
+const maxSidecar = 1 << 20
+
+// A gcp is a ground control point, relating a raster position (I, J) to model
+// coordinates (X, Y).
+type gcp struct {
+	I, J, X, Y float64
+}
+
+// parseSidecar reads the sidecar file of the specified name from r. The EPSG
+// code epsg is used if the file does not specify its coordinate system.
+func parseSidecar(name string, r io.Reader, epsg int) (*geotiff.Georeference, error) {
+	b, err := readSidecar(r)
+	if err != nil {
+		return nil, err
+	}
+	var g *geotiff.Georeference
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case strings.HasSuffix(strings.ToLower(name), ".aux.xml") || bytes.HasPrefix(bytes.TrimSpace(b), []byte("<PAMDataset")):
+		g, err = parseAuxXML(b)
+	case ext == ".points" || bytes.Contains(b, []byte("mapX")):
+		g, err = parsePoints(b)
+	default:
+		g, err = parseWorldFile(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.EPSG == 0 {
+		g.EPSG = epsg
+	}
+	return g, nil
+}
+
+func readSidecar(r io.Reader) ([]byte, error) {
+	b := new(bytes.Buffer)
+	n, err := io.CopyN(b, r, maxSidecar+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n > maxSidecar {
+		return nil, errors.New("sidecar file too large")
+	}
+	return b.Bytes(), nil
+}
+
+// parseWorldFile parses the six lines of a world file, which give the
+// coefficients A, D, B, E, C, F of the transformation
+//
+//	x = A*i + B*j + C
+//	y = D*i + E*j + F
+//
+// from the center of pixel (i, j) to model coordinates.
+func parseWorldFile(b []byte) (*geotiff.Georeference, error) {
+	var v []float64
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return nil, fmt.Errorf("world file: %v", err)
+		}
+		v = append(v, f)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(v) != 6 {
+		return nil, errors.New("world file must hold six numbers")
+	}
+	a, d, bb, e, c, f := v[0], v[1], v[2], v[3], v[4], v[5]
+	// Shift the origin from the center to the corner of the first pixel.
+	return &geotiff.Georeference{
+		Transform: [6]float64{a, bb, c - (a+bb)/2, d, e, f - (d+e)/2},
+	}, nil
+}
+
+// auxXML is the part of a GDAL PAM dataset that georeferences an image.
+type auxXML struct {
+	SRS          string `xml:"SRS"`
+	GeoTransform string `xml:"GeoTransform"`
+	GCPList      struct {
+		Projection string `xml:"Projection,attr"`
+		GCPs       []struct {
+			Pixel float64 `xml:"Pixel,attr"`
+			Line  float64 `xml:"Line,attr"`
+			X     float64 `xml:"X,attr"`
+			Y     float64 `xml:"Y,attr"`
+		} `xml:"GCP"`
+	} `xml:"GCPList"`
+}
+
+// parseAuxXML parses a GDAL .aux.xml file. A GDAL GeoTransform gives the
+// coefficients C, A, B, F, D, E of the transformation
+//
+//	x = A*i + B*j + C
+//	y = D*i + E*j + F
+//
+// from the corner of pixel (i, j) to model coordinates.
+func parseAuxXML(b []byte) (*geotiff.Georeference, error) {
+	var aux auxXML
+	if err := xml.Unmarshal(b, &aux); err != nil {
+		return nil, fmt.Errorf("aux.xml: %v", err)
+	}
+	if aux.GeoTransform != "" {
+		var v []float64
+		for _, s := range strings.Split(aux.GeoTransform, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("aux.xml: bad GeoTransform: %v", err)
+			}
+			v = append(v, f)
+		}
+		if len(v) != 6 {
+			return nil, errors.New("aux.xml: GeoTransform must hold six numbers")
+		}
+		return &geotiff.Georeference{
+			Transform: [6]float64{v[1], v[2], v[0], v[4], v[5], v[3]},
+			EPSG:      wktEPSG(aux.SRS),
+		}, nil
+	}
+	var gcps []gcp
+	for _, p := range aux.GCPList.GCPs {
+		gcps = append(gcps, gcp{p.Pixel, p.Line, p.X, p.Y})
+	}
+	if len(gcps) == 0 {
+		return nil, errors.New("aux.xml: no GeoTransform or GCPs")
+	}
+	g, err := fitGCPs(gcps)
+	if err != nil {
+		return nil, err
+	}
+	g.EPSG = wktEPSG(aux.GCPList.Projection)
+	return g, nil
+}
+
+// parsePoints parses a QGIS georeferencer .points file: comma-separated
+// lines of mapX, mapY, pixelX, pixelY and enable, where pixelY is negated.
+// A leading comment line may hold the coordinate system as "#CRS: WKT".
+func parsePoints(b []byte) (*geotiff.Georeference, error) {
+	epsg := 0
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#CRS:") {
+				epsg = wktEPSG(line)
+			}
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	recs, err := csv.NewReader(strings.NewReader(strings.Join(lines, "\n"))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("points file: %v", err)
+	}
+	var gcps []gcp
+	for i, rec := range recs {
+		if i == 0 && len(rec) > 0 && rec[0] == "mapX" {
+			continue // header
+		}
+		if len(rec) < 5 {
+			return nil, fmt.Errorf("points file: line %d has %d fields, want at least 5", i+1, len(rec))
+		}
+		var v [5]float64
+		for j := range v {
+			if v[j], err = strconv.ParseFloat(strings.TrimSpace(rec[j]), 64); err != nil {
+				return nil, fmt.Errorf("points file: line %d: %v", i+1, err)
+			}
+		}
+		if v[4] == 0 {
+			continue // disabled
+		}
+		gcps = append(gcps, gcp{I: v[2], J: -v[3], X: v[0], Y: v[1]})
+	}
+	g, err := fitGCPs(gcps)
+	if err != nil {
+		return nil, err
+	}
+	g.EPSG = epsg
+	return g, nil
+}
+
+// fitGCPs returns the affine transformation that best fits the ground control
+// points, in the least squares sense.
+func fitGCPs(gcps []gcp) (*geotiff.Georeference, error) {
+	if len(gcps) < 3 {
+		return nil, errors.New("at least three ground control points are needed")
+	}
+	// Solve the normal equations N·[a b c] = [Σxi Σxj Σx] (and likewise
+	// for y), where N = Σ [i j 1]ᵀ[i j 1].
+	var n graphics.Affine
+	var rx, ry [3]float64
+	for _, p := range gcps {
+		v := [3]float64{p.I, p.J, 1}
+		for r := 0; r < 3; r++ {
+			for c := 0; c < 3; c++ {
+				n[r*3+c] += v[r] * v[c]
+			}
+			rx[r] += v[r] * p.X
+			ry[r] += v[r] * p.Y
+		}
+	}
+	inv := inverse(n)
+	for _, v := range inv {
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, errors.New("ground control points are collinear")
+		}
+	}
+	var t [6]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			t[r] += inv[r*3+c] * rx[c]
+			t[3+r] += inv[r*3+c] * ry[c]
+		}
+	}
+	return &geotiff.Georeference{Transform: t}, nil
+}
+
+// authorityRE matches the EPSG authority clauses of a WKT coordinate system.
+var authorityRE = regexp.MustCompile(`(?:AUTHORITY|ID)\["EPSG",\s*"?(\d+)"?\]`)
+
+// wktEPSG returns the EPSG code of a coordinate system described in WKT, or 0
+// if it has none. The code of the outermost system is the last one given.
+func wktEPSG(wkt string) int {
+	m := authorityRE.FindAllStringSubmatch(wkt, -1)
+	if len(m) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[len(m)-1][1])
+	return n
+}
+
+// parseEPSG parses a coordinate system given as "EPSG:n" or "n". An empty
+// string yields 0.
+func parseEPSG(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(s), "EPSG:"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad coordinate system %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,295 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+const (
+	sliceWorkers    = 4  // default number of concurrent tile renderers
+	maxSliceWorkers = 16 // upper bound on the "workers" slice parameter
+	secPerTile      = 2  // worst-case time to render and encode one tile
+	secPerStore     = 5  // worst-case time to store a batch and delete its tasks
+	storeBatch      = 10 // maximum tiles to store in one datastore put
+)
+
+// A slicer renders the tiles of an Overlay using a bounded pool of worker
+// goroutines. Tile tasks are leased from the tileQueue only when a worker is
+// idle, so no leased task waits behind others long enough for its lease to
+// expire. Rendered tiles are handed to a single goroutine that stores them in
+// batches, deletes their tasks and notifies the client. In pyramid mode the
+// store also queues the parents of the stored tiles when they become ready.
+type slicer struct {
+	c       appengine.Context
+	key     *datastore.Key
+	o       *Overlay
+	srcs    []imageSource // the Overlay's image, or the images of a mosaic's layers
+	workers int
+	base    int64 // zoom level rendered from srcs in pyramid mode
+
+	idle  chan bool      // holds one value for each idle worker
+	work  chan *sliceJob // leased tiles waiting to be rendered
+	store chan *sliceJob // rendered tiles waiting to be stored
+	quit  chan bool      // closed when the first error occurs
+
+	mu    sync.Mutex
+	err   error
+	count int // tiles stored
+}
+
+// A sliceJob is a single leased tile task.
+type sliceJob struct {
+	task    *taskqueue.Task
+	tile    *Tile
+	expires time.Time // when the lease on task runs out
+}
+
+func newSlicer(c appengine.Context, k *datastore.Key, o *Overlay, srcs []imageSource, workers int) *slicer {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > maxSliceWorkers {
+		workers = maxSliceWorkers
+	}
+	s := &slicer{
+		c:       c,
+		key:     k,
+		o:       o,
+		srcs:    srcs,
+		workers: workers,
+		idle:    make(chan bool, workers),
+		work:    make(chan *sliceJob, workers),
+		store:   make(chan *sliceJob, workers),
+		quit:    make(chan bool),
+	}
+	if o.Pyramid {
+		s.base = pyramidBase(o)
+	}
+	for i := 0; i < workers; i++ {
+		s.idle <- true
+	}
+	return s
+}
+
+// run leases, renders and stores tiles until the tileQueue holds no more
+// tasks for the Overlay or an error occurs. It returns the number of tiles
+// stored and the first error encountered.
+func (s *slicer) run() (int, error) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.render()
+		}()
+	}
+	stored := make(chan bool)
+	go func() {
+		s.put()
+		close(stored)
+	}()
+
+	s.lease()
+
+	// Shut down the pipeline in order: renderers, then the store.
+	close(s.work)
+	wg.Wait()
+	close(s.store)
+	<-stored
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.err
+}
+
+// fail records err as the slicer's error if it is the first, and tells the
+// leasing loop to stop.
+func (s *slicer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.quit)
+	}
+}
+
+// failed reports whether an error has occurred.
+func (s *slicer) failed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// lease fetches tile tasks for the idle workers and hands them out.
+// It returns once there is no more work or an error has occurred.
+func (s *slicer) lease() {
+	for {
+		// Wait for at least one idle worker, then claim all idle workers.
+		n := 0
+		select {
+		case <-s.idle:
+			n++
+		case <-s.quit:
+			return
+		}
+	claim:
+		for n < s.workers {
+			select {
+			case <-s.idle:
+				n++
+			default:
+				break claim
+			}
+		}
+		if s.failed() {
+			return
+		}
+
+		// Each leased tile starts rendering immediately, but may then wait
+		// for the batch ahead of it to be stored; allow for both. The lease
+		// is extended again when the tile's own batch is stored.
+		leaseSecs := secPerTile + secPerStore
+		expires := time.Now().Add(time.Duration(leaseSecs) * time.Second)
+		tasks, err := taskqueue.LeaseByTag(s.c, n, tileQueue, leaseSecs, s.key.Encode())
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		// Give back the workers we claimed but have no work for.
+		for i := len(tasks); i < n; i++ {
+			s.idle <- true
+		}
+		if len(tasks) == 0 {
+			// No more work to do.
+			return
+		}
+		for _, task := range tasks {
+			s.work <- &sliceJob{task: task, expires: expires}
+		}
+	}
+}
+
+// render draws and encodes the tiles received from the work channel and
+// passes them on to be stored.
+func (s *slicer) render() {
+	for j := range s.work {
+		s.renderJob(j)
+		s.idle <- true
+	}
+}
+
+func (s *slicer) renderJob(j *sliceJob) {
+	if s.failed() {
+		return
+	}
+	if time.Now().After(j.expires) {
+		// The lease has run out, so another slicer may have the task.
+		s.c.Warningf("lease expired before rendering task %s", j.task.Name)
+		return
+	}
+	j.tile = new(Tile)
+	if err := json.Unmarshal(j.task.Payload, j.tile); err != nil {
+		s.fail(err)
+		return
+	}
+	var err error
+	switch {
+	case s.o.Pyramid && j.tile.Zoom < s.base:
+		err = pyramidTile(s.c, s.key, s.o, j.tile)
+	case s.o.isMosaic():
+		err = sliceMosaic(j.tile, s.o, s.srcs)
+	default:
+		err = slice(s.c, j.tile, s.o, s.srcs[0])
+	}
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.store <- j
+}
+
+// put stores rendered tiles in batches of up to storeBatch. A batch is written
+// as soon as no more rendered tiles are waiting, so that the tiles are not
+// held back longer than necessary.
+func (s *slicer) put() {
+	var batch []*sliceJob
+	for j := range s.store {
+		batch = append(batch, j)
+		if len(batch) < storeBatch && len(s.store) > 0 {
+			continue
+		}
+		if !s.failed() {
+			if err := s.putBatch(batch); err != nil {
+				s.fail(err)
+			}
+		}
+		batch = nil
+	}
+}
+
+// putBatch stores the tiles of the provided jobs, and their high-DPI
+// variants, deletes their tasks, and tells the client about them.
+func (s *slicer) putBatch(jobs []*sliceJob) error {
+	keys := make([]*datastore.Key, len(jobs))
+	tiles := make([]*Tile, len(jobs))
+	var tasks []*taskqueue.Task
+	for i, j := range jobs {
+		tiles[i] = j.tile
+		keys[i] = j.tile.Key(s.c, s.key)
+		// Extend the lease to cover storing the batch. Don't delete a task
+		// whose lease has run out, as it may now belong to another slicer;
+		// storing its tile twice is harmless.
+		if now := time.Now(); now.Before(j.expires) {
+			if err := taskqueue.ModifyLease(s.c, j.task, tileQueue, secPerStore); err == nil {
+				j.expires = now.Add(secPerStore * time.Second)
+			}
+		}
+		if time.Now().Before(j.expires) {
+			tasks = append(tasks, j.task)
+		} else {
+			s.c.Warningf("lease expired before storing task %s; it will be rendered again", j.task.Name)
+		}
+	}
+	entities := tiles
+	if s.o.Retina {
+		entities = append([]*Tile(nil), tiles...)
+		for _, t := range tiles {
+			keys = append(keys, t.RetinaKey(s.c, s.key))
+			entities = append(entities, t.retinaTile())
+		}
+	}
+	if _, err := datastore.PutMulti(s.c, keys, entities); err != nil {
+		return err
+	}
+	if len(tasks) > 0 {
+		if err := taskqueue.DeleteMulti(s.c, tasks, tileQueue); err != nil {
+			return err
+		}
+	}
+	var ids []string
+	for _, t := range tiles {
+		ids = append(ids, t.String())
+	}
+	send(s.c, s.key.Encode(), Message{Total: s.o.Tiles, IDs: ids})
+
+	if s.o.Pyramid {
+		if err := queueParents(s.c, s.key, s.o, tiles); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.count += len(tiles)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,327 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// Overlays are indexed by where they lie, so that those covering an area of
+// the map can be found. The world is divided into a quadtree of cells, named
+// by quadkey as tiles are (see Tile.quadkey). A placed Overlay records in
+// Cells the quadkeys of the cells that cover its bounding box, at the finest
+// level at which at most maxCells do, and, marked by cellAncestor, those of
+// the larger cells that hold them. An area is searched with the cells that
+// cover it in the same way: an Overlay may lie in the area if it has one of
+// those cells, has one marked (so lies within it), or has a larger cell that
+// holds one. The Overlays found are then checked against the area exactly.
+//
+// Only the Overlays that a user owns or that are shared with them are
+// searched, with a query for each cell and each of the ways they may see
+// them; at most maxSearchScan Overlays are read.
+
+const (
+	maxCellLevel   = 20  // finest level of cells that Overlays are indexed by
+	maxCells       = 8   // limit on the cells covering an Overlay
+	maxSearchCells = 4   // limit on the cells covering an area searched
+	cellAncestor   = "+" // marks the cells holding an Overlay's cells
+
+	maxSearchScan = 1000 // limit on the Overlays read per search
+	reindexBatch  = 100  // Overlays reindexed per task
+)
+
+func init() {
+	// Task handler.
+	http.Handle("/reindex", appHandler(reindexHandler))
+}
+
+// coveringCells returns the quadkeys of the cells that cover the rectangle
+// from minX, minY to maxX, maxY in world coordinates, at the finest level, up
+// to maxCellLevel, at which at most limit cells do. Columns beyond the
+// antimeridian are wrapped into the world.
+func coveringCells(minX, minY, maxX, maxY float64, limit int) []string {
+	minY, maxY = math.Max(minY, 0), math.Min(maxY, worldSize)
+	level := int64(1)
+	for level < maxCellLevel {
+		x0, y0, x1, y1 := cellRange(minX, minY, maxX, maxY, level+1)
+		if (x1-x0+1)*(y1-y0+1) > int64(limit) {
+			break
+		}
+		level++
+	}
+	x0, y0, x1, y1 := cellRange(minX, minY, maxX, maxY, level)
+	n := int64(1) << uint(level)
+	var cells []string
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			t := &Tile{X: (x%n + n) % n, Y: y, Zoom: level}
+			cells = append(cells, t.quadkey())
+		}
+	}
+	return cells
+}
+
+// cellRange returns the first and last columns and rows of the cells at the
+// specified level that cover the rectangle, as coveringCells does. Columns
+// may lie outside the world, but span at most its width.
+func cellRange(minX, minY, maxX, maxY float64, level int64) (x0, y0, x1, y1 int64) {
+	n := int64(1) << uint(level)
+	size := worldSize / float64(n)
+	cell := func(v float64, last bool) int64 {
+		if last {
+			return int64(math.Ceil(v/size)) - 1
+		}
+		return int64(math.Floor(v / size))
+	}
+	x0, x1 = cell(minX, false), cell(maxX, true)
+	y0, y1 = cell(minY, false), cell(maxY, true)
+	if x1 < x0 {
+		x1 = x0
+	}
+	if x1-x0 >= n {
+		x0, x1 = 0, n-1
+	}
+	y0 = int64(math.Max(0, math.Min(float64(y0), float64(n-1))))
+	y1 = int64(math.Max(float64(y0), math.Min(float64(y1), float64(n-1))))
+	return
+}
+
+// setCells sets the Overlay's Cells from its corners, or clears them if it
+// has not been placed.
+func (o *Overlay) setCells() {
+	o.Cells = nil
+	if o.TopLeft == nil {
+		return
+	}
+	var xs, ys []float64
+	for _, p := range [][]float64{o.TopLeft, o.TopRight, o.BottomRight, o.BottomLeft()} {
+		xs, ys = append(xs, p[0]), append(ys, p[1])
+	}
+	seen := make(map[string]bool)
+	for _, c := range coveringCells(min(xs...), min(ys...), max(xs...), max(ys...), maxCells) {
+		for l := 1; l <= len(c); l++ {
+			v := c[:l] + cellAncestor
+			if l == len(c) {
+				v = c
+			}
+			if !seen[v] {
+				seen[v] = true
+				o.Cells = append(o.Cells, v)
+			}
+		}
+	}
+}
+
+// searchCells returns the values of Cells that Overlays which may lie within
+// the specified bounds, as west, south, east and north in degrees, have one
+// of.
+func searchCells(b []float64) []string {
+	lat := func(v float64) float64 { return math.Max(-maxLatitude, math.Min(v, maxLatitude)) }
+	nw, se := lngLatToWorld(b[0], lat(b[3])), lngLatToWorld(b[2], lat(b[1]))
+	var cells []string
+	seen := make(map[string]bool)
+	add := func(v string) {
+		if !seen[v] {
+			seen[v] = true
+			cells = append(cells, v)
+		}
+	}
+	for _, c := range coveringCells(nw[0], nw[1], se[0], se[1], maxSearchCells) {
+		add(c)
+		add(c + cellAncestor)
+		for l := 1; l < len(c); l++ {
+			add(c[:l])
+		}
+	}
+	return cells
+}
+
+// boundsIntersect reports whether the bounds a and b, as west, south, east
+// and north in degrees, intersect, allowing for either to cross the
+// antimeridian. Nil bounds intersect nothing.
+func boundsIntersect(a, b []float64) bool {
+	if a == nil || b == nil || a[1] > b[3] || a[3] < b[1] {
+		return false
+	}
+	for _, shift := range []float64{-360, 0, 360} {
+		if a[0] <= b[2]+shift && a[2] >= b[0]+shift {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSearchRequest parses the area to search for Overlays in, given by the
+// form value "bbox" (west,south,east,north in degrees) or "point"
+// (longitude,latitude), and the other form values of parseFilter and
+// listRequest.parseView. The east bound may exceed 180 degrees, to cross the
+// antimeridian.
+func parseSearchRequest(v url.Values) (*listRequest, error) {
+	lr := &listRequest{Limit: defaultListLimit}
+	var err error
+	if lr.Filter, err = parseFilter(v); err != nil {
+		return nil, err
+	}
+	if s := v.Get("point"); s != "" {
+		if lr.Filter.Bounds != nil {
+			return nil, errors.New("invalid parameter point: must not be given with bbox")
+		}
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return nil, errors.New("invalid parameter point: must be longitude,latitude")
+		}
+		p := make([]float64, 2)
+		for i := range parts {
+			if p[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64); err != nil {
+				return nil, errors.New("invalid parameter point: must be longitude,latitude")
+			}
+		}
+		if p[1] < -90 || p[1] > 90 {
+			return nil, errors.New("invalid parameter point: latitude must be from -90 to 90")
+		}
+		lr.Filter.Bounds = []float64{p[0], p[1], p[0], p[1]}
+	}
+	if lr.Filter.Bounds == nil {
+		return nil, errors.New("missing parameter bbox or point")
+	}
+	if err := lr.parseView(v); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+// byKey sorts Overlays, and their keys, in key order.
+type byKey struct {
+	keys     []*datastore.Key
+	overlays []*Overlay
+}
+
+func (s byKey) Len() int           { return len(s.keys) }
+func (s byKey) Less(i, j int) bool { return keyLess(s.keys[i], s.keys[j]) }
+func (s byKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.overlays[i], s.overlays[j] = s.overlays[j], s.overlays[i]
+}
+
+// searchOverlays returns, in key order, up to lr.Limit of the Overlays that
+// the principal may see that lie within the bounds of the request's filter
+// and match the rest of it, with their Role set, and reports whether there
+// may be more. Only owners are told who their Overlays are shared with.
+func searchOverlays(c appengine.Context, p *principal, lr *listRequest) ([]*datastore.Key, []*Overlay, bool, error) {
+	queries, err := accessQueries(c, p)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var keys []*datastore.Key
+	seen := make(map[string]bool)
+	more := false
+	for _, cell := range searchCells(lr.Filter.Bounds) {
+		for _, q := range queries {
+			found, err := q.Filter("Cells = ", cell).KeysOnly().Limit(maxSearchScan+1).GetAll(c, nil)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			for _, k := range found {
+				if seen[k.Encode()] {
+					continue
+				}
+				if len(keys) == maxSearchScan {
+					more = true
+					break
+				}
+				seen[k.Encode()] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	// Overlays deleted since they were found are skipped.
+	found := make([]*Overlay, len(keys))
+	for i := range found {
+		found[i] = new(Overlay)
+	}
+	err = datastore.GetMulti(c, keys, found)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, nil, false, err
+	}
+	var list byKey
+	for i, o := range found {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, nil, false, merr[i]
+		}
+		a := overlayAccess(p, o)
+		if a < accessView || !lr.Filter.matches(o) {
+			continue
+		}
+		o.Role = a.role()
+		if a != accessOwn {
+			o.Viewers, o.Editors = nil, nil
+		}
+		list.keys, list.overlays = append(list.keys, keys[i]), append(list.overlays, o)
+	}
+	sort.Sort(list)
+	if len(list.keys) > lr.Limit {
+		list.keys, list.overlays = list.keys[:lr.Limit], list.overlays[:lr.Limit]
+		more = true
+	}
+	return list.keys, list.overlays, more, nil
+}
+
+// reindexHandler sets the Cells of up to reindexBatch Overlays, in key order
+// from after the one whose encoded key is given by the "after" parameter,
+// and queues itself to reindex the next. It indexes Overlays stored before
+// they were indexed by where they lie.
+func reindexHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	q := datastore.NewQuery("Overlay").Order("__key__").KeysOnly().Limit(reindexBatch)
+	if s := r.FormValue("after"); s != "" {
+		k, err := datastore.DecodeKey(s)
+		if err != nil {
+			return &appError{err, "invalid parameter after", http.StatusBadRequest}
+		}
+		q = q.Filter("__key__ >", k)
+	}
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return appErrorf(err, "could not get overlays")
+	}
+	for _, k := range keys {
+		tx := func(c appengine.Context) error {
+			o := new(Overlay)
+			if err := datastore.Get(c, k, o); err != nil {
+				return err
+			}
+			old := strings.Join(o.Cells, ",")
+			if o.setCells(); strings.Join(o.Cells, ",") == old {
+				return nil
+			}
+			_, err := datastore.Put(c, k, o)
+			return err
+		}
+		if err := datastore.RunInTransaction(c, tx, nil); err != nil && err != datastore.ErrNoSuchEntity {
+			return appErrorf(err, "could not reindex overlay %s", k.Encode())
+		}
+	}
+	if len(keys) == reindexBatch {
+		task := taskqueue.NewPOSTTask("/reindex", url.Values{"after": {keys[len(keys)-1].Encode()}})
+		if _, err := taskqueue.Add(c, task, ""); err != nil {
+			return appErrorf(err, "could not queue reindex task")
+		}
+	}
+	fmt.Fprintf(w, "reindexed %d overlays", len(keys))
+	return nil
+}
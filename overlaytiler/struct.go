@@ -5,6 +5,7 @@ package overlaytiler
 
 import (
 	"fmt"
+	"time"
 
 	"appengine"
 	"appengine/datastore"
@@ -13,27 +14,71 @@ import (
 const (
 	tilesPerZoom = 1000 // limit to prevent DoS
 
-	sliceQueue = "slice"
-	tileQueue  = "tile"
-	zipQueue   = "zip"
-	sendQueue  = "send"
+	rasterQueue = "raster"
+	sliceQueue  = "slice"
+	tileQueue   = "tile"
+	zipQueue    = "zip"
+	sendQueue   = "send"
 
 	sliceBackend  = "slicer"
 	sliceBackends = 4
 	zipBackend    = "zipper"
 
 	zipSentinel = "ZIP_RUNNING"
+
+	deleteBatch  = 500  // limit on the entities deleted at once
+	maxTaskLease = 1000 // limit on the tasks leased at once
+
+	defaultTileSize = 256
 )
 
 // Overlay describes a map overlay image and the state of the tile generation
 // process. It is to be stored in the datastore. The presence of a valid
 // BlobKey in the Zip field indicates the process is complete.
 type Overlay struct {
+	Key    string            `datastore:"-"` // Encoded datastore key, for clients.
 	Owner  string            // User ID of the creator of this Overlay.
 	Image  appengine.BlobKey // Overlay image location.
 	Width  int               // Overlay image dimensions.
 	Height int
 
+	ImageBytes int64 // Size of the image blob.
+
+	// Created is when the Overlay was stored, and Updated when its user
+	// last changed it.
+	Created time.Time
+	Updated time.Time
+
+	// Orientation is the EXIF orientation of the uploaded image, from 1 to
+	// 8; Width and Height are those of the image once turned upright.
+	// Location is where the image was taken, as longitude and latitude from
+	// its EXIF GPS tags, as a hint for placing it (see exif.go).
+	Orientation int
+	Location    []float64
+
+	// Raster is the location of the image split into blocks; it holds
+	// rasterSentinel while the image is being split. RasterError is why the
+	// image could not be split, if it could not.
+	Raster      appengine.BlobKey
+	RasterError string
+
+	// Thumbnails are the locations of PNG thumbnails of the image, one for
+	// each of thumbnailSizes (see thumbnail.go). ThumbnailURL and PreviewURL
+	// are, for clients, the URLs of a thumbnail and of a preview of the
+	// placed Overlay.
+	Thumbnails   []appengine.BlobKey
+	ThumbnailURL string `datastore:"-"`
+	PreviewURL   string `datastore:"-"`
+
+	// Metadata set by the user (see metadata.go). Captured is when the
+	// image was made, if known.
+	Name        string
+	Description string `datastore:",noindex"`
+	Tags        []string
+	Attribution string `datastore:",noindex"`
+	License     string
+	Captured    time.Time
+
 	TopLeft     []float64 // Position of the overlay in world coordinates.
 	TopRight    []float64
 	BottomRight []float64
@@ -42,7 +87,77 @@ type Overlay struct {
 	MaxZoom     int64
 	Tiles       int // Total number of Tiles to generate.
 
+	// Cells are the quadkeys of the cells of the world that the placed
+	// Overlay lies in, by which it is found (see spatial.go).
+	Cells []string `json:"-"`
+
+	// Clip is a polygon, as x, y pairs in image pixels, outside which the
+	// image is transparent. Mask is the location of an alpha mask image
+	// stretched over the image, and MaskBounds the bounds of its
+	// non-transparent pixels as x0, y0, x1, y1 in image pixels (see clip.go).
+	Clip       []float64
+	Mask       appengine.BlobKey
+	MaskBounds []float64
+
+	// ColorKey, if set, is a colour, as "#rrggbb", that is made transparent
+	// in tiles, along with colours within Tolerance of it. LumaAlpha makes
+	// pixels transparent in proportion to their luminance. Opacity is the
+	// opacity of the tiles, from 0 to 1 (see transparency.go).
+	ColorKey  string
+	Tolerance int
+	LumaAlpha bool
+	Opacity   float64
+
+	// Adjustments to the colours of the image (see adjust.go). Levels holds
+	// the input black and white points; zero values leave the image
+	// unchanged.
+	Levels     []float64
+	Gamma      float64
+	Brightness float64
+	Contrast   float64
+	Saturation float64
+	Grayscale  bool
+	Tint       string
+
+	// TileSize is the width and height of tiles in pixels: 256 or 512.
+	// Tiles cover TileSize/2^zoom world units at each zoom level.
+	TileSize int
+	// Retina specifies that a high-DPI variant of each tile, twice its
+	// width and height, is generated too.
+	Retina bool
+	// Scheme is the tiling scheme that names the tiles in the zip file, and
+	// TileMatrixSet the EPSG code of the grid of tiles (see scheme.go).
+	Scheme        string
+	TileMatrixSet int
+
+	// Pyramid specifies that only the tiles at the highest zoom level are
+	// rendered from Image, and lower zoom levels are built from them.
+	Pyramid bool
+	Started time.Time // When the tile generation process was started.
+
+	// Layers, if set, makes the Overlay a mosaic of the Overlays with these
+	// keys, from the bottom layer to the top (see mosaic.go). Feather is the
+	// width, in pixels of their images, of the seams over which upper layers
+	// fade in.
+	Layers  []*datastore.Key
+	Feather int
+	layers  []*Overlay // the layers, once loaded by getOverlay
+
 	Zip appengine.BlobKey // Zip file location.
+
+	// Export is the location of the zip file holding the image exported as
+	// a GeoTIFF; it holds exportSentinel while the export is running.
+	Export appengine.BlobKey
+
+	// Viewers and Editors are who the Overlay is shared with besides its
+	// Owner: users by email address, and Groups as "group:" and their name.
+	// Signed links to the Overlay are revoked by incrementing LinkEpoch.
+	// Role is, for clients, the role of the user who requested the Overlay
+	// (see share.go).
+	Viewers   []string
+	Editors   []string
+	LinkEpoch int
+	Role      string `datastore:"-"`
 }
 
 // BottomLeft calculates the bottom-left point of the overlay, based on
@@ -55,9 +170,20 @@ func (o *Overlay) BottomLeft() (p []float64) {
 	return
 }
 
-// Tile represents a single tile, it is a child of Overlay.
+// tileSize returns the width and height of the Overlay's tiles in pixels.
+// Overlays processed before tile sizes were introduced have 256-pixel tiles.
+func (o *Overlay) tileSize() int {
+	if o.TileSize == 0 {
+		return defaultTileSize
+	}
+	return o.TileSize
+}
+
+// Tile represents a single tile, it is a child of Overlay. The high-DPI
+// variant of a tile, if any, is stored separately under RetinaKey.
 type Tile struct {
 	Image      []byte `json:"-"`
+	Retina     []byte `json:"-" datastore:"-"` // high-DPI variant
 	X, Y, Zoom int64  // tile coordinates
 }
 
@@ -69,12 +195,23 @@ func (t *Tile) Key(c appengine.Context, parent *datastore.Key) *datastore.Key {
 	return datastore.NewKey(c, "Tile", t.String(), 0, parent)
 }
 
+// RetinaKey returns the key of the Tile holding the high-DPI variant of t.
+func (t *Tile) RetinaKey(c appengine.Context, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "RetinaTile", t.String(), 0, parent)
+}
+
+// retinaTile returns the Tile to be stored under RetinaKey.
+func (t *Tile) retinaTile() *Tile {
+	return &Tile{Image: t.Retina, X: t.X, Y: t.Y, Zoom: t.Zoom}
+}
+
 // Message is the data structure that is sent (in JSON-encoded form) to the
 // client via the Channel API.
 type Message struct {
 	Total int
 	IDs   []string
 
-	TilesDone bool
-	ZipDone   bool
+	TilesDone  bool
+	ZipDone    bool
+	ExportDone bool
 }
@@ -15,9 +15,11 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"appengine"
+	"appengine/blobstore"
 	"appengine/channel"
 	"appengine/datastore"
 	"appengine/taskqueue"
@@ -30,6 +32,8 @@ import (
 
 func init() {
 	// Task handlers.
+	http.Handle("/geotiff", appHandler(geotiffHandler))
+	http.Handle("/raster", appHandler(rasterHandler))
 	http.Handle("/slice", appHandler(sliceHandler))
 	http.Handle("/zip", appHandler(zipHandler))
 }
@@ -37,6 +41,7 @@ func init() {
 // sliceHandler fetches Tile tasks from the tileQueue, 
 // generates and stores an image for each Tile, and - if all the
 // tiles have been generated - kicks off the zip task.
+// The optional "workers" parameter sets how many tiles are rendered at once.
 func sliceHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
 	tim := timer.New()
 
@@ -50,81 +55,31 @@ func sliceHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *
 
 	tim.Point("get Overlay")
 
-	m, err := imageBlob(c, o.Image)
+	// The sources of a mosaic are the images of its layers.
+	var srcs []imageSource
+	if o.isMosaic() {
+		srcs, err = layerSources(c, o)
+	} else {
+		var m imageSource
+		m, err = overlaySource(c, o)
+		srcs = []imageSource{m}
+	}
 	if err != nil {
 		return appErrorf(err, "could not get image")
 	}
 
 	tim.Point("get overlay Image")
 
-restart:
-	const (
-		inFlight   = 10 // tiles to process at once
-		secPerTile = 2  // worst-case time to process one tile
-	)
-
-	errc := make(chan error, o.Tiles/inFlight+1)
-	errs := 0
-	count := 0
-
-	// Generate images for the provided tiles.
-	for {
-		tasks, err := taskqueue.LeaseByTag(c, inFlight, tileQueue, inFlight*secPerTile, k.Encode())
-		if err != nil {
-			return appErrorf(err, "couldn't get more tasks")
-		}
-		if len(tasks) == 0 {
-			// No more work to do.
-			break
-		}
-		tiles := make([]*Tile, len(tasks))
-		keys := make([]*datastore.Key, len(tasks))
-		for i, task := range tasks {
-			tile := new(Tile)
-			err = json.Unmarshal(task.Payload, tile)
-			if err != nil {
-				panic(err)
-			}
-			err = slice(c, tile, o.Transform, m)
-			if err != nil {
-				panic(err)
-			}
-			tiles[i] = tile
-			keys[i] = tile.Key(c, k)
+	workers := sliceWorkers
+	if v := r.FormValue("workers"); v != "" {
+		if workers, err = strconv.Atoi(v); err != nil {
+			return appErrorf(err, "invalid parameter workers")
 		}
-
-		// Store generated tiles in datastore while going back to
-		// generate more.
-		go func() {
-			_, err = datastore.PutMulti(c, keys, tiles)
-			if err != nil {
-				errc <- err
-				return
-			}
-			for _, task := range tasks {
-				err = taskqueue.Delete(c, task, tileQueue)
-				if err != nil {
-					errc <- err
-					return
-				}
-			}
-			var ids []string
-			for _, t := range tiles {
-				ids = append(ids, t.String())
-			}
-			send(c, k.Encode(), Message{Total: o.Tiles, IDs: ids})
-			count += len(tiles)
-			errc <- nil
-		}()
-		errs++
 	}
 
-	// Wait for all goroutines to finish.
-	for i := 0; i < errs; i++ {
-		if e := <-errc; err == nil && e != nil {
-			err = e
-		}
-	}
+restart:
+	// Generate and store images for the Overlay's tiles.
+	count, err := newSlicer(c, k, o, srcs, workers).run()
 	if err != nil {
 		return appErrorf(err, "could not generate tiles")
 	}
@@ -155,31 +110,251 @@ restart:
 	return nil
 }
 
-// slice draws the specified tile using the given transformation and source
-// image and stores it in the provided Tile's Image field.
-func slice(c appengine.Context, tile *Tile, transform []float64, m image.Image) error {
+// rasterHandler splits an Overlay's image into a raster, stores it in
+// blobstore, and records its BlobKey in the Overlay. Once the task has been
+// retried maxRasterRetries times, it gives up and records in the Overlay why
+// the image could not be split.
+func rasterHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	k, o, err := getOverlay(r)
+	if err != nil {
+		return appErrorf(err, "overlay not found")
+	}
+	e := rasterize(c, k, o)
+	if e == nil {
+		return nil
+	}
+	if n, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount")); n < maxRasterRetries {
+		return e
+	}
+	c.Errorf("giving up splitting image of overlay %s: %s: %v", k.Encode(), e.Message, e.Error)
+	tx := func(c appengine.Context) error {
+		o := new(Overlay)
+		if err := datastore.Get(c, k, o); err != nil {
+			return err
+		}
+		if o.Raster != rasterSentinel {
+			return nil
+		}
+		o.Raster, o.RasterError = "", e.Message
+		if e.Error != nil {
+			o.RasterError += ": " + e.Error.Error()
+		}
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return appErrorf(err, "could not store overlay")
+	}
+	return nil
+}
+
+// rasterize splits the image of the Overlay with the specified key into a
+// raster, as rasterHandler does.
+func rasterize(c appengine.Context, k *datastore.Key, o *Overlay) *appError {
+	rr, err := newRowReader(c, o.Image)
+	if err != nil {
+		return appErrorf(err, "could not read image")
+	}
+	if rr, err = orientRows(rr, o.Orientation); err != nil {
+		return appErrorf(err, "could not turn image upright")
+	}
+	bw, err := blobstore.Create(c, "application/octet-stream")
+	if err != nil {
+		return appErrorf(err, "could not create raster blob")
+	}
+	if err := writeRaster(bw, rr); err != nil {
+		return appErrorf(err, "could not write raster")
+	}
+	if err := bw.Close(); err != nil {
+		return appErrorf(err, "could not close raster blob")
+	}
+	bk, err := bw.Key()
+	if err != nil {
+		return appErrorf(err, "could not get raster blob key")
+	}
+
+	// Make thumbnails from the smallest levels of the raster. An Overlay
+	// without thumbnails is still usable.
+	var thumbs []appengine.BlobKey
+	if src, err := openRaster(c, bk); err != nil {
+		c.Warningf("could not open raster for thumbnails: %v", err)
+	} else if thumbs, err = makeThumbnails(c, src); err != nil {
+		c.Warningf("could not make thumbnails: %v", err)
+	}
+
+	// Update the Overlay in a transaction, as it may have been placed in
+	// the meantime.
+	tx := func(c appengine.Context) error {
+		o := new(Overlay)
+		if err := datastore.Get(c, k, o); err != nil {
+			return err
+		}
+		o.Raster, o.Thumbnails = bk, thumbs
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return appErrorf(err, "could not store overlay")
+	}
+	return nil
+}
+
+// geotiffHandler exports an Overlay's image as a GeoTIFF on the grid given by
+// the "crs" and "zoom" parameters, stores the zip file holding it in
+// blobstore, and records its BlobKey in the Overlay.
+func geotiffHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	k, o, err := getOverlay(r)
+	if err != nil {
+		return appErrorf(err, "overlay not found")
+	}
+	g, err := parseExportGrid(o, r.FormValue("crs"), r.FormValue("zoom"))
+	if err != nil {
+		return appErrorf(err, "invalid export parameters")
+	}
+	src, err := overlaySource(c, o)
+	if err != nil {
+		return appErrorf(err, "could not read overlay image")
+	}
+
+	bw, err := blobstore.Create(c, "application/zip")
+	if err != nil {
+		return appErrorf(err, "could not create export blob")
+	}
+	if err := writeExport(bw, k.Encode(), g, o, src); err != nil {
+		return appErrorf(err, "could not write export")
+	}
+	if err := bw.Close(); err != nil {
+		return appErrorf(err, "could not close export blob")
+	}
+	bk, err := bw.Key()
+	if err != nil {
+		return appErrorf(err, "could not get export blob key")
+	}
+
+	tx := func(c appengine.Context) error {
+		if err := reloadOverlay(c, k, o); err != nil {
+			return err
+		}
+		o.Export = bk
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
+		return appErrorf(err, "could not store overlay")
+	}
+
+	// Tell the client we're done.
+	send(c, k.Encode(), Message{ExportDone: true})
+	return nil
+}
+
+// slice draws the specified tile of the Overlay from the given source image
+// and stores it in the provided Tile's Image field, and its high-DPI variant
+// in the Retina field if the Overlay has them.
+func slice(c appengine.Context, tile *Tile, o *Overlay, src imageSource) error {
 	// Convert the transformation matrix to a graphics.Affine.
 	var a graphics.Affine
-	copy(a[:], transform)
+	copy(a[:], o.Transform)
 
+	render := tileRenderer(o)
+	m, err := render(a, tile, o.tileSize(), 1, src)
+	if err != nil {
+		return err
+	}
+	o.applyTransparency(m)
+	if err := encodeTile(tile, m); err != nil {
+		return err
+	}
+	if !o.Retina {
+		return nil
+	}
+	if m, err = render(a, tile, o.tileSize(), 2, src); err != nil {
+		return err
+	}
+	o.applyTransparency(m)
+	tile.Retina, err = encodePNG(m)
+	return err
+}
+
+// tileRenderer returns the function that draws the tiles of the Overlay's
+// tile matrix set.
+func tileRenderer(o *Overlay) func(graphics.Affine, *Tile, int, int, imageSource) (*image.RGBA, error) {
+	if ms := o.tileMatrixSet(); ms.EPSG != 3857 {
+		return ms.renderTile
+	}
+	return renderTile
+}
+
+// renderTile draws the specified Web Mercator tile, of size pixels at scale 1,
+// using the given transformation from world coordinates to source image
+// pixels. The image is drawn at the specified scale: 2 for high-DPI tiles.
+func renderTile(a graphics.Affine, tile *Tile, size, scale int, src imageSource) (*image.RGBA, error) {
 	// Scale and translate the matrix for this Tile's coordinates.
-	s := math.Pow(2, float64(tile.Zoom))
-	a = a.Scale(s, s).Translate(float64(-tile.X*256), float64(-tile.Y*256))
+	s := math.Pow(2, float64(tile.Zoom)) * float64(scale)
+	px := int64(size * scale)
+	a = a.Scale(s, s).Translate(float64(-tile.X*px), float64(-tile.Y*px))
 
 	// Allocate the target image and draw the transformation into it.
-	m2 := image.NewRGBA(image.Rect(0, 0, 256, 256))
-	a.Transform(m2, m, interp.Bilinear)
+	m2 := image.NewRGBA(image.Rect(0, 0, int(px), int(px)))
+	if err := drawAffine(m2, a, s, src); err != nil {
+		return nil, err
+	}
+	return m2, nil
+}
 
-	// Generate PNG-encoded image and store it in the Image field.
-	buf := new(bytes.Buffer)
-	err := png.Encode(buf, m2)
+// drawAffine draws src into dst using a, which maps dst pixels to source
+// pixels at level 0, and on which a world unit spans s dst pixels. The
+// columns of Overlays that cross the antimeridian are wrapped, so dst may
+// hold parts of the Overlay from the world to the west or east.
+func drawAffine(dst *image.RGBA, a graphics.Affine, s float64, src imageSource) error {
+	// Draw from the smallest level of detail that is no coarser than dst,
+	// scaling the matrix to match.
+	n := sourceLevel(a, src.levels())
+	f := math.Pow(2, float64(n))
+	level := src.level(n)
+	for k := -1; k <= 1; k++ {
+		ak := graphics.I.Scale(f, f).Mul(a.Translate(float64(-k*256)*s, 0))
+		if !overlaps(ak, dst.Rect, level.Bounds()) {
+			continue
+		}
+		ak.Transform(dst, level, interp.Bilinear)
+	}
+	return src.err()
+}
+
+// overlaps reports whether a, which maps destination pixels to source pixels,
+// maps any part of the destination rectangle dst into the source rectangle src.
+func overlaps(a graphics.Affine, dst, src image.Rectangle) bool {
+	var xs, ys []float64
+	for _, p := range []image.Point{dst.Min, {dst.Max.X, dst.Min.Y}, {dst.Min.X, dst.Max.Y}, dst.Max} {
+		x, y := float64(p.X), float64(p.Y)
+		xs = append(xs, a[0]*x+a[1]*y+a[2])
+		ys = append(ys, a[3]*x+a[4]*y+a[5])
+	}
+	return max(xs...) > float64(src.Min.X) && min(xs...) < float64(src.Max.X) &&
+		max(ys...) > float64(src.Min.Y) && min(ys...) < float64(src.Max.Y)
+}
+
+// encodeTile generates a PNG-encoded image from m and stores it in the
+// provided Tile's Image field.
+func encodeTile(tile *Tile, m image.Image) error {
+	b, err := encodePNG(m)
 	if err != nil {
 		return err
 	}
-	tile.Image = buf.Bytes()
+	tile.Image = b
 	return nil
 }
 
+// encodePNG returns the PNG encoding of m.
+func encodePNG(m image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // checkDone tests whether we have generated all the tiles.
 // If so, it creates a zip task on the zipper backend.
 func checkDone(c appengine.Context, oKey *datastore.Key) (done bool, err error) {
@@ -196,7 +371,7 @@ func checkDone(c appengine.Context, oKey *datastore.Key) (done bool, err error)
 		if err != nil {
 			return err
 		}
-		done = o.Tiles >= count
+		done = count >= o.Tiles
 		if !done || o.Zip != "" {
 			return nil
 		}
@@ -227,9 +402,9 @@ func checkDone(c appengine.Context, oKey *datastore.Key) (done bool, err error)
 	return done, nil
 }
 
-// zipHandler creates a zip file containing all tile images and an index.html
-// containing a Maps API tile overlay, writes it to blobstore, and updates
-// stores the BlobKey in the Overlay.
+// zipHandler creates a zip file containing all tile images, an index.html
+// containing a Maps API tile overlay and the Overlay's metadata, writes it to
+// blobstore, and updates stores the BlobKey in the Overlay.
 func zipHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
 	k, o, err := getOverlay(r)
 	if err != nil {
@@ -241,7 +416,7 @@ func zipHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *ap
 	z := zip.NewWriter(buf)
 
 	// Add the tiles.
-	if err := addTilesToZip(c, z, k); err != nil {
+	if err := addTilesToZip(c, z, k, o); err != nil {
 		return appErrorf(err, "could not add tile images to zip file")
 	}
 
@@ -250,19 +425,45 @@ func zipHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *ap
 		return appErrorf(err, "could not generate index.html")
 	}
 
+	// Add the metadata files.
+	if err := addMetadataToZip(z, k, o); err != nil {
+		return appErrorf(err, "could not add metadata to zip file")
+	}
+
 	// Finish writing the zip file.
 	if err := z.Close(); err != nil {
 		return appErrorf(err, "could not close zip")
 	}
 
-	// Store the buffer in blobstore and update the overlay.
-	o.Zip, err = createBlob(c, buf, "application/zip")
+	// Store the buffer in blobstore and update the overlay. The Overlay is
+	// updated in a transaction, as it may have been changed or shared
+	// while the zip file was built.
+	bk, err := createBlob(c, buf, "application/zip")
 	if err != nil {
 		return appErrorf(err, "could not store zip file")
 	}
-	if _, err := datastore.Put(c, k, o); err != nil {
+	stale := false
+	tx := func(c appengine.Context) error {
+		if err := reloadOverlay(c, k, o); err != nil {
+			return err
+		}
+		if stale = o.Zip != zipSentinel; stale {
+			return nil
+		}
+		o.Zip = bk
+		_, err := datastore.Put(c, k, o)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, tx, nil); err != nil {
 		return appErrorf(err, "could not store overlay")
 	}
+	if stale {
+		// The Overlay was processed again while the zip file was built.
+		if err := blobstore.Delete(c, bk); err != nil {
+			c.Warningf("deleting stale zip file: %v", err)
+		}
+		return nil
+	}
 
 	// Tell the client we're done.
 	send(c, k.Encode(), Message{ZipDone: true})
@@ -271,24 +472,28 @@ func zipHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *ap
 }
 
 // addTilesToZip fetches all the Tile records for a given Overlay, fetches
-// their associated image blobs, and adds them to the provided zip file.
-func addTilesToZip(c appengine.Context, z *zip.Writer, oKey *datastore.Key) error {
+// their associated image blobs, and adds them to the provided zip file, named
+// according to the Overlay's tiling scheme. High-DPI tiles are named with an
+// "@2x" suffix.
+func addTilesToZip(c appengine.Context, z *zip.Writer, oKey *datastore.Key, o *Overlay) error {
 	base := oKey.Encode()
-	q := datastore.NewQuery("Tile").Ancestor(oKey)
-	for i := q.Run(c); ; {
-		var t Tile
-		if _, err := i.Next(&t); err == datastore.Done {
-			break
-		} else if err != nil {
-			return err
-		}
-		name := fmt.Sprintf("%s/%d/%d/%d.png", base, t.Zoom, t.X, t.Y)
-		w, err := z.Create(name)
-		if err != nil {
-			return err
-		}
-		if _, err = w.Write(t.Image); err != nil {
-			return err
+	for _, kind := range []struct{ name, suffix string }{{"Tile", ""}, {"RetinaTile", "@2x"}} {
+		q := datastore.NewQuery(kind.name).Ancestor(oKey)
+		for i := q.Run(c); ; {
+			var t Tile
+			if _, err := i.Next(&t); err == datastore.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("%s/%s%s.png", base, o.tilePath(&t), kind.suffix)
+			w, err := z.Create(name)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(t.Image); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -306,6 +511,7 @@ func addIndexToZip(c appengine.Context, z *zip.Writer, oKey *datastore.Key, o *O
 
 var zipTemplate = template.Must(template.New("zip.html").Funcs(template.FuncMap{
 	"coord": coordString,
+	"grid":  overlayGrid,
 }).ParseFiles("templates/zip.html"))
 
 // coordString returns a string representation of two float64 coordinates.
@@ -0,0 +1,174 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+
+	"appengine"
+
+	"code.google.com/p/graphics-go/graphics"
+)
+
+// Thumbnails of an Overlay's image are made when it is split into a raster,
+// and stored as PNG blobs, so that lists of Overlays need not fetch their
+// images. A preview of a placed Overlay, drawn where it lies on a blank Web
+// Mercator canvas, is rendered on request.
+
+// thumbnailSizes are the widths and heights of the boxes that an Overlay's
+// thumbnails fit in, in pixels. Overlay.Thumbnails follows their order.
+var thumbnailSizes = []int{64, 128, 256}
+
+const (
+	defaultThumbnailSize = 128
+	maxPreviewSize       = 512 // limit on the width and height of previews
+)
+
+// makeThumbnails stores thumbnails of the image read from src, one for each
+// of thumbnailSizes, and returns their BlobKeys.
+func makeThumbnails(c appengine.Context, src imageSource) ([]appengine.BlobKey, error) {
+	var keys []appengine.BlobKey
+	for _, size := range thumbnailSizes {
+		m := previewImage(src, size)
+		if err := src.err(); err != nil {
+			return keys, err
+		}
+		b, err := encodePNG(m)
+		if err != nil {
+			return keys, err
+		}
+		k, err := createBlob(c, bytes.NewReader(b), "image/png")
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// thumbnailKey returns the BlobKey of the Overlay's thumbnail of the
+// specified size, if it has one.
+func (o *Overlay) thumbnailKey(size int) (appengine.BlobKey, bool) {
+	for i, s := range thumbnailSizes {
+		if s == size && i < len(o.Thumbnails) {
+			return o.Thumbnails[i], true
+		}
+	}
+	return "", false
+}
+
+// previewImage returns the image read from src reduced to fit within size
+// pixels on each side. Each pixel is the average of the source pixels it
+// covers.
+func previewImage(src imageSource, size int) *image.RGBA {
+	// Start from the smallest level of detail that is still large enough.
+	n := 0
+	for n+1 < src.levels() {
+		b := src.level(n + 1).Bounds()
+		if b.Dx() < size && b.Dy() < size {
+			break
+		}
+		n++
+	}
+	m := src.level(n)
+	b := m.Bounds()
+	scale := math.Max(1, math.Max(float64(b.Dx()), float64(b.Dy()))/float64(size))
+	w := int(math.Max(1, math.Floor(float64(b.Dx())/scale)))
+	h := int(math.Max(1, math.Floor(float64(b.Dy())/scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := int(float64(y)*scale), int(float64(y+1)*scale)
+		for x := 0; x < w; x++ {
+			x0, x1 := int(float64(x)*scale), int(float64(x+1)*scale)
+			var sum [4]uint32
+			count := uint32(0)
+			for sy := y0; sy < y1 && sy < b.Dy(); sy++ {
+				for sx := x0; sx < x1 && sx < b.Dx(); sx++ {
+					r, g, bl, a := m.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					sum[0], sum[1], sum[2], sum[3] = sum[0]+r>>8, sum[1]+g>>8, sum[2]+bl>>8, sum[3]+a>>8
+					count++
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			for j := range sum {
+				dst.Pix[i+j] = uint8(sum[j] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// placedPreview draws the placed Overlay where it lies on a blank Web
+// Mercator canvas, at the highest zoom level at which it fits within
+// maxPreviewSize pixels.
+func placedPreview(c appengine.Context, o *Overlay) (*image.RGBA, error) {
+	var srcs []imageSource
+	if o.isMosaic() {
+		var err error
+		if srcs, err = layerSources(c, o); err != nil {
+			return nil, err
+		}
+	} else {
+		src, err := overlaySource(c, o)
+		if err != nil {
+			return nil, err
+		}
+		srcs = []imageSource{src}
+	}
+	return drawPreview(o, srcs)
+}
+
+// drawPreview draws the preview of the placed Overlay from the given sources
+// of its image, or of its layers if it is a mosaic.
+func drawPreview(o *Overlay, srcs []imageSource) (*image.RGBA, error) {
+	minX, minY, maxX, maxY, err := tileMatrixSets[3857].extent(o)
+	if err != nil {
+		return nil, err
+	}
+	zoom := math.Floor(math.Log2(maxPreviewSize / math.Max(maxX-minX, maxY-minY)))
+	zoom = math.Max(0, math.Min(zoom, 21))
+	s := math.Pow(2, zoom)
+	w := int(math.Max(1, math.Ceil((maxX-minX)*s)))
+	h := int(math.Max(1, math.Ceil((maxY-minY)*s)))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	layers := []*Overlay{o}
+	if o.isMosaic() {
+		layers = o.layers
+	}
+	for i, l := range layers {
+		var a graphics.Affine
+		copy(a[:], l.Transform)
+		a = a.Scale(s, s).Translate(-minX*s, -minY*s)
+		m := image.NewRGBA(dst.Rect)
+		if err := drawAffine(m, a, s, srcs[i]); err != nil {
+			return nil, err
+		}
+		l.applyTransparency(m)
+		draw.Draw(dst, dst.Rect, m, image.ZP, draw.Over)
+	}
+	if o.isMosaic() {
+		o.applyTransparency(dst)
+	}
+	return dst, nil
+}
+
+// setPreviewURLs sets the Overlay's ThumbnailURL and PreviewURL, for those it
+// has, from its encoded key.
+func (o *Overlay) setPreviewURLs() {
+	q := url.Values{"key": {o.Key}}
+	if len(o.Thumbnails) > 0 {
+		o.ThumbnailURL = "/thumbnail?" + q.Encode()
+	}
+	if o.Transform != nil || o.isMosaic() {
+		q.Set("placed", "true")
+		o.PreviewURL = "/thumbnail?" + q.Encode()
+	}
+}
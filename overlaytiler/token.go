@@ -0,0 +1,323 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Build scripts and other clients that cannot log in interactively act for a
+// user with an API token, sent as "Authorization: Bearer <token>". A token is
+// allowed only the scopes it was created with. Tokens are created, listed and
+// revoked through the JSON API by a logged-in user; they cannot manage tokens
+// themselves.
+//
+// Handlers that accept tokens are wrapped by authHandler, and app.yaml leaves
+// their login to it. An upload made with a token sends the same header to
+// the blobstore upload URL, which passes it on to the upload handler.
+
+// API token scopes.
+const (
+	scopeRead    = "read"    // list and get Overlays, their tiles and downloads
+	scopeUpload  = "upload"  // upload images
+	scopeProcess = "process" // process, export and combine Overlays
+	scopeShare   = "share"   // share Overlays and manage groups
+)
+
+var tokenScopes = []string{scopeRead, scopeUpload, scopeProcess, scopeShare}
+
+const (
+	tokenPrefix      = "otk_"    // marks the secret of an API token
+	tokenBytes       = 20        // random bytes in a token's secret
+	maxTokens        = 20        // limit on the tokens a user may hold
+	maxTokenName     = 100       // length limit for a token's name
+	tokenUseInterval = time.Hour // how often LastUsed is updated
+)
+
+// APIToken is an API token of a user. It is stored in the datastore keyed by
+// tokenID of its secret; the secret itself is shown only when it is created.
+type APIToken struct {
+	Owner    string // user ID
+	Email    string // the owner's email address, for sharing
+	Name     string `datastore:",noindex"`
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// tokenID returns the ID of the API token with the specified secret, which
+// is the hex-encoded SHA-256 hash of the secret.
+func tokenID(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func tokenKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "APIToken", id, 0, nil)
+}
+
+// errNoToken is returned by lookupToken if the secret is not that of an API
+// token.
+var errNoToken = errors.New("no such API token")
+
+// lookupToken fetches the API token with the specified secret.
+func lookupToken(c appengine.Context, secret string) (*datastore.Key, *APIToken, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, nil, errNoToken
+	}
+	k := tokenKey(c, tokenID(secret))
+	t := new(APIToken)
+	if err := datastore.Get(c, k, t); err == datastore.ErrNoSuchEntity {
+		return nil, nil, errNoToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return k, t, nil
+}
+
+// A principal is the user on whose behalf a request is made.
+type principal struct {
+	UserID string
+	Email  string         // in lower case
+	Admin  bool           // whether the logged-in user is an administrator
+	Token  *datastore.Key // the API token used, or nil if logged in
+	Scopes []string       // the scopes of the API token
+
+	// Groups are the names of the Groups the user is a member of, once
+	// loaded by loadGroups.
+	Groups       []string
+	groupsLoaded bool
+}
+
+// allows reports whether the principal may act within the specified scope.
+// Logged-in users may do anything.
+func (p *principal) allows(scope string) bool {
+	if p.Token == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// A userHandler serves requests made on behalf of the principal it is given.
+type userHandler func(appengine.Context, *principal, http.ResponseWriter, *http.Request) *appError
+
+// authHandler authenticates requests to h, by API token or else by login,
+// and requires that they be allowed the specified scope. An empty scope
+// leaves checking scopes to h, with requireScope.
+func authHandler(scope string, h userHandler) appHandler {
+	return func(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+		p, e := authenticate(c, w, r)
+		if e != nil {
+			return e
+		}
+		if scope != "" && !p.allows(scope) {
+			return scopeError(scope)
+		}
+		return h(c, p, w, r)
+	}
+}
+
+// requireScope returns an appError if the principal is not allowed the
+// specified scope.
+func requireScope(p *principal, scope string) *appError {
+	if p == nil || !p.allows(scope) {
+		return scopeError(scope)
+	}
+	return nil
+}
+
+func scopeError(scope string) *appError {
+	return &appError{nil, "API token lacks scope " + scope, http.StatusForbidden}
+}
+
+// authenticate returns the principal of a request: the owner of the API
+// token in its Authorization header, if it has one, or the logged-in user.
+func authenticate(c appengine.Context, w http.ResponseWriter, r *http.Request) (*principal, *appError) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		if u := user.Current(c); u != nil {
+			return &principal{UserID: u.ID, Email: strings.ToLower(u.Email), Admin: u.Admin}, nil
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="overlay-tiler"`)
+		return nil, &appError{nil, "login or an API token is required", http.StatusUnauthorized}
+	}
+	const bearer = "Bearer "
+	if !strings.HasPrefix(h, bearer) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="overlay-tiler", error="invalid_request"`)
+		return nil, &appError{nil, "Authorization must be a Bearer token", http.StatusUnauthorized}
+	}
+	k, t, err := lookupToken(c, strings.TrimSpace(h[len(bearer):]))
+	if err == errNoToken {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="overlay-tiler", error="invalid_token"`)
+		return nil, &appError{err, "invalid or revoked API token", http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, appErrorf(err, "could not get API token")
+	}
+	if now := time.Now(); now.Sub(t.LastUsed) > tokenUseInterval {
+		t.LastUsed = now
+		if _, err := datastore.Put(c, k, t); err != nil {
+			c.Warningf("recording use of API token: %v", err)
+		}
+	}
+	return &principal{UserID: t.Owner, Email: t.Email, Token: k, Scopes: t.Scopes}, nil
+}
+
+// An apiToken is the representation of an APIToken in the API. Its Secret is
+// given only when it is created.
+type apiToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Secret   string     `json:"secret,omitempty"`
+}
+
+func newAPIToken(k *datastore.Key, t *APIToken) *apiToken {
+	a := &apiToken{
+		ID:      k.StringID(),
+		Name:    t.Name,
+		Scopes:  t.Scopes,
+		Created: t.Created,
+	}
+	if !t.LastUsed.IsZero() {
+		a.LastUsed = &t.LastUsed
+	}
+	return a
+}
+
+// apiTokens dispatches requests to manage the user's API tokens, whose path
+// below apiPrefix is given in parts:
+//
+//	GET    tokens      list the user's API tokens
+//	POST   tokens      create an API token
+//	DELETE tokens/{id} revoke an API token
+func apiTokens(c appengine.Context, p *principal, w http.ResponseWriter, r *http.Request, parts []string) *appError {
+	if p == nil || p.Token != nil {
+		return &appError{nil, "API tokens can only be managed when logged in", http.StatusForbidden}
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		return listTokens(c, w, p.UserID)
+	case len(parts) == 1 && r.Method == "POST":
+		return createToken(c, w, r, p)
+	case len(parts) == 1:
+		return methodNotAllowed(w, "GET", "POST")
+	case len(parts) == 2 && r.Method == "DELETE":
+		return revokeToken(c, w, p.UserID, parts[1])
+	case len(parts) == 2:
+		return methodNotAllowed(w, "DELETE")
+	}
+	return &appError{nil, "no such resource", http.StatusNotFound}
+}
+
+// listTokens writes the API tokens of the specified user.
+func listTokens(c appengine.Context, w http.ResponseWriter, uid string) *appError {
+	var tokens []*APIToken
+	keys, err := datastore.NewQuery("APIToken").Filter("Owner = ", uid).GetAll(c, &tokens)
+	if err != nil {
+		return appErrorf(err, "could not get API tokens")
+	}
+	list := make([]*apiToken, len(keys))
+	for i, k := range keys {
+		list[i] = newAPIToken(k, tokens[i])
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Tokens []*apiToken `json:"tokens"`
+	}{list})
+	return nil
+}
+
+// createToken creates an API token for the specified principal, with the
+// "name" and comma-separated "scopes" parameters, and writes it with its
+// secret.
+func createToken(c appengine.Context, w http.ResponseWriter, r *http.Request, p *principal) *appError {
+	uid := p.UserID
+	name := strings.TrimSpace(r.FormValue("name"))
+	if len(name) > maxTokenName {
+		return &appError{nil, "name is too long", http.StatusBadRequest}
+	}
+	scopes, err := parseScopes(r.FormValue("scopes"))
+	if err != nil {
+		return &appError{err, "invalid parameter scopes: " + err.Error(), http.StatusBadRequest}
+	}
+	n, err := datastore.NewQuery("APIToken").Filter("Owner = ", uid).KeysOnly().Count(c)
+	if err != nil {
+		return appErrorf(err, "could not count API tokens")
+	}
+	if n >= maxTokens {
+		return &appError{nil, "too many API tokens; revoke one first", http.StatusConflict}
+	}
+
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return appErrorf(err, "could not create API token")
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	t := &APIToken{Owner: uid, Email: p.Email, Name: name, Scopes: scopes, Created: time.Now()}
+	k, err := datastore.Put(c, tokenKey(c, tokenID(secret)), t)
+	if err != nil {
+		return appErrorf(err, "could not save API token")
+	}
+	a := newAPIToken(k, t)
+	a.Secret = secret
+	w.Header().Set("Location", apiPrefix+"tokens/"+a.ID)
+	writeJSON(w, http.StatusCreated, a)
+	return nil
+}
+
+// parseScopes parses a comma-separated list of scopes. An empty list allows
+// every scope.
+func parseScopes(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return tokenScopes, nil
+	}
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		ok := false
+		for _, scope := range tokenScopes {
+			ok = ok || v == scope
+		}
+		if !ok {
+			return nil, errors.New("unknown scope " + v)
+		}
+		if !seen[v] {
+			seen[v] = true
+			scopes = append(scopes, v)
+		}
+	}
+	return scopes, nil
+}
+
+// revokeToken deletes the specified user's API token with the given ID.
+func revokeToken(c appengine.Context, w http.ResponseWriter, uid, id string) *appError {
+	k := tokenKey(c, id)
+	t := new(APIToken)
+	if err := datastore.Get(c, k, t); err == datastore.ErrNoSuchEntity || err == nil && t.Owner != uid {
+		return &appError{err, "API token not found", http.StatusNotFound}
+	} else if err != nil {
+		return appErrorf(err, "could not get API token")
+	}
+	if err := datastore.Delete(c, k); err != nil {
+		return appErrorf(err, "could not revoke API token")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// The white paper of a scanned plan hides the basemap beneath it. An Overlay
+// may make its tiles partly transparent, as the opacity slider of the editor
+// previews in the browser: by keying out a colour, by turning luminance into
+// transparency so that light paper vanishes and dark ink remains, and by an
+// overall opacity. These are applied to each tile as it is rendered, before
+// it is encoded; pyramid tiles, made from rendered tiles, inherit them.
+
+const maxTolerance = 255
+
+// opacity returns the opacity of the Overlay's tiles. Overlays processed
+// before opacity was introduced are opaque.
+func (o *Overlay) opacity() float64 {
+	if o.Opacity == 0 {
+		return 1
+	}
+	return o.Opacity
+}
+
+// transparent reports whether the Overlay's tiles are made partly
+// transparent.
+func (o *Overlay) transparent() bool {
+	return o.ColorKey != "" || o.LumaAlpha || o.opacity() < 1
+}
+
+// parseTransparency sets the Overlay's transparency options from the
+// "colorKey", "tolerance", "lumaAlpha" and "opacity" parameters of a process
+// request. The colour key is given as "#rrggbb" or "rrggbb", and tolerance
+// is the difference, from 0 to 255 in each of red, green and blue, of the
+// colours that are keyed out along with it.
+func parseTransparency(o *Overlay, colorKey, tolerance, lumaAlpha, opacity string) error {
+	o.ColorKey, o.Tolerance, o.LumaAlpha, o.Opacity = "", 0, false, 1
+	if colorKey != "" {
+		if _, err := parseColor(colorKey); err != nil {
+			return fmt.Errorf("invalid parameter colorKey: %v", err)
+		}
+		o.ColorKey = "#" + strings.ToLower(strings.TrimPrefix(colorKey, "#"))
+	}
+	if tolerance != "" {
+		t, err := strconv.Atoi(tolerance)
+		if err != nil || t < 0 || t > maxTolerance {
+			return fmt.Errorf("invalid parameter tolerance: must be from 0 to %d", maxTolerance)
+		}
+		if o.ColorKey == "" {
+			return fmt.Errorf("invalid parameter tolerance: no colorKey was given")
+		}
+		o.Tolerance = t
+	}
+	if lumaAlpha != "" {
+		var err error
+		if o.LumaAlpha, err = strconv.ParseBool(lumaAlpha); err != nil {
+			return fmt.Errorf("invalid parameter lumaAlpha")
+		}
+	}
+	if opacity != "" {
+		a, err := strconv.ParseFloat(opacity, 64)
+		if err != nil || !(a > 0 && a <= 1) {
+			return fmt.Errorf("invalid parameter opacity: must be greater than 0 and at most 1")
+		}
+		o.Opacity = a
+	}
+	return nil
+}
+
+// parseColor parses a colour given as "#rrggbb" or "rrggbb".
+func parseColor(s string) ([3]uint8, error) {
+	var c [3]uint8
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return c, fmt.Errorf("%q is not a colour of the form #rrggbb", s)
+	}
+	for i := range c {
+		v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return c, fmt.Errorf("%q is not a colour of the form #rrggbb", s)
+		}
+		c[i] = uint8(v)
+	}
+	return c, nil
+}
+
+// applyTransparency makes the rendered tile image m as transparent as the
+// Overlay specifies.
+func (o *Overlay) applyTransparency(m *image.RGBA) {
+	if !o.transparent() {
+		return
+	}
+	key, keyed := [3]uint8{}, false
+	if o.ColorKey != "" {
+		var err error
+		key, err = parseColor(o.ColorKey)
+		keyed = err == nil
+	}
+	opacity := o.opacity()
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		p := m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)]
+		for i := 0; i+3 < len(p); i += 4 {
+			a := p[i+3]
+			if a == 0 {
+				continue
+			}
+			// The pixels of m are alpha-premultiplied; the key and the
+			// luminance apply to their colour.
+			var c [3]int
+			for j := range c {
+				c[j] = int(p[i+j]) * 0xff / int(a)
+			}
+			f := opacity
+			if keyed && within(c, key, o.Tolerance) {
+				f = 0
+			}
+			if o.LumaAlpha {
+				luma := 0.299*float64(c[0]) + 0.587*float64(c[1]) + 0.114*float64(c[2])
+				f *= 1 - luma/0xff
+			}
+			for j := 0; j < 4; j++ {
+				p[i+j] = uint8(float64(p[i+j])*f + 0.5)
+			}
+		}
+	}
+}
+
+// within reports whether each component of the colour c differs from that
+// of key by at most tolerance.
+func within(c [3]int, key [3]uint8, tolerance int) bool {
+	for j := range c {
+		if d := c[j] - int(key[j]); d > tolerance || d < -tolerance {
+			return false
+		}
+	}
+	return true
+}
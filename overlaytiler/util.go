@@ -4,6 +4,7 @@
 package overlaytiler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -13,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 
+	_ "geotiff"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -46,6 +48,18 @@ func inverse(a graphics.Affine) graphics.Affine {
 	}
 }
 
+// overlayTransform computes the transformation matrix that maps world
+// coordinates to pixels of the Overlay's image, given its corners.
+func overlayTransform(o *Overlay) []float64 {
+	a := graphics.I.Scale(1/float64(o.Width), 1/float64(o.Height)).
+		Mul(inverse(graphics.Affine{
+			o.TopRight[0] - o.TopLeft[0], o.BottomRight[0] - o.TopRight[0], o.TopLeft[0],
+			o.TopRight[1] - o.TopLeft[1], o.BottomRight[1] - o.TopRight[1], o.TopLeft[1],
+			0, 0, 1,
+		}))
+	return []float64(a[:])
+}
+
 func max(n ...float64) (r float64) {
 	r = n[0]
 	for i := 1; i < len(n); i++ {
@@ -67,25 +81,59 @@ func min(n ...float64) (r float64) {
 }
 
 // getOverlay fetches an Overlay (identified by the "key" form value)
-// from the datastore.
+// from the datastore, without checking who may see it. Handlers acting for a
+// user use requestOverlay instead.
 func getOverlay(r *http.Request) (*datastore.Key, *Overlay, error) {
-	c := appengine.NewContext(r)
-	ks := r.FormValue("key")
+	return loadOverlay(appengine.NewContext(r), r.FormValue("key"))
+}
+
+// errNoOverlay is returned by loadOverlay if there is no Overlay with the
+// specified key.
+var errNoOverlay = errors.New("no such overlay")
+
+// loadOverlay fetches the Overlay with the specified encoded key from the
+// datastore, along with its layers if it is a mosaic.
+func loadOverlay(c appengine.Context, ks string) (*datastore.Key, *Overlay, error) {
 	k, err := datastore.DecodeKey(ks)
-	if err != nil {
-		return nil, nil, err
+	if err != nil || k.Kind() != "Overlay" {
+		return nil, nil, errNoOverlay
 	}
 	o := new(Overlay)
-	if err := datastore.Get(c, k, o); err != nil {
+	if err := datastore.Get(c, k, o); err == datastore.ErrNoSuchEntity {
+		return nil, nil, errNoOverlay
+	} else if err != nil {
 		return nil, nil, err
 	}
+	if o.isMosaic() {
+		if o.layers, err = getLayers(c, o.Layers); err != nil {
+			return nil, nil, err
+		}
+	}
 	return k, o, nil
 }
 
+// reloadOverlay gets the Overlay with the specified key into o again, in
+// place of its stored fields; Get would append to the slices of a loaded
+// Overlay. Its other fields are kept.
+func reloadOverlay(c appengine.Context, k *datastore.Key, o *Overlay) error {
+	fresh := &Overlay{
+		Key:          o.Key,
+		ThumbnailURL: o.ThumbnailURL,
+		PreviewURL:   o.PreviewURL,
+		Role:         o.Role,
+		layers:       o.layers,
+	}
+	if err := datastore.Get(c, k, fresh); err != nil {
+		return err
+	}
+	*o = *fresh
+	return nil
+}
+
 // scaleCoord converts a magnitude from mercator pixels to tile coordinates at
-// a specified zoom level.
-func scaleCoord(p float64, zoom int64) (t int64) {
-	return int64(p * math.Pow(2, float64(zoom)) / 256) // floor
+// a specified zoom level, for tiles of the specified size in pixels.
+func scaleCoord(p float64, zoom int64, size int) (t int64) {
+	return int64(math.Floor(p * math.Pow(2, float64(zoom)) / float64(size)))
 }
 
 // parsePair parses a comma separated pair of floats into a []float64.
@@ -107,7 +155,13 @@ type appHandler func(appengine.Context, http.ResponseWriter, *http.Request) *app
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	if e := fn(c, w, r); e != nil {
-		http.Error(w, e.Message, e.Code)
+		if ue, ok := e.Error.(*uploadError); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(e.Code)
+			json.NewEncoder(w).Encode(ue)
+		} else {
+			http.Error(w, e.Message, e.Code)
+		}
 		c.Errorf("%s (%v)", e.Message, e.Error)
 	}
 }
@@ -137,10 +191,17 @@ func createBlob(c appengine.Context, r io.Reader, contentType string) (appengine
 	return w.Key()
 }
 
-// imageBlob fetches the specified blob and decodes it as an image.
+// imageBlob fetches the specified blob and decodes it as an image. Images of
+// more than maxDecodePixels pixels are not decoded.
 func imageBlob(c appengine.Context, k appengine.BlobKey) (image.Image, error) {
-	r := blobstore.NewReader(c, k)
-	m, _, err := image.Decode(r)
+	cfg, _, err := image.DecodeConfig(blobstore.NewReader(c, k))
+	if err != nil {
+		return nil, err
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > maxDecodePixels {
+		return nil, fmt.Errorf("image has %d pixels; images decoded in full are limited to %d pixels", pixels, maxDecodePixels)
+	}
+	m, _, err := image.Decode(blobstore.NewReader(c, k))
 	return m, err
 }
 
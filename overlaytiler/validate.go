@@ -0,0 +1,214 @@
+// Copyright (c) Google Inc. All Rights Reserved.
+
+package overlaytiler
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+)
+
+// Uploaded images are checked before they are accepted: their size, their
+// dimensions as declared in their header, and their format as sniffed from
+// their content. Images are never decoded in full by uploadHandler, and only
+// images that cannot be read a band of rows at a time are decoded in full by
+// the raster task, so a small file that declares a huge image is rejected
+// before it can exhaust memory.
+
+const (
+	maxUploadBytes  = 512 << 20 // size limit for any uploaded file
+	maxImageSide    = 1 << 17   // width and height limit for images
+	maxDecodePixels = 1 << 26   // pixel count limit for images decoded in full
+)
+
+// Quota holds the upload limits of a user. It is stored in the datastore
+// keyed by user ID; users without one are subject to defaultQuota.
+type Quota struct {
+	MaxBytes      int64 // size limit for a single image
+	MaxPixels     int64 // pixel count limit for a single image
+	MaxTotalBytes int64 // limit on the total size of a user's images
+}
+
+var defaultQuota = Quota{
+	MaxBytes:      128 << 20,
+	MaxPixels:     1 << 30,
+	MaxTotalBytes: 2 << 30,
+}
+
+// userQuota returns the upload limits of the specified user.
+func userQuota(c appengine.Context, userID string) (*Quota, error) {
+	q := new(Quota)
+	err := datastore.Get(c, datastore.NewKey(c, "Quota", userID, 0, nil), q)
+	if err == datastore.ErrNoSuchEntity {
+		*q = defaultQuota
+		return q, nil
+	}
+	return q, err
+}
+
+// An uploadError explains to the client why an upload was rejected. It is
+// written to the response as JSON.
+type uploadError struct {
+	Reason  string // one of the reasons below
+	Message string
+	Limit   int64 `json:",omitempty"` // the limit that was exceeded
+	Value   int64 `json:",omitempty"` // the value that exceeded it
+}
+
+func (e *uploadError) Error() string { return e.Message }
+
+// Upload rejection reasons.
+const (
+	rejectMissing    = "missing"
+	rejectFormat     = "format"
+	rejectMismatch   = "mismatch"
+	rejectBytes      = "bytes"
+	rejectDimensions = "dimensions"
+	rejectPixels     = "pixels"
+	rejectQuota      = "quota"
+	rejectSidecar    = "sidecar"
+	rejectMask       = "mask"
+	rejectMetadata   = "metadata"
+)
+
+// rejectUpload returns an appError that rejects an upload with the specified
+// status code and reason.
+func rejectUpload(code int, reason, format string, v ...interface{}) *appError {
+	msg := fmt.Sprintf(format, v...)
+	return &appError{&uploadError{Reason: reason, Message: msg}, msg, code}
+}
+
+// rejectLimit returns an appError that rejects an upload because value
+// exceeds limit.
+func rejectLimit(code int, reason string, value, limit int64, format string, v ...interface{}) *appError {
+	e := rejectUpload(code, reason, format, v...)
+	ue := e.Error.(*uploadError)
+	ue.Value, ue.Limit = value, limit
+	return e
+}
+
+// Supported image formats, by MIME type.
+var (
+	imageTypes = map[string]bool{
+		"image/gif":  true,
+		"image/jpeg": true,
+		"image/png":  true,
+		"image/tiff": true,
+	}
+	typeAliases = map[string]string{
+		"image/jpg":   "image/jpeg",
+		"image/pjpeg": "image/jpeg",
+		"image/x-png": "image/png",
+		"image/tif":   "image/tiff",
+		"image/x-tif": "image/tiff",
+	}
+	extensionTypes = map[string]string{
+		".gif":  "image/gif",
+		".jpeg": "image/jpeg",
+		".jpg":  "image/jpeg",
+		".png":  "image/png",
+		".tif":  "image/tiff",
+		".tiff": "image/tiff",
+	}
+)
+
+// sniffType returns the MIME type of the image held in b, the start of a
+// file, or "" if it is not of a supported format.
+func sniffType(b []byte) string {
+	s := string(b)
+	if strings.HasPrefix(s, "II*\x00") || strings.HasPrefix(s, "MM\x00*") {
+		return "image/tiff"
+	}
+	if t := http.DetectContentType(b); imageTypes[t] {
+		return t
+	}
+	return ""
+}
+
+// checkUpload checks an uploaded image, whose header declares it to be of
+// dimensions m, against the user's quota and the limits above.
+func checkUpload(c appengine.Context, info *blobstore.BlobInfo, m image.Config, userID string, q *Quota) *appError {
+	if info.Size > q.MaxBytes {
+		return rejectLimit(http.StatusRequestEntityTooLarge, rejectBytes, info.Size, q.MaxBytes,
+			"image is %d bytes; the limit is %d bytes", info.Size, q.MaxBytes)
+	}
+
+	// The format sniffed from the content must match the declared one.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(blobstore.NewReader(c, info.BlobKey), head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return appErrorf(err, "could not read image")
+	}
+	sniffed := sniffType(head[:n])
+	if sniffed == "" {
+		return rejectUpload(http.StatusUnsupportedMediaType, rejectFormat,
+			"unsupported image format; use PNG, JPEG, GIF or TIFF")
+	}
+	declared := strings.ToLower(info.ContentType)
+	if t, ok := typeAliases[declared]; ok {
+		declared = t
+	}
+	if !imageTypes[declared] {
+		declared = extensionTypes[strings.ToLower(path.Ext(info.Filename))]
+	}
+	if declared != "" && declared != sniffed {
+		return rejectUpload(http.StatusUnsupportedMediaType, rejectMismatch,
+			"file was uploaded as %s but holds %s", declared, sniffed)
+	}
+
+	// The declared dimensions must be within the limits. Images that will
+	// be decoded in full are held to a lower limit.
+	if m.Width <= 0 || m.Height <= 0 || m.Width > maxImageSide || m.Height > maxImageSide {
+		return rejectUpload(http.StatusRequestEntityTooLarge, rejectDimensions,
+			"image is %dx%d pixels; each side must be from 1 to %d pixels", m.Width, m.Height, maxImageSide)
+	}
+	pixels := int64(m.Width) * int64(m.Height)
+	if pixels > q.MaxPixels {
+		return rejectLimit(http.StatusRequestEntityTooLarge, rejectPixels, pixels, q.MaxPixels,
+			"image has %d pixels; the limit is %d pixels", pixels, q.MaxPixels)
+	}
+	if pixels > maxDecodePixels && !streamable(c, info.BlobKey, sniffed) {
+		return rejectLimit(http.StatusRequestEntityTooLarge, rejectPixels, pixels, maxDecodePixels,
+			"image has %d pixels; unless stored as TIFF or non-interlaced PNG, images are limited to %d pixels",
+			pixels, maxDecodePixels)
+	}
+
+	// The user's images must fit in their quota. Only the sizes of their
+	// images are read, by a projection query.
+	total := info.Size
+	sizes := datastore.NewQuery("Overlay").Filter("Owner = ", userID).Project("ImageBytes")
+	for i := sizes.Run(c); ; {
+		var o struct{ ImageBytes int64 }
+		if _, err := i.Next(&o); err == datastore.Done {
+			break
+		} else if err != nil {
+			return appErrorf(err, "could not get overlays")
+		}
+		total += o.ImageBytes
+	}
+	if total > q.MaxTotalBytes {
+		return rejectLimit(http.StatusForbidden, rejectQuota, total, q.MaxTotalBytes,
+			"your images would take %d bytes; your quota is %d bytes", total, q.MaxTotalBytes)
+	}
+	return nil
+}
+
+// streamable reports whether the raster task can read the image of the
+// specified type a band of rows at a time (see newRowReader).
+func streamable(c appengine.Context, k appengine.BlobKey, typ string) bool {
+	switch typ {
+	case "image/tiff":
+		return true
+	case "image/png":
+		_, err := newPNGRows(blobstore.NewReader(c, k))
+		return err == nil
+	}
+	return false
+}
@@ -10,8 +10,56 @@ window.addEventListener('load', function() {
   addNavEvents(map);
 
   new SearchWidget(map, document.querySelector('#kd-search'));
+  showOverlaysInView(map);
 });
 
+/**
+ * Outlines the bounds of the user's overlays, and those shared with them,
+ * that lie within the map's viewport, each time the map comes to rest.
+ *
+ * @param {google.maps.Map} map
+ */
+function showOverlaysInView(map) {
+  var outlines = [];
+  var xhr = null;
+  google.maps.event.addListener(map, 'idle', function() {
+    var bounds = map.getBounds();
+    if (!bounds) return;
+    var sw = bounds.getSouthWest();
+    var ne = bounds.getNorthEast();
+    var east = ne.lng();
+    if (east < sw.lng()) {
+      // The viewport crosses the antimeridian.
+      east += 360;
+    }
+    var bbox = [sw.lng(), sw.lat(), east, ne.lat()].join(',');
+    if (xhr) xhr.abort();
+    xhr = new XMLHttpRequest;
+    xhr.open('GET', '/search.json?view=summary&bbox=' + bbox, true);
+    xhr.onload = function() {
+      if (xhr.status != 200) return;
+      var overlays = JSON.parse(xhr.responseText) || [];
+      for (var i = 0, outline; outline = outlines[i]; i++) {
+        outline.setMap(null);
+      }
+      outlines = [];
+      for (var i = 0, o; o = overlays[i]; i++) {
+        var b = o.Bounds;
+        outlines.push(new google.maps.Rectangle({
+          map: map,
+          bounds: new google.maps.LatLngBounds(
+              new google.maps.LatLng(b[1], b[0]),
+              new google.maps.LatLng(b[3], b[2])),
+          clickable: false,
+          fillOpacity: 0.05,
+          strokeWeight: 1
+        }));
+      }
+    };
+    xhr.send();
+  });
+}
+
 /**
  * Adds the events to the navbar
  *
@@ -69,7 +117,26 @@ function addDragAndDrop(map) {
       window.alert('No file uploaded');
       return;
     }
-    var imageURL = (window.URL || window.webkitURL).createObjectURL(files[0]);
+
+    // A georeferencing sidecar file, and an alpha mask named like
+    // "map-mask.png" that clips the image, may be dropped along with it.
+    var image = files[0], sidecar = null, mask = null;
+    for (var i = 0, file; file = files[i]; i++) {
+      if (/\.(wld|[a-z]{2}w|points|aux\.xml)$/i.test(file.name)) {
+        sidecar = file;
+      } else if (/[._-]mask\.(png|gif)$/i.test(file.name)) {
+        mask = file;
+      } else {
+        image = file;
+      }
+    }
+    var maxBytes = +document.querySelector('#max-upload-bytes').value;
+    if (image.size > maxBytes) {
+      window.alert('The image is too large: the limit is ' +
+          Math.floor(maxBytes / (1 << 20)) + ' MB.');
+      return;
+    }
+    var imageURL = (window.URL || window.webkitURL).createObjectURL(image);
 
     var rect = map.getDiv().getBoundingClientRect();
     var x = e.pageX - rect.left;
@@ -83,7 +150,7 @@ function addDragAndDrop(map) {
 
     var editor = new OverlayEditor(overlay);
 
-    uploadInBackground(files[0], map, overlay);
+    uploadInBackground(image, sidecar, mask, map, overlay);
   }, false);
 }
 
@@ -91,10 +158,12 @@ function addDragAndDrop(map) {
  * Uploads given file to blob store.
  *
  * @param {File} file
+ * @param {?File} sidecar georeferencing for file, if any.
+ * @param {?File} mask alpha mask clipping file, if any.
  * @param {google.maps.Map} map
  * @param {Overlay} overlay
  */
-function uploadInBackground(file, map, overlay) {
+function uploadInBackground(file, sidecar, mask, map, overlay) {
   // FIXME(cbro): position this somewhere less ugly.
   var progress = document.createElement('progress');
   map.controls[google.maps.ControlPosition.TOP_RIGHT].push(
@@ -103,17 +172,26 @@ function uploadInBackground(file, map, overlay) {
   var xhr = new XMLHttpRequest;
   xhr.open('POST', document.querySelector('#upload-url').value, true);
   xhr.onload = function(e) {
-    // TODO(cbro): more robust error handling.
-    if (xhr.statusText != 'OK') {
-      window.alert(xhr.statusText + ': ' + xhr.responseText);
+    if (xhr.status != 200) {
+      // Rejected uploads are explained by a JSON object with a Reason and
+      // a Message.
+      var msg = xhr.responseText;
+      try {
+        msg = JSON.parse(msg).Message;
+      } catch (err) {}
+      window.alert('Upload failed: ' + msg);
+      progress.parentNode.removeChild(progress);
       return;
     }
     overlay.setKey(xhr.responseText);
     console.log(overlay.getKey());
+    placeFromServer(map, overlay);
     var processButton = new ProcessButton(overlay, function(token) {
       new StatusBox(overlay, token);
     });
     map.controls[google.maps.ControlPosition.TOP_RIGHT].push(processButton);
+    map.controls[google.maps.ControlPosition.TOP_RIGHT].push(
+        new ExportButton(overlay));
     progress.parentNode.removeChild(progress);
   };
 
@@ -129,5 +207,70 @@ function uploadInBackground(file, map, overlay) {
 
   var form = new FormData;
   form.append('overlay', file);
+  if (sidecar) {
+    form.append('sidecar', sidecar);
+  }
+  if (mask) {
+    form.append('mask', mask);
+  }
   xhr.send(form);
 }
+
+/**
+ * Moves the overlay to the position the server derived from the image's
+ * georeferencing, if it has any, or else to where a photo was taken.
+ *
+ * @param {google.maps.Map} map
+ * @param {Overlay} overlay
+ */
+function placeFromServer(map, overlay) {
+  var xhr = new XMLHttpRequest;
+  xhr.open('GET', '/overlays.json', true);
+  xhr.onload = function() {
+    if (xhr.status != 200) return;
+    var overlays = JSON.parse(xhr.responseText) || [];
+    var proj = map.getProjection();
+    var latLng = function(p) {
+      return proj.fromPointToLatLng(new google.maps.Point(p[0], p[1]));
+    };
+    for (var i = 0, o; o = overlays[i]; i++) {
+      if (o.Key != overlay.getKey()) continue;
+      if (o.TopLeft) {
+        overlay.set('topLeft', latLng(o.TopLeft));
+        overlay.set('topRight', latLng(o.TopRight));
+        overlay.set('bottomRight', latLng(o.BottomRight));
+        map.panTo(latLng(o.TopLeft));
+      } else if (o.Location) {
+        // Photos record where they were taken: move the overlay there,
+        // keeping its size, for the user to place it exactly.
+        moveOverlayTo(map, overlay,
+            new google.maps.LatLng(o.Location[1], o.Location[0]));
+      }
+    }
+  };
+  xhr.send();
+}
+
+/**
+ * Moves the overlay so that it is centred on the given position, and pans
+ * the map there.
+ *
+ * @param {google.maps.Map} map
+ * @param {Overlay} overlay
+ * @param {google.maps.LatLng} center
+ */
+function moveOverlayTo(map, overlay, center) {
+  var proj = map.getProjection();
+  var tl = proj.fromLatLngToPoint(overlay.get('topLeft'));
+  var br = proj.fromLatLngToPoint(overlay.get('bottomRight'));
+  var c = proj.fromLatLngToPoint(center);
+  var dx = c.x - (tl.x + br.x) / 2;
+  var dy = c.y - (tl.y + br.y) / 2;
+  var corners = ['topLeft', 'topRight', 'bottomRight'];
+  for (var i = 0, corner; corner = corners[i]; i++) {
+    var p = proj.fromLatLngToPoint(overlay.get(corner));
+    overlay.set(corner, proj.fromPointToLatLng(
+        new google.maps.Point(p.x + dx, p.y + dy)));
+  }
+  map.panTo(center);
+}
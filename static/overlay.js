@@ -162,9 +162,20 @@ Overlay.prototype.computeTransform_ = function() {
  * @param {number} opacity the opacity, between 0 and 1.
  */
 Overlay.prototype.setOpacity = function(opacity) {
+  this.set('opacity', opacity);
   this.el_.style.opacity = opacity + '';
 };
 
+/**
+ * Returns the opacity of the image.
+ *
+ * @return {number} the opacity, between 0 and 1.
+ */
+Overlay.prototype.getOpacity = function() {
+  var opacity = this.get('opacity');
+  return opacity == null ? 1 : opacity;
+};
+
 /**
  * Sets the unique Overlay key provided by the server.
  *
@@ -107,8 +107,73 @@ function OpacityWidget(overlay) {
  */
 function ProcessButton(overlay, callback) {
   // TODO(cbro): prettify
+  var container = document.createElement('div');
+
+  var tileSize = document.createElement('select');
+  tileSize.innerHTML = '<option value="256">256px tiles</option>' +
+      '<option value="512">512px tiles</option>';
+  container.appendChild(tileSize);
+
+  var scheme = document.createElement('select');
+  scheme.innerHTML = '<option value="xyz">XYZ</option>' +
+      '<option value="tms">TMS</option>' +
+      '<option value="quadkey">Quadkeys</option>';
+  container.appendChild(scheme);
+
+  var matrixSet = document.createElement('select');
+  matrixSet.innerHTML = '<option value="3857">Web Mercator</option>' +
+      '<option value="4326">EPSG:4326</option>' +
+      '<option value="27700">British National Grid</option>' +
+      '<option value="2056">Swiss LV95</option>';
+  container.appendChild(matrixSet);
+
+  var label = document.createElement('label');
+  var retina = document.createElement('input');
+  retina.type = 'checkbox';
+  label.appendChild(retina);
+  label.appendChild(document.createTextNode('@2x'));
+  container.appendChild(label);
+
+  // A colour, such as the white of the paper, may be made transparent in
+  // the tiles, and light colours may fade in proportion to their luminance.
+  var keyLabel = document.createElement('label');
+  var keyed = document.createElement('input');
+  keyed.type = 'checkbox';
+  keyLabel.appendChild(keyed);
+  keyLabel.appendChild(document.createTextNode('Key out'));
+  container.appendChild(keyLabel);
+
+  var colorKey = document.createElement('input');
+  colorKey.type = 'color';
+  colorKey.value = '#ffffff';
+  container.appendChild(colorKey);
+
+  var tolerance = document.createElement('input');
+  tolerance.type = 'number';
+  tolerance.min = 0;
+  tolerance.max = 255;
+  tolerance.value = 16;
+  tolerance.title = 'Tolerance';
+  container.appendChild(tolerance);
+
+  var lumaLabel = document.createElement('label');
+  var lumaAlpha = document.createElement('input');
+  lumaAlpha.type = 'checkbox';
+  lumaLabel.appendChild(lumaAlpha);
+  lumaLabel.appendChild(document.createTextNode('Luminance to alpha'));
+  container.appendChild(lumaLabel);
+
+  // High-DPI tiles are only made for 256px tiles.
+  tileSize.onchange = function() {
+    retina.disabled = tileSize.value != '256';
+    if (retina.disabled) {
+      retina.checked = false;
+    }
+  };
+
   var button = document.createElement('button');
   button.innerHTML = 'Process';
+  container.appendChild(button);
 
   button.onclick = function() {
     document.body.classList.add('processing');
@@ -122,14 +187,24 @@ function ProcessButton(overlay, callback) {
       key: overlay.getKey(),
       topLeft: xy(overlay.get('topLeft')),
       topRight: xy(overlay.get('topRight')),
-      bottomRight: xy(overlay.get('bottomRight'))
+      bottomRight: xy(overlay.get('bottomRight')),
+      tileSize: tileSize.value,
+      retina: retina.checked,
+      scheme: scheme.value,
+      tileMatrixSet: matrixSet.value,
+      lumaAlpha: lumaAlpha.checked,
+      opacity: Math.max(overlay.getOpacity(), 0.01)
     };
+    if (keyed.checked) {
+      params.colorKey = colorKey.value;
+      params.tolerance = tolerance.value;
+    }
 
     var xhr = new XMLHttpRequest;
     xhr.onload = function(e) {
       if (xhr.status != 200) {
-        // TODO(adg): notify user that process failed
-        console.log('process', xhr.status);
+        document.body.classList.remove('processing');
+        window.alert('Could not process the overlay: ' + xhr.responseText);
         return;
       }
       callback(xhr.responseText);
@@ -138,6 +213,44 @@ function ProcessButton(overlay, callback) {
     xhr.send();
   };
 
+  return container;
+}
+
+/**
+ * A button that exports the overlay as a GeoTIFF in Web Mercator, and
+ * downloads it once the export is done.
+ *
+ * @param {!Overlay} overlay
+ * @return {Element}
+ */
+function ExportButton(overlay) {
+  var button = document.createElement('button');
+  button.innerHTML = 'Export GeoTIFF';
+
+  button.onclick = function() {
+    var key = overlay.getKey();
+    var xhr = new XMLHttpRequest;
+    xhr.onload = function(e) {
+      if (xhr.status != 200) {
+        window.alert('Export failed: ' + xhr.responseText);
+        return;
+      }
+      button.disabled = true;
+      var sock = new goog.appengine.Channel(xhr.responseText).open();
+      sock.onmessage = function(msg) {
+        if (JSON.parse(msg.data).ExportDone) {
+          button.disabled = false;
+          window.location = '/download?format=geotiff&key=' + key;
+        }
+      };
+      sock.onclose = sock.onerror = function() {
+        button.disabled = false;
+      };
+    };
+    xhr.open('POST', '/export?' + objToUrlParams({key: key}), true);
+    xhr.send();
+  };
+
   return button;
 }
 